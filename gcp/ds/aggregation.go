@@ -0,0 +1,78 @@
+package ds
+
+import(
+	"fmt"
+)
+
+/*
+
+ n,err := p.Count(ctx, ds.NewQuery("Flight").Filter("Airline =", "UA"))
+
+ res,err := p.Aggregate(ctx, ds.NewQuery("Flight"),
+   ds.AggregateCount("n"), ds.AggregateAvg("Altitude", "avgAlt"))
+ fmt.Printf("%d flights, avg altitude %.0f\n", res.Int("n"), res.Float("avgAlt"))
+
+ */
+
+type AggregationType string
+
+const(
+	AggCount AggregationType = "count"
+	AggSum   AggregationType = "sum"
+	AggAvg   AggregationType = "avg"
+)
+
+// Aggregation is computed server-side over the results of a query; the result is returned
+// under the alias.
+type Aggregation struct {
+	Type   AggregationType
+	Field  string // Unused for AggCount
+	Alias  string
+}
+
+// If the alias is empty, these will pick one; e.g. "count", or "sum_Altitude".
+func AggregateCount(alias string) Aggregation {
+	return Aggregation{AggCount, "", alias}.withDefaultAlias()
+}
+func AggregateSum(field, alias string) Aggregation {
+	return Aggregation{AggSum, field, alias}.withDefaultAlias()
+}
+func AggregateAvg(field, alias string) Aggregation {
+	return Aggregation{AggAvg, field, alias}.withDefaultAlias()
+}
+
+func (a Aggregation)withDefaultAlias() Aggregation {
+	if a.Alias == "" {
+		a.Alias = string(a.Type)
+		if a.Field != "" { a.Alias += "_" + a.Field }
+	}
+	return a
+}
+
+func (a Aggregation)String() string {
+	if a.Type == AggCount { return fmt.Sprintf("%s()->%q", a.Type, a.Alias) }
+	return fmt.Sprintf("%s(%q)->%q", a.Type, a.Field, a.Alias)
+}
+
+// AggregationResult maps each aggregation's alias to its result. Counts are int64; sums are
+// int64 if all the summed values were integers, else float64; averages are float64, or nil if
+// there was nothing to average.
+type AggregationResult map[string]interface{}
+
+// Int returns the named result as an int64 (truncating floats); zero if it is missing or nil.
+func (ar AggregationResult)Int(alias string) int64 {
+	switch v := ar[alias].(type) {
+	case int64:   return v
+	case float64: return int64(v)
+	}
+	return 0
+}
+
+// Float returns the named result as a float64; zero if it is missing or nil.
+func (ar AggregationResult)Float(alias string) float64 {
+	switch v := ar[alias].(type) {
+	case int64:   return float64(v)
+	case float64: return v
+	}
+	return 0
+}
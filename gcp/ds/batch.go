@@ -0,0 +1,42 @@
+package ds
+
+import(
+	"sync"
+)
+
+// MaxBatchSize is the most keys that datastore will accept in a single get, put or delete.
+const MaxBatchSize = 500
+
+// DefaultBatchConcurrency is how many batches a large multi-operation will run at once.
+const DefaultBatchConcurrency = 4
+
+// runBatches splits n items into batches of at most size, and calls f on each [lo,hi) range,
+// with up to concurrency calls running at once. The ranges don't overlap, so f can safely write
+// into per-item slots of shared slices (e.g. a MultiError).
+func runBatches(n, size, concurrency int, f func(lo, hi int)) {
+	if n <= size {
+		f(0, n)
+		return
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	numBatches := (n + size - 1) / size
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i:=0; i<numBatches; i++ {
+		lo,hi := i*size, (i+1)*size
+		if hi > n { hi = n }
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(lo, hi int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(lo, hi)
+		}(lo, hi)
+	}
+	wg.Wait()
+}
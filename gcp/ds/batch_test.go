@@ -0,0 +1,58 @@
+package ds
+
+import(
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunBatches(t *testing.T) {
+	tests := []struct {
+		N, Size, Concurrency   int
+		ExpBatches             int
+	}{
+		{0, 500, 4, 1},
+		{10, 500, 4, 1},
+		{500, 500, 4, 1},
+		{501, 500, 4, 2},
+		{2345, 500, 2, 5},
+		{2345, 100, 0, 24},
+	}
+
+	for _,test := range tests {
+		var mu sync.Mutex
+		running, maxRunning, batches := 0, 0, 0
+		seen := make([]int, test.N)
+
+		runBatches(test.N, test.Size, test.Concurrency, func(lo, hi int) {
+			mu.Lock()
+			running++
+			batches++
+			if running > maxRunning { maxRunning = running }
+			mu.Unlock()
+
+			if hi-lo > test.Size {
+				t.Errorf("batch [%d,%d) bigger than %d", lo, hi, test.Size)
+			}
+			for i:=lo; i<hi; i++ { seen[i]++ }
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+
+		if batches != test.ExpBatches {
+			t.Errorf("%+v: expected %d batches, got %d", test, test.ExpBatches, batches)
+		}
+		if limit := test.Concurrency; limit > 0 && maxRunning > limit {
+			t.Errorf("%+v: %d batches ran at once", test, maxRunning)
+		}
+		for i,n := range seen {
+			if n != 1 {
+				t.Errorf("%+v: item %d was in %d batches", test, i, n)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package ds
+
+import(
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+/*
+
+ cp := ds.NewCachingProvider(p, ds.NewMemcacheEntityCache("10.0.0.3:11211"), &ds.CachingOptions{
+   DefaultTTL: time.Hour,
+   KindTTLs: map[string]time.Duration{"Schedule":5*time.Minute, "Flight":-1}, // Never cache flights
+ })
+ ... use cp wherever you'd have used p ...
+
+ // Or, just within this process
+ cp := ds.NewCachingProvider(p, ds.NewLRUEntityCache(10000), nil)
+
+ */
+
+// CachingOptions configures a CachingProvider; the zero value caches everything, without
+// expiry.
+type CachingOptions struct {
+	DefaultTTL  time.Duration            // For kinds not in KindTTLs; zero means no expiry
+	KindTTLs    map[string]time.Duration // Per kind; a negative TTL means don't cache that kind
+}
+
+func (opts CachingOptions)ttl(kind string) time.Duration {
+	if ttl,exists := opts.KindTTLs[kind]; exists { return ttl }
+	return opts.DefaultTTL
+}
+
+// CachingProvider wraps another provider, and keeps the entities it reads in an EntityCache,
+// keyed by their encoded datastore key. Get and GetMulti read through the cache; writes (incl.
+// Mutate, and transactions) remove the entities they touch. Queries, and reads inside
+// transactions, always go to the datastore.
+//
+// Entities are cached as their raw properties, so different structs can be loaded from the
+// same cached entity. Problems with the cache are logged, and then ignored.
+//
+// A read that overlaps a write can still put the old version of an entity back in the cache,
+// where it stays until its TTL expires, or it is written again.
+type CachingProvider struct {
+	DatastoreProvider
+	cache     EntityCache
+	opts      CachingOptions
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+}
+
+// NewCachingProvider wraps p; opts may be nil.
+func NewCachingProvider(p DatastoreProvider, cache EntityCache, opts *CachingOptions) *CachingProvider {
+	o := CachingOptions{}
+	if opts != nil { o = *opts }
+	return &CachingProvider{DatastoreProvider:p, cache:cache, opts:o}
+}
+
+// CacheStats returns how many entities have been found in the cache, and how many have not
+// (and so were read from the datastore).
+func (cp *CachingProvider)CacheStats() (hits, misses int64) {
+	return cp.hits.Load(), cp.misses.Load()
+}
+
+// {{{ cache keys, encoding
+
+// cacheKey is empty for keys that can't (or shouldn't) be cached.
+func (cp *CachingProvider)cacheKey(keyer Keyer) string {
+	k := toDatastoreKey(keyer)
+	if k == nil || k.Incomplete() || cp.opts.ttl(k.Kind) < 0 {
+		return ""
+	}
+	return k.Encode()
+}
+
+func (cp *CachingProvider)invalidate(ctx context.Context, keyers []Keyer) {
+	cacheKeys := []string{}
+	for _,k := range keyers {
+		if cacheKey := cp.cacheKey(k); cacheKey != "" { cacheKeys = append(cacheKeys, cacheKey) }
+	}
+	if len(cacheKeys) == 0 {
+		return
+	}
+	if err := cp.cache.Delete(cacheKeys...); err != nil {
+		cp.Warningf(ctx, "dsprovider: cache invalidation failed, %d keys: %v", len(cacheKeys), err)
+	}
+}
+
+// The property value types are registered with gob in memoryprovider.go.
+func encodeProperties(props []datastore.Property) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(props)
+	return buf.Bytes(), err
+}
+
+func decodeProperties(b []byte) ([]datastore.Property, error) {
+	props := []datastore.Property{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&props)
+	return props, err
+}
+
+// }}}
+// {{{ getMulti
+
+// getMulti loads an entity into each of dsts, from the cache if possible. The MultiError has
+// the per-entity errors; the error is for when the whole thing failed.
+func (cp *CachingProvider)getMulti(ctx context.Context, keyers []Keyer, dsts []interface{}) (MultiError, error) {
+	cacheKeys := make([]string, len(keyers))
+	lookup := []string{}
+	for i,k := range keyers {
+		cacheKeys[i] = cp.cacheKey(k)
+		if cacheKeys[i] != "" { lookup = append(lookup, cacheKeys[i]) }
+	}
+
+	found := map[string][]byte{}
+	if len(lookup) > 0 {
+		var err error
+		if found,err = cp.cache.GetMulti(lookup); err != nil {
+			cp.Warningf(ctx, "dsprovider: cache lookup failed, %d keys: %v", len(lookup), err)
+			found = map[string][]byte{}
+		}
+	}
+
+	me := make(MultiError, len(keyers))
+	misses := []int{}
+	for i := range keyers {
+		if b,exists := found[cacheKeys[i]]; exists {
+			if props,err := decodeProperties(b); err != nil {
+				cp.Warningf(ctx, "dsprovider: bad cache entry for %v: %v", keyers[i], err)
+			} else {
+				me[i] = memLoad(dsts[i], props)
+				continue
+			}
+		}
+		misses = append(misses, i)
+	}
+	cp.hits.Add(int64(len(keyers) - len(misses)))
+	cp.misses.Add(int64(len(misses)))
+	if len(misses) == 0 {
+		return me, nil
+	}
+
+	// Fetch the raw properties, so we cache the whole entity, not just what dst has room for
+	missKeyers := make([]Keyer, len(misses))
+	for j,i := range misses { missKeyers[j] = keyers[i] }
+	pls := make([]datastore.PropertyList, len(misses))
+	err := cp.DatastoreProvider.GetMulti(ctx, missKeyers, pls)
+	if _,isMulti := err.(MultiError); err != nil && !isMulti {
+		return nil, err
+	}
+	missME := AsMultiError(err, len(misses))
+
+	for j,i := range misses {
+		if me[i] = missME[j]; me[i] != nil {
+			continue
+		}
+		me[i] = memLoad(dsts[i], pls[j])
+		if cacheKeys[i] == "" {
+			continue
+		}
+		if b,err := encodeProperties(pls[j]); err != nil {
+			cp.Warningf(ctx, "dsprovider: could not encode %v for the cache: %v", keyers[i], err)
+		} else if err := cp.cache.Set(cacheKeys[i], b, cp.opts.ttl(keyKind(keyers[i]))); err != nil {
+			cp.Warningf(ctx, "dsprovider: could not cache %v: %v", keyers[i], err)
+		}
+	}
+	return me, nil
+}
+
+// }}}
+
+// {{{ Reads
+
+func (cp *CachingProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	me,err := cp.getMulti(ctx, []Keyer{keyer}, []interface{}{dst})
+	if err != nil {
+		return err
+	}
+	return me[0]
+}
+
+// GetMulti returns a MultiError if some keys could not be fetched.
+func (cp *CachingProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keyers) {
+		return cp.DatastoreProvider.GetMulti(ctx, keyers, dst) // Let it complain
+	}
+	dsts := make([]interface{}, len(keyers))
+	for i := range dsts {
+		dsts[i] = sliceElemPtr(v.Index(i))
+	}
+	me,err := cp.getMulti(ctx, keyers, dsts)
+	if err != nil {
+		return err
+	}
+	return me.errOrNil()
+}
+
+// }}}
+// {{{ Writes
+
+// The entities are removed from the cache even if the write fails, as it may have happened
+// anyway.
+
+func (cp *CachingProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
+	out,err := cp.DatastoreProvider.Put(ctx, keyer, src)
+	cp.invalidate(ctx, []Keyer{keyer})
+	return out, err
+}
+
+func (cp *CachingProvider)PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error) {
+	out,err := cp.DatastoreProvider.PutMulti(ctx, keyers, src)
+	cp.invalidate(ctx, keyers)
+	return out, err
+}
+
+func (cp *CachingProvider)Delete(ctx context.Context, keyer Keyer) error {
+	err := cp.DatastoreProvider.Delete(ctx, keyer)
+	cp.invalidate(ctx, []Keyer{keyer})
+	return err
+}
+
+func (cp *CachingProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
+	err := cp.DatastoreProvider.DeleteMulti(ctx, keyers)
+	cp.invalidate(ctx, keyers)
+	return err
+}
+
+func (cp *CachingProvider)Mutate(ctx context.Context, muts ...Mutation) ([]Keyer, error) {
+	out,err := cp.DatastoreProvider.Mutate(ctx, muts...)
+	keyers := []Keyer{}
+	for _,m := range muts { keyers = append(keyers, m.Keyer) }
+	cp.invalidate(ctx, keyers)
+	return out, err
+}
+
+// RunInTransaction invalidates everything the transaction wrote, once it is over; reads inside
+// the transaction don't use the cache.
+func (cp *CachingProvider)RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts *TransactionOptions) error {
+	written := &cachingTransactionWrites{}
+	err := cp.DatastoreProvider.RunInTransaction(ctx, func(tx Transaction) error {
+		return f(&cachingTransaction{Transaction:tx, written:written})
+	}, opts)
+	cp.invalidate(ctx, written.keyers)
+	return err
+}
+
+// cachingTransactionWrites accumulates across retries of the transaction, as it is cheaper
+// to over-invalidate than to work out which attempt committed.
+type cachingTransactionWrites struct {
+	mu       sync.Mutex
+	keyers []Keyer
+}
+
+func (w *cachingTransactionWrites)add(keyers ...Keyer) {
+	w.mu.Lock()
+	w.keyers = append(w.keyers, keyers...)
+	w.mu.Unlock()
+}
+
+type cachingTransaction struct {
+	Transaction
+	written *cachingTransactionWrites
+}
+
+func (tx *cachingTransaction)Put(keyer Keyer, src interface{}) error {
+	tx.written.add(keyer)
+	return tx.Transaction.Put(keyer, src)
+}
+func (tx *cachingTransaction)PutMulti(keyers []Keyer, src interface{}) error {
+	tx.written.add(keyers...)
+	return tx.Transaction.PutMulti(keyers, src)
+}
+func (tx *cachingTransaction)Delete(keyer Keyer) error {
+	tx.written.add(keyer)
+	return tx.Transaction.Delete(keyer)
+}
+func (tx *cachingTransaction)DeleteMulti(keyers []Keyer) error {
+	tx.written.add(keyers...)
+	return tx.Transaction.DeleteMulti(keyers)
+}
+func (tx *cachingTransaction)Mutate(muts ...Mutation) error {
+	for _,m := range muts { tx.written.add(m.Keyer) }
+	return tx.Transaction.Mutate(muts...)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,105 @@
+package ds
+
+import(
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachingProvider(t *testing.T) {
+	p,root := newTestProvider(t)
+	cache := NewLRUEntityCache(100)
+	cp := NewCachingProvider(p, cache, &CachingOptions{KindTTLs:map[string]time.Duration{"Bar":-1}})
+	k := p.NewIDKey(ctx, "Foo", 100, root)
+
+	// The first read fills the cache, the second comes from it
+	for i:=0; i<2; i++ {
+		foo := Foo{}
+		if err := cp.Get(ctx, k, &foo); err != nil || foo.I != 0 || len(foo.Tags) != 1 || !foo.T.Equal(t0) {
+			t.Errorf("Get #%d: %v, %+v", i, err, foo)
+		}
+	}
+	if hits,misses := cp.CacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("expected 1 hit & 1 miss, got %d & %d", hits, misses)
+	}
+
+	// The cache isn't read by the underlying provider, so prove it is being used
+	p.Put(ctx, k, &Foo{S:"sneaky"})
+	if foo := (Foo{}); cp.Get(ctx, k, &foo) != nil || foo.S != "foo" {
+		t.Errorf("Get, expected the cached entity, got %+v", foo)
+	}
+
+	// Writes via the CachingProvider invalidate
+	if _,err := cp.Put(ctx, k, &Foo{S:"new"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if foo := (Foo{}); cp.Get(ctx, k, &foo) != nil || foo.S != "new" {
+		t.Errorf("Get after Put, got %+v", foo)
+	}
+
+	// GetMulti mixes hits, misses, missing entities, and a kind that isn't cached
+	keyers := []Keyer{
+		k,
+		p.NewIDKey(ctx, "Foo", 101, root),
+		p.NewIDKey(ctx, "Foo", 999, root),
+		p.NewNameKey(ctx, "Bar", "bar1", nil),
+	}
+	for i:=0; i<2; i++ {
+		foos := make([]Bar, 4)
+		me,_ := cp.GetMulti(ctx, keyers, foos).(MultiError)
+		if me == nil || me[0] != ErrFieldMismatch || me[1] != ErrFieldMismatch || me[2] != ErrNoSuchEntity || me[3] != nil {
+			t.Errorf("GetMulti #%d: unexpected errors %v", i, []error(me))
+		}
+		if foos[0].S != "new" || foos[1].S != "foo" || foos[3].S != "foo" {
+			t.Errorf("GetMulti #%d: unexpected results %+v", i, foos)
+		}
+	}
+	if n := cache.Len(); n != 2 {
+		t.Errorf("expected 2 cached entities, got %d", n)
+	}
+
+	// Deletes, and transactions, invalidate too
+	if err := cp.Delete(ctx, keyers[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := cp.Get(ctx, keyers[1], &Foo{}); err != ErrNoSuchEntity {
+		t.Errorf("Get after Delete, expected ErrNoSuchEntity, got %v", err)
+	}
+	err := cp.RunInTransaction(ctx, func(tx Transaction) error {
+		return tx.Mutate(NewUpsert(k, &Foo{S:"tx"}))
+	}, nil)
+	if foo := (Foo{}); err != nil || cp.Get(ctx, k, &foo) != nil || foo.S != "tx" {
+		t.Errorf("Get after transaction: %v, %+v", err, foo)
+	}
+}
+
+func TestLRUEntityCache(t *testing.T) {
+	c := NewLRUEntityCache(2)
+	c.Set("a", []byte("A"), 0)
+	c.Set("b", []byte("B"), 0)
+	c.GetMulti([]string{"a"}) // So "b" is the least recently used
+	c.Set("c", []byte("C"), 0)
+	if got,_ := c.GetMulti([]string{"a","b","c"}); len(got) != 2 || got["b"] != nil {
+		t.Errorf("expected b to be evicted, got %v", got)
+	}
+
+	c.Set("d", []byte("D"), time.Millisecond)
+	time.Sleep(5*time.Millisecond)
+	if got,_ := c.GetMulti([]string{"d"}); len(got) != 0 {
+		t.Errorf("expected d to have expired, got %v", got)
+	}
+
+	c.Delete("a", "nosuchkey")
+	if got,_ := c.GetMulti([]string{"a"}); len(got) != 0 {
+		t.Errorf("expected a to be deleted, got %v", got)
+	}
+}
+
+func TestMemcacheEntityKey(t *testing.T) {
+	if k := memcacheEntityKey("abc"); k != "ds:abc" {
+		t.Errorf("short key, got %q", k)
+	}
+	if k := memcacheEntityKey(strings.Repeat("x", 300)); len(k) > 250 || !strings.HasPrefix(k, "ds#") {
+		t.Errorf("long key, got %q", k)
+	}
+}
@@ -0,0 +1,129 @@
+package ds
+
+import(
+	"fmt"
+	"sync"
+
+	"context"
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// AllocateIDs turns incomplete keys into complete ones, with IDs that datastore promises not
+// to hand out again; so you can build a graph of parent & child keys before writing anything.
+func (p CloudDSProvider)AllocateIDs(ctx context.Context, keyers []Keyer) ([]Keyer, error) {
+	keys := p.unpackKeyers(keyers)
+	for _,k := range keys {
+		if k == nil || !k.Incomplete() {
+			return nil, fmt.Errorf("AllocateIDs{cloud}: key %v is not incomplete", k)
+		}
+	}
+	allocated,err := p.client.AllocateIDs(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("AllocateIDs{cloud}: %w", err)
+	}
+	return p.packKeyers(allocated), nil
+}
+
+// ReserveIDs stops datastore from allocating the IDs in these (complete) keys; e.g. if they
+// were assigned by some other system. The datastore library doesn't offer this, so we make the
+// RPC ourselves, over a connection of our own that is set up on first use.
+func (p CloudDSProvider)ReserveIDs(ctx context.Context, keyers []Keyer) error {
+	keys := p.unpackKeyers(keyers)
+	for _,k := range keys {
+		if k == nil || k.ID == 0 {
+			return fmt.Errorf("ReserveIDs{cloud}: key %v does not have an ID", k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	client,err := p.reserver.get(ctx)
+	if err != nil {
+		return fmt.Errorf("ReserveIDs{cloud}: %v", err)
+	}
+	req := pb.ReserveIdsRequest{ProjectId: p.Project, DatabaseId: p.reserver.databaseID}
+	for _,k := range keys {
+		req.Keys = append(req.Keys, keyToProto(p.Project, req.DatabaseId, k))
+	}
+
+	// The backend routes requests on these
+	params := "project_id=" + p.Project
+	if req.DatabaseId != "" { params += "&database_id=" + req.DatabaseId }
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-goog-request-params", params)
+
+	if _,err := client.ReserveIds(ctx, &req); err != nil {
+		return fmt.Errorf("ReserveIDs{cloud}: %w", err)
+	}
+	return nil
+}
+
+// idReserver holds the connection used by ReserveIDs; CloudDSProvider.Close closes it.
+type idReserver struct {
+	databaseID  string
+	opts      []option.ClientOption
+
+	mu          sync.Mutex
+	conn       *grpc.ClientConn
+	closed      bool
+}
+
+// get dials on first use, under the caller's context; if that fails, the next call tries again.
+func (r *idReserver)get(ctx context.Context) (pb.DatastoreClient, error) {
+	if r == nil {
+		return nil, fmt.Errorf("provider was not built by NewCloudDSProvider")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, fmt.Errorf("provider has been closed")
+	}
+	if r.conn == nil {
+		opts := []option.ClientOption{
+			option.WithEndpoint("datastore.googleapis.com:443"),
+			option.WithScopes(datastore.ScopeDatastore),
+		}
+		conn,err := gtransport.Dial(ctx, append(opts, r.opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	return pb.NewDatastoreClient(r.conn), nil
+}
+
+func (r *idReserver)close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+func keyToProto(project, databaseID string, k *datastore.Key) *pb.Key {
+	out := pb.Key{
+		PartitionId: &pb.PartitionId{ProjectId:project, DatabaseId:databaseID, NamespaceId:k.Namespace},
+	}
+	for ; k != nil; k = k.Parent {
+		elem := pb.Key_PathElement{Kind: k.Kind}
+		if k.Name != "" {
+			elem.IdType = &pb.Key_PathElement_Name{Name: k.Name}
+		} else if k.ID != 0 {
+			elem.IdType = &pb.Key_PathElement_Id{Id: k.ID}
+		}
+		out.Path = append([]*pb.Key_PathElement{&elem}, out.Path...)
+	}
+	return &out
+}
@@ -0,0 +1,52 @@
+package ds
+
+import(
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestKeyToProto(t *testing.T) {
+	k := toDatastoreKey(NewKey("ns", PathName("Root", "root"), PathID("Foo", 123)))
+	pk := keyToProto("proj", "db", k)
+
+	if part := pk.GetPartitionId(); part.GetProjectId() != "proj" || part.GetDatabaseId() != "db" ||
+		part.GetNamespaceId() != "ns" {
+		t.Errorf("bad partition: %v", part)
+	}
+	if len(pk.Path) != 2 || pk.Path[0].GetName() != "root" || pk.Path[1].GetKind() != "Foo" ||
+		pk.Path[1].GetId() != 123 {
+		t.Errorf("bad path: %v", pk.Path)
+	}
+}
+
+func TestIDReserverClose(t *testing.T) {
+	r := &idReserver{opts: []option.ClientOption{
+		option.WithEndpoint("localhost:1"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}}
+
+	if _,err := r.get(ctx); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	conn := r.conn
+	if _,err := r.get(ctx); err != nil || r.conn != conn {
+		t.Errorf("second get: should reuse the connection (err: %v)", err)
+	}
+	if err := r.close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if conn.GetState() != connectivity.Shutdown {
+		t.Errorf("close: connection is still %v", conn.GetState())
+	}
+	if _,err := r.get(ctx); err == nil {
+		t.Errorf("get after close: expected an error")
+	}
+	if err := (*idReserver)(nil).close(); err != nil {
+		t.Errorf("close of nil reserver: %v", err)
+	}
+}
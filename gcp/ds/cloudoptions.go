@@ -0,0 +1,176 @@
+package ds
+
+import(
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+/*
+
+ // Talks to the real thing, in the default database & namespace
+ p,err := ds.NewCloudDSProvider(ctx, "myproject")
+ defer p.Close()
+
+ // A non-default database and namespace, with our own logger
+ p,err := ds.NewCloudDSProvider(ctx, "myproject",
+   ds.WithDatabaseID("staging"),
+   ds.WithNamespace("tenant1"),
+   ds.WithLogHandler(slog.NewJSONHandler(os.Stderr, nil)))
+
+ // A local emulator (e.g. `gcloud beta emulators datastore start`). If DATASTORE_EMULATOR_HOST
+ // is set in the environment, this happens automatically.
+ p,err := ds.NewCloudDSProvider(ctx, "myproject", ds.WithEmulatorHost("localhost:8081"))
+
+ */
+
+// CloudOption configures a CloudDSProvider; pass them to NewCloudDSProvider.
+type CloudOption func(*cloudConfig)
+
+type cloudConfig struct {
+	namespace      string
+	databaseID     string
+	emulatorHost   string
+	logHandler     slog.Handler
+	logLevel       slog.Level
+
+	blockingDial    bool
+	dialTimeout     time.Duration
+	backoffMaxDelay time.Duration
+
+	clientOptions []option.ClientOption
+}
+
+// The dial defaults are what NewCloudDSProvider has always used.
+func newCloudConfig(opts ...CloudOption) cloudConfig {
+	cfg := cloudConfig{
+		blockingDial: true,
+		dialTimeout: 30*time.Second,
+		backoffMaxDelay: 5*time.Second,
+	}
+	for _,opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.emulatorHost == "" {
+		cfg.emulatorHost = os.Getenv("DATASTORE_EMULATOR_HOST")
+	}
+	if cfg.logHandler == nil {
+		cfg.logHandler = newDefaultLogHandler(os.Stdout)
+	}
+	return cfg
+}
+
+// WithNamespace sets the default namespace, for new keys and for queries.
+func WithNamespace(ns string) CloudOption {
+	return func(cfg *cloudConfig) { cfg.namespace = ns }
+}
+
+// WithDatabaseID picks a non-default database within the project.
+func WithDatabaseID(id string) CloudOption {
+	return func(cfg *cloudConfig) { cfg.databaseID = id }
+}
+
+// WithCredentialsFile authenticates using a service account (or similar) JSON file, instead of
+// the application default credentials.
+func WithCredentialsFile(filename string) CloudOption {
+	return WithClientOptions(option.WithCredentialsFile(filename))
+}
+
+// WithCredentialsJSON is like WithCredentialsFile, but takes the contents of the file.
+func WithCredentialsJSON(json []byte) CloudOption {
+	return WithClientOptions(option.WithCredentialsJSON(json))
+}
+
+// WithEmulatorHost connects to a datastore emulator at host:port, without authentication. It
+// overrides the DATASTORE_EMULATOR_HOST environment variable.
+func WithEmulatorHost(host string) CloudOption {
+	return func(cfg *cloudConfig) { cfg.emulatorHost = host }
+}
+
+// WithBlockingDial controls whether NewCloudDSProvider waits for the connection to come up
+// (the default), or returns straight away and connects in the background.
+func WithBlockingDial(block bool) CloudOption {
+	return func(cfg *cloudConfig) { cfg.blockingDial = block }
+}
+
+// WithDialTimeout bounds how long a blocking dial waits; zero means no timeout.
+func WithDialTimeout(d time.Duration) CloudOption {
+	return func(cfg *cloudConfig) { cfg.dialTimeout = d }
+}
+
+// WithBackoffMaxDelay caps the delay between attempts to (re)connect.
+func WithBackoffMaxDelay(d time.Duration) CloudOption {
+	return func(cfg *cloudConfig) { cfg.backoffMaxDelay = d }
+}
+
+// WithLogHandler sends the provider's log records to h, instead of to stdout as text. See
+// NewCloudLoggingHandler. The provider's own level is applied before h sees the records.
+func WithLogHandler(h slog.Handler) CloudOption {
+	return func(cfg *cloudConfig) { cfg.logHandler = h }
+}
+
+// WithLogger sends the provider's log output to l, as text. Each record goes through l, so
+// l's prefix and flags apply as usual; the record's own time is left out, as l adds that (or
+// not, if its flags say not to).
+func WithLogger(l *log.Logger) CloudOption {
+	h := slog.NewTextHandler(loggerWriter{l}, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey { return slog.Attr{} }
+			return a
+		},
+	})
+	return WithLogHandler(h)
+}
+
+// loggerWriter writes via l.Output; the text handler makes one Write per record.
+type loggerWriter struct {
+	l *log.Logger
+}
+
+func (w loggerWriter)Write(p []byte) (int, error) {
+	if err := w.l.Output(2, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WithLogLevel sets the provider's minimum log level; the default is slog.LevelInfo. Use
+// slog.LevelDebug to see Debugf output. It can be changed later with SetLogLevel.
+func WithLogLevel(level slog.Level) CloudOption {
+	return func(cfg *cloudConfig) { cfg.logLevel = level }
+}
+
+// WithClientOptions passes options straight through to the underlying datastore client.
+// They are applied last, so they override anything else.
+func WithClientOptions(opts ...option.ClientOption) CloudOption {
+	return func(cfg *cloudConfig) { cfg.clientOptions = append(cfg.clientOptions, opts...) }
+}
+
+// toClientOptions assembles the options for datastore.NewClientWithDatabase.
+func (cfg cloudConfig)toClientOptions() []option.ClientOption {
+	opts := []option.ClientOption{}
+	if cfg.backoffMaxDelay > 0 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithBackoffMaxDelay(cfg.backoffMaxDelay)))
+	}
+	if cfg.blockingDial {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithBlock()))
+		if cfg.dialTimeout > 0 {
+			opts = append(opts, option.WithGRPCDialOption(grpc.WithTimeout(cfg.dialTimeout)))
+		}
+	}
+	if cfg.emulatorHost != "" {
+		// The datastore lib does this itself for DATASTORE_EMULATOR_HOST, but not for a host
+		// passed in explicitly.
+		opts = append(opts,
+			option.WithEndpoint(cfg.emulatorHost),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+	return append(opts, cfg.clientOptions...)
+}
@@ -0,0 +1,53 @@
+package ds
+
+import(
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCloudOptions(t *testing.T) {
+	os.Unsetenv("DATASTORE_EMULATOR_HOST")
+	cfg := newCloudConfig()
+	if !cfg.blockingDial || cfg.dialTimeout != 30*time.Second || cfg.emulatorHost != "" {
+		t.Errorf("bad default config: %+v", cfg)
+	} else if cfg.logHandler == nil || cfg.logLevel != slog.LevelInfo {
+		t.Errorf("default config should have a log handler, at info level")
+	} else if n := len(cfg.toClientOptions()); n != 3 {
+		t.Errorf("default config, expected 3 client options, got %d", n)
+	}
+
+	t.Setenv("DATASTORE_EMULATOR_HOST", "localhost:8081")
+	if cfg := newCloudConfig(WithBlockingDial(false)); cfg.emulatorHost != "localhost:8081" {
+		t.Errorf("emulator host not picked up from env: %+v", cfg)
+	} else if n := len(cfg.toClientOptions()); n != 4 {
+		t.Errorf("emulator config, expected 4 client options, got %d", n)
+	}
+
+	h := slog.NewJSONHandler(os.Stderr, nil)
+	cfg = newCloudConfig(WithEmulatorHost("127.0.0.1:9999"), WithNamespace("ns"),
+		WithDatabaseID("db"), WithLogHandler(h), WithCredentialsFile("/dev/null"))
+	if cfg.emulatorHost != "127.0.0.1:9999" {
+		t.Errorf("explicit emulator host should override env, got %q", cfg.emulatorHost)
+	} else if cfg.namespace != "ns" || cfg.databaseID != "db" || cfg.logHandler != h {
+		t.Errorf("options not applied: %+v", cfg)
+	} else if len(cfg.clientOptions) != 1 {
+		t.Errorf("credentials option not passed through: %+v", cfg)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(&buf, "[ds] ", log.Lmsgprefix)
+	cfg := newCloudConfig(WithLogger(l))
+	pl := newProviderLogger(cfg.logHandler, slog.LevelInfo)
+	pl.Infof(ctx, "hello %d", 1)
+	pl.Debugf(ctx, "not at this level")
+
+	if exp := "[ds] level=INFO msg=\"hello 1\"\n"; buf.String() != exp {
+		t.Errorf("WithLogger: expected %q, got %q", exp, buf.String())
+	}
+}
@@ -2,55 +2,128 @@ package ds
 
 import(
 	"fmt"
-	"log"
 	"net/http"
-	"os"
-	"time"
+	"reflect"
 
 	"context"
-	"google.golang.org/api/option"
-	"google.golang.org/grpc"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"cloud.google.com/go/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
 )
 
+// Debug turns on Debugf output from every provider, whatever its own level.
+//
+// Deprecated: use WithLogLevel(slog.LevelDebug), or SetLogLevel, on the provider.
 var Debug = false
 
 // CloudDSProvider implements the DatastoreProvider interface using the cloud datastore API,
 // for use outside of appengine environments.
 type CloudDSProvider struct {
 	Project    string
+	Namespace  string // The default namespace for new root keys, and queries; see namespace.go
 	client    *datastore.Client
-}
+	providerLogger            // Debugf etc; see logging.go
+	reserver  *idReserver // For ReserveIDs
 
-func NewCloudDSProvider(ctx context.Context, project string) (*CloudDSProvider, error) {
-	client,err := datastore.NewClient(ctx, project,
-		option.WithGRPCDialOption(grpc.WithBackoffMaxDelay(5*time.Second)),
-		option.WithGRPCDialOption(grpc.WithBlock()),
-		option.WithGRPCDialOption(grpc.WithTimeout(30*time.Second)))
-	provider := CloudDSProvider{Project: project, client: client}	
+	// GetMulti, PutMulti and DeleteMulti split up requests of more than MaxBatchSize keys, and
+	// run this many batches concurrently; if unset, DefaultBatchConcurrency.
+	BatchConcurrency int
+}
 
-	log.SetOutput(os.Stdout)
+// NewCloudDSProvider connects to the datastore for the project; see cloudoptions.go for the
+// options.
+func NewCloudDSProvider(ctx context.Context, project string, opts ...CloudOption) (*CloudDSProvider, error) {
+	cfg := newCloudConfig(opts...)
+	client,err := datastore.NewClientWithDatabase(ctx, project, cfg.databaseID, cfg.toClientOptions()...)
+	provider := CloudDSProvider{
+		Project: project,
+		Namespace: cfg.namespace,
+		client: client,
+		providerLogger: newProviderLogger(cfg.logHandler, cfg.logLevel),
+		reserver: &idReserver{databaseID: cfg.databaseID, opts: cfg.toClientOptions()},
+	}
 
 	return &provider, err
 }
 
-func (p CloudDSProvider)flattenQuery(in *Query) *datastore.Query {
-	out := datastore.NewQuery(in.Kind)
-	if in.AncestorKeyer != nil { out = out.Ancestor(in.AncestorKeyer.(*datastore.Key)) }
-	for _,filter := range in.Filters {
-		out = out.Filter(filter.Field, filter.Value)
+// Close releases the provider's connections; it can't be used afterwards.
+func (p CloudDSProvider)Close() error {
+	err := p.reserver.close()
+	if p.client != nil {
+		if cerr := p.client.Close(); err == nil { err = cerr }
+	}
+	return err
+}
+
+func (p CloudDSProvider)flattenQuery(ctx context.Context, in *Query) (*datastore.Query, error) {
+	out := datastore.NewQuery(in.Kind).Namespace(queryNamespace(ctx, in, p.Namespace))
+	if in.AncestorKeyer != nil { out = out.Ancestor(toDatastoreKey(in.AncestorKeyer)) }
+	for _,ef := range in.allFilters() {
+		if err := validateFilter(ef); err != nil {
+			return nil, err
+		}
+		out = out.FilterEntity(p.flattenFilter(ef))
 	}
 	if len(in.ProjectFields) != 0 { out = out.Project(in.ProjectFields...) }
-	if in.OrderStr != ""          { out = out.Order(in.OrderStr) }
+	for _,o := range in.allOrders() { out = out.Order(o.String()) }
 	if in.KeysOnlyVal             { out = out.KeysOnly() }
 	if in.DistinctVals            { out = out.Distinct() }
 	if in.LimitVal != 0           { out = out.Limit(in.LimitVal) }
-	return out
+	if in.OffsetVal != 0          { out = out.Offset(in.OffsetVal) }
+	if in.StartCursor != "" {
+		c,err := datastore.DecodeCursor(string(in.StartCursor))
+		if err != nil { return nil, fmt.Errorf("bad start cursor: %v", err) }
+		out = out.Start(c)
+	}
+	if in.EndCursor != "" {
+		c,err := datastore.DecodeCursor(string(in.EndCursor))
+		if err != nil { return nil, fmt.Errorf("bad end cursor: %v", err) }
+		out = out.End(c)
+	}
+	return out, nil
+}
+
+func (p CloudDSProvider)flattenFilter(in EntityFilter) datastore.EntityFilter {
+	switch f := in.(type) {
+	case Filter:
+		return p.flattenFilter(f.Property())
+	case CompositeFilter:
+		subfilters := []datastore.EntityFilter{}
+		for _,sub := range f.Filters {
+			subfilters = append(subfilters, p.flattenFilter(sub))
+		}
+		if f.Op == CompositeOr {
+			return datastore.OrFilter{Filters: subfilters}
+		}
+		return datastore.AndFilter{Filters: subfilters}
+	}
+
+	f := in.(PropertyFilter)
+	return datastore.PropertyFilter{FieldName: f.Field, Operator: string(f.Op), Value: filterValue(f.Value)}
+}
+
+// filterValue turns any Keyers (e.g. ds.Keys) in a filter's value, which for OpIn and OpNotIn
+// is a slice, into the *datastore.Keys that the library expects.
+func filterValue(v interface{}) interface{} {
+	if keyer,isKeyer := v.(Keyer); isKeyer {
+		return toDatastoreKey(keyer)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || !rv.Type().Elem().Implements(reflect.TypeOf((*Keyer)(nil)).Elem()) {
+		return v
+	}
+	keys := make([]*datastore.Key, rv.Len())
+	for i := range keys {
+		keyer,_ := rv.Index(i).Interface().(Keyer)
+		keys[i] = toDatastoreKey(keyer)
+	}
+	return keys
 }
 
 func  (p CloudDSProvider)unpackKeyer(in Keyer) *datastore.Key {
-	if in == nil { return nil }
-	return in.(*datastore.Key)
+	return toDatastoreKey(in)
 }
 func (p CloudDSProvider)unpackKeyers(in []Keyer) []*datastore.Key {
 	out := []*datastore.Key{}
@@ -62,13 +135,46 @@ func (p CloudDSProvider)unpackKeyers(in []Keyer) []*datastore.Key {
 func (p CloudDSProvider)packKeyers(in []*datastore.Key) []Keyer {
 	out := []Keyer{}
 	for _,k := range in {
-		out = append(out, Keyer(k))
+		if k == nil {
+			out = append(out, nil) // Don't wrap a nil pointer in a non-nil interface
+		} else {
+			out = append(out, Keyer(k))
+		}
 	}
 	return out
 }
 
+func (p CloudDSProvider)batchConcurrency() int {
+	if p.BatchConcurrency < 1 { return DefaultBatchConcurrency }
+	return p.BatchConcurrency
+}
+
+// collectMultiErr copies the per-key errors from the batch [lo,hi) into the MultiError,
+// translating them with f. If the whole batch failed, every key in it gets that error, so
+// that the other batches' results still stand.
+func collectMultiErr(me MultiError, lo, hi int, err error, f func(error) error) {
+	if err == nil {
+		return
+	}
+	if perKey,ok := err.(datastore.MultiError); ok {
+		for i,keyErr := range perKey {
+			me[lo+i] = f(keyErr)
+		}
+		return
+	}
+	for i:=lo; i<hi; i++ {
+		me[i] = f(err)
+	}
+}
+
+func untranslated(err error) error { return err }
+
 func (p CloudDSProvider)GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error) {
-	dsQuery := p.flattenQuery(q)
+	warnIfInvalid(ctx, p, q)
+	dsQuery,err := p.flattenQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("GetAll{cloud}: %v\nQuery: %s", err, q)
+	}
 
 	keys,err := p.client.GetAll(ctx, dsQuery, dst)
 	keyers := p.packKeyers(keys)
@@ -77,14 +183,20 @@ func (p CloudDSProvider)GetAll(ctx context.Context, q *Query, dst interface{}) (
 		if _,assertionOk := err.(*datastore.ErrFieldMismatch); assertionOk {
 			return keyers, ErrFieldMismatch
 		}
-		return nil, fmt.Errorf("GetAll{cloud}: %v\nQuery: %s", err, q)
+		return nil, fmt.Errorf("GetAll{cloud}: %w\nQuery: %s", err, q)
 	}
 	return keyers,nil
 }
 
-func (p CloudDSProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
-	err := p.client.Get(ctx, p.unpackKeyer(keyer), dst)
-	if err == datastore.ErrNoSuchEntity {
+// translateGetErr maps the cloud library's read errors onto ours.
+func translateGetErr(err error) error {
+	if perKey,ok := err.(datastore.MultiError); ok {
+		me := make(MultiError, len(perKey))
+		for i,keyErr := range perKey {
+			me[i] = translateGetErr(keyErr)
+		}
+		return me
+	} else if err == datastore.ErrNoSuchEntity {
 		return ErrNoSuchEntity
 	} else if err != nil {
 		if _,assertionOk := err.(*datastore.ErrFieldMismatch); assertionOk {
@@ -94,50 +206,271 @@ func (p CloudDSProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) e
 	return err
 }
 
-func (p CloudDSProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
-	err := p.client.GetMulti(ctx, p.unpackKeyers(keyers), dst)
-	if err == datastore.ErrNoSuchEntity {
-		return ErrNoSuchEntity
+func (p CloudDSProvider)Count(ctx context.Context, q *Query) (int, error) {
+	agg := AggregateCount("")
+	res,err := p.Aggregate(ctx, q, agg)
+	return int(res.Int(agg.Alias)), err
+}
+
+func (p CloudDSProvider)Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	warnIfInvalid(ctx, p, q)
+	dsQuery,err := p.flattenQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate{cloud}: %v\nQuery: %s", err, q)
+	}
+
+	aq := dsQuery.NewAggregationQuery()
+	for _,agg := range aggs {
+		agg = agg.withDefaultAlias()
+		switch agg.Type {
+		case AggCount: aq = aq.WithCount(agg.Alias)
+		case AggSum:   aq = aq.WithSum(agg.Field, agg.Alias)
+		case AggAvg:   aq = aq.WithAvg(agg.Field, agg.Alias)
+		default:
+			return nil, fmt.Errorf("Aggregate{cloud}: unknown aggregation %q", agg.Type)
+		}
+	}
+
+	dsResult,err := p.client.RunAggregationQuery(ctx, aq)
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate{cloud}: %w\nQuery: %s", err, q)
+	}
+
+	// The values come back as protobufs; unpack them into plain numbers.
+	out := AggregationResult{}
+	for alias,val := range dsResult {
+		out[alias] = nil
+		if pbVal,ok := val.(*pb.Value); ok {
+			switch v := pbVal.GetValueType().(type) {
+			case *pb.Value_IntegerValue: out[alias] = v.IntegerValue
+			case *pb.Value_DoubleValue:  out[alias] = v.DoubleValue
+			}
+		}
+	}
+	return out, nil
+}
+
+func (p CloudDSProvider)Run(ctx context.Context, q *Query) QueryIterator {
+	warnIfInvalid(ctx, p, q)
+	dsQuery,err := p.flattenQuery(ctx, q)
+	if err != nil {
+		return cloudIterator{err: fmt.Errorf("Run{cloud}: %v\nQuery: %s", err, q)}
+	}
+	return cloudIterator{it: p.client.Run(ctx, dsQuery)}
+}
+
+// cloudIterator implements QueryIterator on top of datastore.Iterator.
+type cloudIterator struct {
+	it   *datastore.Iterator
+	err   error
+}
+
+func (ci cloudIterator)Next(dst interface{}) (Keyer, error) {
+	if ci.err != nil { return nil, ci.err }
+	key,err := ci.it.Next(dst)
+	if err == iterator.Done {
+		return nil, ErrDone
 	} else if err != nil {
 		if _,assertionOk := err.(*datastore.ErrFieldMismatch); assertionOk {
-			return ErrFieldMismatch
+			return Keyer(key), ErrFieldMismatch
 		}
+		return nil, err
 	}
-	return err
+	return Keyer(key), nil
+}
+
+func (ci cloudIterator)Cursor() (Cursor, error) {
+	if ci.err != nil { return "", ci.err }
+	c,err := ci.it.Cursor()
+	if err != nil { return "", err }
+	return Cursor(c.String()), nil
+}
+
+func (p CloudDSProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	return translateGetErr(p.client.Get(ctx, p.unpackKeyer(keyer), dst))
+}
+
+// GetMulti fetches in batches of MaxBatchSize. If some keys could not be fetched, the error
+// is a MultiError.
+func (p CloudDSProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	keys := p.unpackKeyers(keyers)
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Slice || dstVal.Len() != len(keys) {
+		return fmt.Errorf("GetMulti{cloud}: dst must be a slice of len %d, got %T", len(keys), dst)
+	}
+
+	me := make(MultiError, len(keys))
+	runBatches(len(keys), MaxBatchSize, p.batchConcurrency(), func(lo, hi int) {
+		err := p.client.GetMulti(ctx, keys[lo:hi], dstVal.Slice(lo,hi).Interface())
+		collectMultiErr(me, lo, hi, err, translateGetErr)
+	})
+	return me.errOrNil()
 }
 
 func (p CloudDSProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
 	key,error := p.client.Put(ctx, p.unpackKeyer(keyer), src)
 	return Keyer(key), error
 }	
+// PutMulti writes in batches of MaxBatchSize. If some entities could not be written, the error
+// is a MultiError, and the returned keys for those entities are nil.
 func (p CloudDSProvider)PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error) {
-	keys,err := p.client.PutMulti(ctx, p.unpackKeyers(keyers), src)
-	return p.packKeyers(keys), err
+	keys := p.unpackKeyers(keyers)
+	srcVal := reflect.ValueOf(src)
+	if srcVal.Kind() != reflect.Slice || srcVal.Len() != len(keys) {
+		return nil, fmt.Errorf("PutMulti{cloud}: src must be a slice of len %d, got %T", len(keys), src)
+	}
+
+	ret := make([]*datastore.Key, len(keys))
+	me := make(MultiError, len(keys))
+	runBatches(len(keys), MaxBatchSize, p.batchConcurrency(), func(lo, hi int) {
+		putKeys,err := p.client.PutMulti(ctx, keys[lo:hi], srcVal.Slice(lo,hi).Interface())
+		copy(ret[lo:hi], putKeys)
+		collectMultiErr(me, lo, hi, err, untranslated)
+	})
+	return p.packKeyers(ret), me.errOrNil()
 }
 func (p CloudDSProvider)Delete(ctx context.Context, keyer Keyer) error {
 	err := p.client.Delete(ctx, p.unpackKeyer(keyer))
 	if err ==	datastore.ErrNoSuchEntity { return ErrNoSuchEntity }
 	return err
 }	
+// DeleteMulti deletes in batches of MaxBatchSize. If some keys could not be deleted, the
+// error is a MultiError.
 func (p CloudDSProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
-	err := p.client.DeleteMulti(ctx, p.unpackKeyers(keyers))
-	if err ==	datastore.ErrNoSuchEntity { return ErrNoSuchEntity }
+	keys := p.unpackKeyers(keyers)
+
+	me := make(MultiError, len(keys))
+	runBatches(len(keys), MaxBatchSize, p.batchConcurrency(), func(lo, hi int) {
+		collectMultiErr(me, lo, hi, p.client.DeleteMulti(ctx, keys[lo:hi]), translateGetErr)
+	})
+	return me.errOrNil()
+}
+
+// {{{ Mutate
+
+func (p CloudDSProvider)toDSMutations(muts []Mutation) ([]*datastore.Mutation, error) {
+	me := make(MultiError, len(muts))
+	out := []*datastore.Mutation{}
+	for i,m := range muts {
+		if me[i] = m.validate(); me[i] != nil {
+			continue
+		}
+		k := p.unpackKeyer(m.Keyer)
+		if k == nil {
+			me[i] = ErrInvalidKey
+			continue
+		}
+		switch m.Op {
+		case MutationInsert: out = append(out, datastore.NewInsert(k, m.Src))
+		case MutationUpdate: out = append(out, datastore.NewUpdate(k, m.Src))
+		case MutationUpsert: out = append(out, datastore.NewUpsert(k, m.Src))
+		case MutationDelete: out = append(out, datastore.NewDelete(k))
+		}
+	}
+	if err := me.errOrNil(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// translateMutateErr maps the errors from a commit that contained mutations onto ours.
+func translateMutateErr(err error) error {
+	switch status.Code(err) {
+	case codes.AlreadyExists: return ErrEntityExists
+	case codes.NotFound:      return ErrNoSuchEntity
+	}
+	return err
+}
+
+func (p CloudDSProvider)Mutate(ctx context.Context, muts ...Mutation) ([]Keyer, error) {
+	dsMuts,err := p.toDSMutations(muts)
+	if err != nil {
+		return nil, err
+	}
+	keys,err := p.client.Mutate(ctx, dsMuts...)
+	if err != nil {
+		me := make(MultiError, len(muts))
+		collectMultiErr(me, 0, len(muts), err, translateMutateErr)
+		return nil, me
+	}
+	return p.packKeyers(keys), nil
+}
+
+// }}}
+
+func (p CloudDSProvider)RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts *TransactionOptions) error {
+	dsOpts := []datastore.TransactionOption{datastore.MaxAttempts(opts.maxAttempts())}
+	if opts.readOnly() {
+		dsOpts = append(dsOpts, datastore.ReadOnly)
+	}
+
+	_,err := p.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(cloudTransaction{p:p, tx:tx, readOnly:opts.readOnly()})
+	}, dsOpts...)
+
+	if err == datastore.ErrConcurrentTransaction {
+		return ErrConcurrentTransaction
+	}
+	return translateMutateErr(err)
+}
+
+// cloudTransaction implements the Transaction interface on top of datastore.Transaction.
+type cloudTransaction struct {
+	p         CloudDSProvider
+	tx       *datastore.Transaction
+	readOnly  bool
+}
+
+func (t cloudTransaction)Get(keyer Keyer, dst interface{}) error {
+	return translateGetErr(t.tx.Get(t.p.unpackKeyer(keyer), dst))
+}
+func (t cloudTransaction)GetMulti(keyers []Keyer, dst interface{}) error {
+	return translateGetErr(t.tx.GetMulti(t.p.unpackKeyers(keyers), dst))
+}
+func (t cloudTransaction)Put(keyer Keyer, src interface{}) error {
+	if t.readOnly { return ErrReadOnlyTransaction }
+	_,err := t.tx.Put(t.p.unpackKeyer(keyer), src)
+	return err
+}
+func (t cloudTransaction)PutMulti(keyers []Keyer, src interface{}) error {
+	if t.readOnly { return ErrReadOnlyTransaction }
+	_,err := t.tx.PutMulti(t.p.unpackKeyers(keyers), src)
+	return err
+}
+func (t cloudTransaction)Delete(keyer Keyer) error {
+	if t.readOnly { return ErrReadOnlyTransaction }
+	return t.tx.Delete(t.p.unpackKeyer(keyer))
+}
+func (t cloudTransaction)DeleteMulti(keyers []Keyer) error {
+	if t.readOnly { return ErrReadOnlyTransaction }
+	return t.tx.DeleteMulti(t.p.unpackKeyers(keyers))
+}
+// Mutate queues up the mutations; any insert or update preconditions are checked on commit,
+// and a failure there is returned by RunInTransaction.
+func (t cloudTransaction)Mutate(muts ...Mutation) error {
+	if t.readOnly { return ErrReadOnlyTransaction }
+	dsMuts,err := t.p.toDSMutations(muts)
+	if err != nil {
+		return err
+	}
+	_,err = t.tx.Mutate(dsMuts...)
 	return err
 }
 
 func (p CloudDSProvider)NewIncompleteKey(ctx context.Context, kind string, root Keyer) Keyer {
 	key := datastore.IncompleteKey(kind, p.unpackKeyer(root))
-	return Keyer(key)
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
 }
 func (p CloudDSProvider)NewNameKey(ctx context.Context, kind, name string, root Keyer) Keyer {
 	key := datastore.NameKey(kind, name, p.unpackKeyer(root))
-	return Keyer(key)
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
 }
 func (p CloudDSProvider)NewIDKey(ctx context.Context, kind string, id int64, root Keyer) Keyer {
 	key := datastore.IDKey(kind, id, p.unpackKeyer(root))
-	return Keyer(key)
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
 }
 
+
 func (p CloudDSProvider)DecodeKey(encoded string) (Keyer, error) {
 	key, err := datastore.DecodeKey(encoded)
 	return Keyer(key), err
@@ -149,6 +482,11 @@ func (p CloudDSProvider)KeyParent(in Keyer) Keyer {
 	return nil
 }
 func (p CloudDSProvider)KeyName(in Keyer) string { return p.unpackKeyer(in).Name }
+func (p CloudDSProvider)KeyKind(in Keyer) string { return keyKind(in) }
+func (p CloudDSProvider)KeyID(in Keyer) int64 { return keyID(in) }
+func (p CloudDSProvider)KeyNamespace(in Keyer) string { return keyNamespace(in) }
+func (p CloudDSProvider)KeyPath(in Keyer) []PathElement { return keyPath(in) }
+func (p CloudDSProvider)KeyEqual(a, b Keyer) bool { return keyEqual(a, b) }
 
 
 func (p CloudDSProvider)HTTPClient(ctx context.Context) *http.Client {
@@ -158,21 +496,6 @@ func (p CloudDSProvider)HTTPClient(ctx context.Context) *http.Client {
 
 
 
-func (p CloudDSProvider)Debugf(ctx context.Context, format string, args ...interface{}) {
-	if Debug {log.Printf(format, args...)}
-}
-func (p CloudDSProvider)Infof(ctx context.Context, format string,args ...interface{}) {
-	log.Printf(format, args...)
-}
-func (p CloudDSProvider)Errorf(ctx context.Context, format string,args ...interface{}) {
-	log.Printf(format, args...)
-}
-func (p CloudDSProvider)Warningf(ctx context.Context, format string,args ...interface{}) {
-	log.Printf(format, args...)
-}
-func (p CloudDSProvider)Criticalf(ctx context.Context, format string,args ...interface{}) {
-	log.Printf(format, args...)
-}
 
 
 /*
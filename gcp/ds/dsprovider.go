@@ -2,15 +2,22 @@ package ds
 
 import(
 	"errors"
+	"log/slog"
 	"net/http"
 
 	"context"
+	"cloud.google.com/go/datastore"
 )
 
 var(
 	ErrNoSuchEntity = errors.New("dsprovider: no such entity")
 	ErrFieldMismatch = errors.New("dsprovider: src obj had a field that dst obj didn't")
 	ErrNoMemcacheService = errors.New("dsprovider: no memcache service available")
+	ErrConcurrentTransaction = errors.New("dsprovider: transaction failed due to contention")
+	ErrReadOnlyTransaction = errors.New("dsprovider: cannot write inside a read-only transaction")
+	ErrDone = errors.New("dsprovider: no more results")
+	ErrEntityExists = errors.New("dsprovider: entity already exists")
+	ErrInvalidKey = datastore.ErrInvalidKey // e.g. a nil or incomplete key passed to Get
 )
 
 // Keyer is a very thin wrapper. It should be populated with a *datastore.Key
@@ -28,10 +35,24 @@ type DatastoreProvider interface {
 	Get(ctx context.Context, keyer Keyer, dst interface{}) error
 	GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error
 	GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error)
+	Run(ctx context.Context, q *Query) QueryIterator
+	Count(ctx context.Context, q *Query) (int, error)
+	Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error)
 	Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error)
 	PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error)
 	Delete(ctx context.Context, keyer Keyer) error
 	DeleteMulti(ctx context.Context, keyers []Keyer) error
+
+	// Mutate applies a mixed batch of writes (see mutation.go) in one round trip. It is all or
+	// nothing; if any mutation fails, none are applied. The returned keys are in the same order
+	// as the mutations, with incomplete keys completed. Errors are a MultiError, with an entry
+	// per mutation; if the backend doesn't say which mutation failed, every entry has the error.
+	Mutate(ctx context.Context, muts ...Mutation) ([]Keyer, error)
+
+	// RunInTransaction runs f in a transaction, retrying it if the commit fails due to
+	// contention. If f returns an error, the transaction is rolled back and the error is
+	// returned. opts may be nil.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts *TransactionOptions) error
 	
 	NewIncompleteKey(ctx context.Context, kind string, root Keyer) Keyer
 	NewNameKey(ctx context.Context, kind, name string, root Keyer) Keyer
@@ -39,14 +60,60 @@ type DatastoreProvider interface {
 	DecodeKey(encoded string) (Keyer, error)
 	KeyParent(Keyer) Keyer
 	KeyName(Keyer) string
+	KeyKind(Keyer) string
+	KeyID(Keyer) int64
+	KeyNamespace(Keyer) string
+	KeyPath(Keyer) []PathElement // From the root down to the key itself
+	KeyEqual(a, b Keyer) bool
+
+	// AllocateIDs completes incomplete keys, with IDs that won't be handed out again, so that
+	// graphs of parent & child keys can be built before anything is written. ReserveIDs stops
+	// the IDs in complete keys from being handed out.
+	AllocateIDs(ctx context.Context, keyers []Keyer) ([]Keyer, error)
+	ReserveIDs(ctx context.Context, keyers []Keyer) error
 
 	// HTTP client - maybe urlfetch, maybe not
 	HTTPClient(ctx context.Context) *http.Client
 
-	// Logging support - goes to appengine logging, or maybe STDOUT
+	// Logging support, via log/slog; see logging.go. The *f methods are shorthand for logging
+	// a formatted message at that level via Logger().
+	Logger() *slog.Logger
 	Debugf(ctx context.Context, format string, args ...interface{})
 	Infof(ctx context.Context, format string, args ...interface{})
 	Warningf(ctx context.Context, format string, args ...interface{})
 	Errorf(ctx context.Context, format string, args ...interface{})
 	Criticalf(ctx context.Context, format string, args ...interface{})
 }
+
+// QueryIterator streams the results of a query, as returned by DatastoreProvider.Run. Next
+// returns ErrDone when there are no more results. Cursor returns a cursor that, when passed
+// to Query.Start, will resume the query just after the most recent result from Next.
+type QueryIterator interface {
+	Next(dst interface{}) (Keyer, error)
+	Cursor() (Cursor, error)
+}
+
+// Transaction is the set of operations available inside RunInTransaction. Reads see the
+// state of the datastore as of the start of the transaction, not any writes made by the
+// transaction itself; the writes are applied atomically when f returns. Incomplete keys are
+// only completed at commit time, so use complete keys if you need to know an entity's ID.
+type Transaction interface {
+	Get(keyer Keyer, dst interface{}) error
+	GetMulti(keyers []Keyer, dst interface{}) error
+	Put(keyer Keyer, src interface{}) error
+	PutMulti(keyers []Keyer, src interface{}) error
+	Delete(keyer Keyer) error
+	DeleteMulti(keyers []Keyer) error
+	Mutate(muts ...Mutation) error
+}
+
+type TransactionOptions struct {
+	MaxAttempts int  // How many times to try committing; defaults to 3
+	ReadOnly    bool // Writes will fail with ErrReadOnlyTransaction
+}
+
+func (opts *TransactionOptions)maxAttempts() int {
+	if opts == nil || opts.MaxAttempts <= 0 { return 3 }
+	return opts.MaxAttempts
+}
+func (opts *TransactionOptions)readOnly() bool { return opts != nil && opts.ReadOnly }
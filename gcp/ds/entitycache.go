@@ -0,0 +1,171 @@
+package ds
+
+import(
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	// The same fork of bradfitz's lib that singleton/memcache uses
+	mclib "github.com/skypies/gomemcache/memcache"
+)
+
+// EntityCache is the storage behind a CachingProvider. A miss isn't an error; GetMulti just
+// leaves that key out of the map. A zero TTL means the entry doesn't expire (though it may
+// still be evicted). Implementations must be safe for concurrent use.
+type EntityCache interface {
+	GetMulti(keys []string) (map[string][]byte, error)
+	Set(key string, val []byte, ttl time.Duration) error
+	Delete(keys ...string) error // Deleting a key that isn't there is not an error
+}
+
+// {{{ MemcacheEntityCache
+
+// MemcacheEntityCache keeps the entities in memcache.
+type MemcacheEntityCache struct {
+	*mclib.Client
+}
+
+func NewMemcacheEntityCache(servers ...string) MemcacheEntityCache {
+	return MemcacheEntityCache{mclib.New(servers...)}
+}
+
+// Memcache keys can't be longer than 250 bytes; keys for deeply nested entities can be.
+func memcacheEntityKey(key string) string {
+	if len(key) <= 240 { return "ds:" + key }
+	sum := sha1.Sum([]byte(key))
+	return "ds#" + hex.EncodeToString(sum[:])
+}
+
+func (mc MemcacheEntityCache)GetMulti(keys []string) (map[string][]byte, error) {
+	mcKeys := make([]string, len(keys))
+	for i,k := range keys { mcKeys[i] = memcacheEntityKey(k) }
+	items,err := mc.Client.GetMulti(mcKeys)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]byte{}
+	for i,k := range keys {
+		if item,exists := items[mcKeys[i]]; exists { out[k] = item.Value }
+	}
+	return out, nil
+}
+
+func (mc MemcacheEntityCache)Set(key string, val []byte, ttl time.Duration) error {
+	// Memcache treats anything over 30 days as an absolute unix time
+	secs := int32(0)
+	if ttl > 30*24*time.Hour {
+		secs = int32((30*24*time.Hour).Seconds())
+	} else if ttl > 0 {
+		secs = int32((ttl + time.Second - 1) / time.Second)
+	}
+	return mc.Client.Set(&mclib.Item{Key:memcacheEntityKey(key), Value:val, Expiration:secs})
+}
+
+func (mc MemcacheEntityCache)Delete(keys ...string) error {
+	for _,k := range keys {
+		if err := mc.Client.Delete(memcacheEntityKey(k)); err != nil && err != mclib.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+// {{{ LRUEntityCache
+
+// LRUEntityCache keeps the entities in process memory, evicting the least recently used once
+// it has MaxEntries of them. Each process has its own copy, so invalidations made by other
+// processes aren't seen; keep the TTLs short if that matters.
+type LRUEntityCache struct {
+	MaxEntries int
+
+	mu       sync.Mutex
+	ll      *list.List // Of *lruEntry; most recently used at the front
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	val    []byte
+	expires  time.Time // Zero if it doesn't expire
+}
+
+func NewLRUEntityCache(maxEntries int) *LRUEntityCache {
+	return &LRUEntityCache{
+		MaxEntries: maxEntries,
+		ll: list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *LRUEntityCache)GetMulti(keys []string) (map[string][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	out := map[string][]byte{}
+	for _,k := range keys {
+		elem,exists := c.entries[k]
+		if !exists { continue }
+		ent := elem.Value.(*lruEntry)
+		if !ent.expires.IsZero() && now.After(ent.expires) {
+			c.remove(elem)
+			continue
+		}
+		c.ll.MoveToFront(elem)
+		out[k] = ent.val
+	}
+	return out, nil
+}
+
+func (c *LRUEntityCache)Set(key string, val []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent := &lruEntry{key:key, val:val}
+	if ttl > 0 { ent.expires = time.Now().Add(ttl) }
+
+	if elem,exists := c.entries[key]; exists {
+		elem.Value = ent
+		c.ll.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.ll.PushFront(ent)
+	for c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries {
+		c.remove(c.ll.Back())
+	}
+	return nil
+}
+
+func (c *LRUEntityCache)Delete(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _,k := range keys {
+		if elem,exists := c.entries[k]; exists { c.remove(elem) }
+	}
+	return nil
+}
+
+// Len is how many entries are in the cache, including any that have expired but not yet been
+// noticed.
+func (c *LRUEntityCache)Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// remove must be called with the lock held.
+func (c *LRUEntityCache)remove(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).key)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,399 @@
+package ds
+
+import(
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/skypies/util/gcp/gcs"
+)
+
+/*
+
+ // Back up a kind (or anything a query can select), one JSON entity per line
+ n,err := ds.Export(ctx, p, ds.NewQuery("Flight").Ancestor(rootKey), w)
+
+ // ... and load it back, e.g. into a MemoryProvider as test fixtures
+ n,err := ds.Import(ctx, ds.NewMemoryProvider(), r)
+
+ // Straight to/from a GCS object
+ n,err := ds.ExportToGCS(ctx, p, ds.NewQuery("Flight"), "mybucket", "backups/flights.ndjson")
+ n,err := ds.ImportFromGCS(ctx, p, "mybucket", "backups/flights.ndjson")
+
+ // ... or, if you have a gcs.Client already
+ n,err := ds.ExportToGCSClient(ctx, gcsClient, p, ds.NewQuery("Flight"), "mybucket", "flights.ndjson")
+
+ Each line looks like this; every value says what type it is, so nothing is lost:
+
+ {"key":{"path":[{"kind":"Root","name":"root"},{"kind":"Foo","id":"100"}]},
+  "properties":{"S":{"string":"foo"},"I":{"int":"0"},"T":{"time":"2020-01-01T00:00:00Z"},
+                "Tags":{"array":[{"string":"all"}]},"Blob":{"bytes":"AAE=","noindex":true}}}
+
+ */
+
+// {{{ the JSON format
+
+type jsonEntity struct {
+	Key         *jsonKey             `json:"key,omitempty"` // Only optional for nested entities
+	Properties   map[string]jsonValue `json:"properties"`
+}
+
+type jsonKey struct {
+	Namespace    string            `json:"namespace,omitempty"`
+	Path       []jsonPathElement   `json:"path"`
+}
+
+type jsonPathElement struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name,omitempty"`
+	ID     string `json:"id,omitempty"` // A string, as JSON numbers can't be trusted with int64s
+}
+
+type jsonGeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// jsonValue has exactly one of its value fields set.
+type jsonValue struct {
+	Null     bool          `json:"null,omitempty"`
+	Bool    *bool          `json:"bool,omitempty"`
+	Int     *string        `json:"int,omitempty"`   // int64, as a string
+	Float    interface{}   `json:"float,omitempty"` // A number; or "NaN", "+Inf", "-Inf"
+	String  *string        `json:"string,omitempty"`
+	Bytes   *string        `json:"bytes,omitempty"` // base64
+	Time    *time.Time     `json:"time,omitempty"`
+	Geo     *jsonGeoPoint  `json:"geo,omitempty"`
+	Key     *jsonKey       `json:"key,omitempty"`
+	Entity  *jsonEntity    `json:"entity,omitempty"`
+	Array   *[]jsonValue   `json:"array,omitempty"`
+	NoIndex  bool          `json:"noindex,omitempty"`
+}
+
+// }}}
+// {{{ to JSON
+
+func keyToJSON(k *datastore.Key) *jsonKey {
+	if k == nil { return nil }
+	out := jsonKey{Namespace:k.Namespace}
+	for ; k != nil; k = k.Parent {
+		elem := jsonPathElement{Kind:k.Kind, Name:k.Name}
+		if k.ID != 0 { elem.ID = strconv.FormatInt(k.ID, 10) }
+		out.Path = append([]jsonPathElement{elem}, out.Path...)
+	}
+	return &out
+}
+
+// Properties with the same name (which older code could write) are merged into an array.
+func entityToJSON(k *datastore.Key, props []datastore.Property) (*jsonEntity, error) {
+	out := jsonEntity{Key:keyToJSON(k), Properties:map[string]jsonValue{}}
+	for _,p := range props {
+		v,err := valueToJSON(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", p.Name, err)
+		}
+		v.NoIndex = p.NoIndex
+
+		if prev,exists := out.Properties[p.Name]; exists {
+			merged := []jsonValue{}
+			if prev.Array != nil { merged = *prev.Array } else { merged = []jsonValue{prev} }
+			if v.Array != nil { merged = append(merged, *v.Array...) } else { merged = append(merged, v) }
+			v = jsonValue{Array:&merged, NoIndex:p.NoIndex}
+		}
+		out.Properties[p.Name] = v
+	}
+	return &out, nil
+}
+
+func valueToJSON(val interface{}) (jsonValue, error) {
+	out := jsonValue{}
+	switch v := val.(type) {
+	case nil:
+		out.Null = true
+	case bool:
+		out.Bool = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		out.Int = &s
+	case float64:
+		switch {
+		case math.IsNaN(v):   out.Float = "NaN"
+		case math.IsInf(v,1): out.Float = "+Inf"
+		case math.IsInf(v,-1): out.Float = "-Inf"
+		default:               out.Float = v
+		}
+	case string:
+		out.String = &v
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(v)
+		out.Bytes = &s
+	case time.Time:
+		out.Time = &v
+	case datastore.GeoPoint:
+		out.Geo = &jsonGeoPoint{Lat:v.Lat, Lng:v.Lng}
+	case *datastore.Key:
+		if v == nil { out.Null = true } else { out.Key = keyToJSON(v) }
+	case *datastore.Entity:
+		if v == nil {
+			out.Null = true
+			break
+		}
+		ent,err := entityToJSON(v.Key, v.Properties)
+		if err != nil { return out, err }
+		out.Entity = ent
+	case []interface{}:
+		vals := []jsonValue{}
+		for _,elem := range v {
+			jv,err := valueToJSON(elem)
+			if err != nil { return out, err }
+			vals = append(vals, jv)
+		}
+		out.Array = &vals
+	default:
+		return out, fmt.Errorf("unsupported type %T", val)
+	}
+	return out, nil
+}
+
+// }}}
+// {{{ from JSON
+
+func keyFromJSON(jk *jsonKey) (*datastore.Key, error) {
+	if jk == nil || len(jk.Path) == 0 {
+		return nil, fmt.Errorf("key has no path")
+	}
+	var k *datastore.Key
+	for _,elem := range jk.Path {
+		id := int64(0)
+		if elem.ID != "" {
+			var err error
+			if id,err = strconv.ParseInt(elem.ID, 10, 64); err != nil {
+				return nil, fmt.Errorf("bad key ID %q", elem.ID)
+			}
+		}
+		k = &datastore.Key{Kind:elem.Kind, Name:elem.Name, ID:id, Parent:k, Namespace:jk.Namespace}
+	}
+	return k, nil
+}
+
+// The properties are sorted by name, so that results are stable.
+func entityFromJSON(je *jsonEntity) (*datastore.Key, []datastore.Property, error) {
+	var k *datastore.Key
+	if je.Key != nil {
+		var err error
+		if k,err = keyFromJSON(je.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	names := []string{}
+	for name := range je.Properties { names = append(names, name) }
+	sort.Strings(names)
+
+	props := []datastore.Property{}
+	for _,name := range names {
+		jv := je.Properties[name]
+		val,err := valueFromJSON(jv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("property %q: %v", name, err)
+		}
+		props = append(props, datastore.Property{Name:name, Value:val, NoIndex:jv.NoIndex})
+	}
+	return k, props, nil
+}
+
+func valueFromJSON(jv jsonValue) (interface{}, error) {
+	switch {
+	case jv.Null:
+		return nil, nil
+	case jv.Bool != nil:
+		return *jv.Bool, nil
+	case jv.Int != nil:
+		return strconv.ParseInt(*jv.Int, 10, 64)
+	case jv.Float != nil:
+		switch f := jv.Float.(type) {
+		case float64:
+			return f, nil
+		case string:
+			return strconv.ParseFloat(f, 64) // Understands "NaN", "+Inf" & "-Inf"
+		}
+		return nil, fmt.Errorf("bad float %v", jv.Float)
+	case jv.String != nil:
+		return *jv.String, nil
+	case jv.Bytes != nil:
+		return base64.StdEncoding.DecodeString(*jv.Bytes)
+	case jv.Time != nil:
+		return *jv.Time, nil
+	case jv.Geo != nil:
+		return datastore.GeoPoint{Lat:jv.Geo.Lat, Lng:jv.Geo.Lng}, nil
+	case jv.Key != nil:
+		return keyFromJSON(jv.Key)
+	case jv.Entity != nil:
+		k,props,err := entityFromJSON(jv.Entity)
+		if err != nil { return nil, err }
+		return &datastore.Entity{Key:k, Properties:props}, nil
+	case jv.Array != nil:
+		out := []interface{}{}
+		for _,elem := range *jv.Array {
+			val,err := valueFromJSON(elem)
+			if err != nil { return nil, err }
+			out = append(out, val)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("value has no type")
+}
+
+// }}}
+
+// {{{ Export
+
+// Export writes the entities that q selects to w, as newline-delimited JSON, with their full
+// keys and typed property values; it returns how many were written. Projection and keys-only
+// queries export just what they fetch.
+func Export(ctx context.Context, p DatastoreProvider, q *Query, w io.Writer) (int, error) {
+	it := NewStreamingIterator(ctx, p, q, datastore.PropertyList{})
+	it.PageSize = 100
+	defer it.Close()
+
+	enc := json.NewEncoder(w) // Encode adds the newline
+	enc.SetEscapeHTML(false)
+	n := 0
+	for it.Iterate(ctx) {
+		props := datastore.PropertyList{}
+		keyer := it.Val(&props)
+		je,err := entityToJSON(toDatastoreKey(keyer), props)
+		if err != nil {
+			return n, fmt.Errorf("Export: %v: %v", keyer, err)
+		}
+		if err := enc.Encode(je); err != nil {
+			return n, fmt.Errorf("Export: %v", err)
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return n, fmt.Errorf("Export: %v", err)
+	}
+	return n, nil
+}
+
+// }}}
+// {{{ Import
+
+// Import reads the output of Export, and writes the entities (in batches) to p, overwriting
+// any that already exist; it returns how many were written. The keys keep the namespace they
+// were exported with.
+func Import(ctx context.Context, p DatastoreProvider, r io.Reader) (int, error) {
+	const batchSize = 100
+	keyers := []Keyer{}
+	ents := []datastore.PropertyList{}
+	n := 0
+
+	flush := func() error {
+		if len(keyers) == 0 { return nil }
+		if _,err := p.PutMulti(ctx, keyers, ents); err != nil {
+			return fmt.Errorf("Import: writing entities %d-%d: %w", n+1, n+len(keyers), err)
+		}
+		n += len(keyers)
+		keyers, ents = []Keyer{}, []datastore.PropertyList{}
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	for line:=1; ; line++ {
+		je := jsonEntity{}
+		if err := dec.Decode(&je); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("Import: entity %d: %v", line, err)
+		}
+
+		k,props,err := entityFromJSON(&je)
+		if err != nil {
+			return n, fmt.Errorf("Import: entity %d: %v", line, err)
+		} else if k == nil || k.Incomplete() {
+			return n, fmt.Errorf("Import: entity %d: key %v is not complete", line, k)
+		}
+		keyers = append(keyers, k)
+		ents = append(ents, props)
+
+		if len(keyers) >= batchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+// }}}
+// {{{ ExportToGCS, ImportFromGCS
+
+// ExportToGCS is Export, into a GCS object. If the export fails, the object isn't written. It
+// builds a storage client just for the call; if you have a gcs.Client, use ExportToGCSClient.
+func ExportToGCS(ctx context.Context, p DatastoreProvider, q *Query, bucket, object string) (int, error) {
+	c,err := gcs.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ExportToGCS: %v", err)
+	}
+	defer c.Close()
+	return ExportToGCSClient(ctx, c, p, q, bucket, object)
+}
+
+// ExportToGCSClient is ExportToGCS, via a client that you already have.
+func ExportToGCSClient(ctx context.Context, c *gcs.Client, p DatastoreProvider, q *Query, bucket, object string) (int, error) {
+	wctx,cancel := context.WithCancel(ctx) // Cancelling the writer's context abandons the upload
+	defer cancel()
+
+	w := c.NewWriter(wctx, bucket, object, gcs.WithContentType("application/x-ndjson"))
+	n,err := Export(ctx, p, q, w)
+	if err != nil {
+		cancel()
+		w.Close()
+		return n, err
+	}
+	if err := w.Close(); err != nil {
+		return n, fmt.Errorf("ExportToGCS: gs://%s/%s: %w", bucket, object, err)
+	}
+	return n, nil
+}
+
+// ImportFromGCS is Import, from a GCS object. Like ExportToGCS, it builds a storage client just
+// for the call; ImportFromGCSClient uses yours.
+func ImportFromGCS(ctx context.Context, p DatastoreProvider, bucket, object string) (int, error) {
+	c,err := gcs.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ImportFromGCS: %v", err)
+	}
+	defer c.Close()
+	return ImportFromGCSClient(ctx, c, p, bucket, object)
+}
+
+// ImportFromGCSClient is ImportFromGCS, via a client that you already have.
+func ImportFromGCSClient(ctx context.Context, c *gcs.Client, p DatastoreProvider, bucket, object string) (int, error) {
+	r,err := c.NewReader(ctx, bucket, object)
+	if err != nil {
+		return 0, fmt.Errorf("ImportFromGCS: %w", err)
+	}
+	defer r.Close()
+	return Import(ctx, p, r)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
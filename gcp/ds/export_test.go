@@ -0,0 +1,157 @@
+package ds
+
+import(
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+
+	"github.com/skypies/util/gcp/gcs"
+)
+
+func TestExportImport(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	// An entity with every type of value
+	ref := p.NewIDKey(ctx, "Foo", 101, root).(*datastore.Key)
+	everything := datastore.PropertyList{
+		{Name:"Array",  Value:[]interface{}{int64(1), "two", nil}},
+		{Name:"Big",    Value:int64(math.MaxInt64)},
+		{Name:"Blob",   Value:[]byte{0, 1, 255}, NoIndex:true},
+		{Name:"Bool",   Value:true},
+		{Name:"Float",  Value:1.5},
+		{Name:"Geo",    Value:datastore.GeoPoint{Lat:37.5, Lng:-122.25}},
+		{Name:"Inf",    Value:math.Inf(-1)},
+		{Name:"Nested", Value:&datastore.Entity{Properties:[]datastore.Property{{Name:"S", Value:"inner"}}}},
+		{Name:"Nil",    Value:nil},
+		{Name:"Ref",    Value:ref},
+		{Name:"Time",   Value:t0.Add(time.Microsecond)},
+	}
+	ek := p.NewNameKey(ctx, "Everything", "e1", nil)
+	if _,err := p.Put(ctx, InNamespace(ek, "ns1"), &everything); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Just the Foos under root
+	var buf bytes.Buffer
+	if n,err := Export(ctx, p, NewQuery("Foo").Ancestor(root), &buf); err != nil || n != 5 {
+		t.Fatalf("Export Foos: %v, %d", err, n)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 5 {
+		t.Errorf("expected 5 lines, got %d", len(lines))
+	}
+
+	p2 := NewMemoryProvider()
+	if n,err := Import(ctx, p2, &buf); err != nil || n != 5 {
+		t.Fatalf("Import Foos: %v, %d", err, n)
+	}
+	foos := []Foo{}
+	if _,err := p2.GetAll(ctx, NewQuery("Foo").Ancestor(root), &foos); err != nil || len(foos) != 5 {
+		t.Fatalf("GetAll after Import: %v, %d", err, len(foos))
+	} else if foos[4].I != 4 || !foos[4].T.Equal(t0.Add(4*time.Hour)) || len(foos[4].Tags) != 2 {
+		t.Errorf("bad Foo after Import: %+v", foos[4])
+	}
+
+	// Everything should survive the round trip, including the namespace
+	buf.Reset()
+	if n,err := Export(ctx, p, NewQuery("Everything").Namespace("ns1"), &buf); err != nil || n != 1 {
+		t.Fatalf("Export Everything: %v, %d", err, n)
+	}
+	if _,err := Import(ctx, p2, &buf); err != nil {
+		t.Fatalf("Import Everything: %v", err)
+	}
+	got := datastore.PropertyList{}
+	if err := p2.Get(ctx, InNamespace(ek, "ns1"), &got); err != nil {
+		t.Fatalf("Get Everything: %v", err)
+	}
+	if !reflect.DeepEqual(got, everything) {
+		t.Errorf("round trip mismatch;\n got: %v\nwant: %v", got, everything)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	p := NewMemoryProvider()
+	tests := map[string]string{
+		"not json":       `{"key":`,
+		"no key":         `{"properties":{}}`,
+		"incomplete key": `{"key":{"path":[{"kind":"Foo"}]},"properties":{}}`,
+		"untyped value":  `{"key":{"path":[{"kind":"Foo","id":"1"}]},"properties":{"A":{}}}`,
+	}
+	for name,in := range tests {
+		if _,err := Import(ctx, p, strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// fakeGCSObjects keeps uploaded objects in memory, and serves them back; it only does what
+// ExportToGCSClient and ImportFromGCSClient need (multipart uploads, and XML API downloads).
+func fakeGCSObjects(t *testing.T) *gcs.Client {
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") {
+			bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+			_,params,_ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			attrs := struct{ Name string }{}
+			if part,err := mr.NextPart(); err == nil {
+				json.NewDecoder(part).Decode(&attrs)
+			}
+			part,err := mr.NextPart()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			objects[bucket+"/"+attrs.Name],_ = io.ReadAll(part)
+			json.NewEncoder(w).Encode(map[string]string{"name":attrs.Name, "bucket":bucket})
+			return
+		}
+		data,exists := objects[strings.TrimPrefix(r.URL.Path, "/")]
+		if !exists {
+			http.Error(w, "no such object", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	c,err := gcs.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("gcs.NewClient: %v", err)
+	}
+	return c
+}
+
+func TestExportImportGCS(t *testing.T) {
+	p,root := newTestProvider(t)
+	c := fakeGCSObjects(t)
+
+	if n,err := ExportToGCSClient(ctx, c, p, NewQuery("Foo").Ancestor(root), "mybucket", "foos.ndjson"); err != nil || n != 5 {
+		t.Fatalf("ExportToGCSClient: %v, %d", err, n)
+	}
+	p2 := NewMemoryProvider()
+	if n,err := ImportFromGCSClient(ctx, c, p2, "mybucket", "foos.ndjson"); err != nil || n != 5 {
+		t.Fatalf("ImportFromGCSClient: %v, %d", err, n)
+	}
+	if n,_ := p2.Count(ctx, NewQuery("Foo")); n != 5 {
+		t.Errorf("after ImportFromGCSClient, expected 5 Foos, got %d", n)
+	}
+
+	if _,err := ImportFromGCSClient(ctx, c, p2, "mybucket", "nope"); !errors.Is(err, gcs.ErrNotExist) {
+		t.Errorf("ImportFromGCSClient of a missing object: expected ErrNotExist, got %v", err)
+	}
+}
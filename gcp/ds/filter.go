@@ -0,0 +1,224 @@
+package ds
+
+import(
+	"fmt"
+	"strings"
+)
+
+/*
+
+ q := ds.NewQuery("Flight").
+   Filter("Timestamp >", t).                     // The old way; still works
+   FilterEntity(ds.Ge("Altitude", 10000)).
+   FilterEntity(ds.Or(
+     ds.Eq("Airline", "UA"),
+     ds.And(ds.Eq("Airline", "AA"), ds.In("Origin", []string{"SFO","SJC"})),
+   ))
+
+ */
+
+// Operator is the comparison in a property filter.
+type Operator string
+
+const(
+	OpEqual       Operator = "="
+	OpLessThan    Operator = "<"
+	OpLessEq      Operator = "<="
+	OpGreaterThan Operator = ">"
+	OpGreaterEq   Operator = ">="
+	OpNotEqual    Operator = "!="
+	OpIn          Operator = "in"
+	OpNotIn       Operator = "not-in"
+)
+
+// Longest first, so "<=" is tried before "<", and "not-in" before "in".
+var allOperators = []Operator{OpLessEq, OpGreaterEq, OpNotEqual, OpLessThan, OpGreaterThan,
+	OpEqual, OpNotIn, OpIn}
+
+// IsInequality is true for the operators that datastore treats as range comparisons.
+func (op Operator)IsInequality() bool {
+	switch op {
+	case OpLessThan, OpLessEq, OpGreaterThan, OpGreaterEq, OpNotEqual, OpNotIn:
+		return true
+	}
+	return false
+}
+
+// EntityFilter is a node in a tree of filters; either a PropertyFilter (or Filter) on a single
+// property, or a CompositeFilter that combines other filters.
+type EntityFilter interface {
+	String() string
+	isEntityFilter()
+}
+
+// {{{ PropertyFilter
+
+// PropertyFilter compares a single property against a value. For OpIn and OpNotIn, the value
+// should be a slice.
+type PropertyFilter struct {
+	Field string
+	Op    Operator
+	Value interface{}
+}
+
+func (PropertyFilter)isEntityFilter() {}
+
+func Eq(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpEqual, val} }
+func Ne(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpNotEqual, val} }
+func Lt(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpLessThan, val} }
+func Le(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpLessEq, val} }
+func Gt(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpGreaterThan, val} }
+func Ge(field string, val interface{}) PropertyFilter    { return PropertyFilter{field, OpGreaterEq, val} }
+func In(field string, vals interface{}) PropertyFilter    { return PropertyFilter{field, OpIn, vals} }
+func NotIn(field string, vals interface{}) PropertyFilter { return PropertyFilter{field, OpNotIn, vals} }
+
+var opFuncNames = map[Operator]string{
+	OpEqual:"Eq", OpNotEqual:"Ne", OpLessThan:"Lt", OpLessEq:"Le", OpGreaterThan:"Gt",
+	OpGreaterEq:"Ge", OpIn:"In", OpNotIn:"NotIn",
+}
+
+// String renders the filter as the call that would construct it.
+func (f PropertyFilter)String() string {
+	if name,exists := opFuncNames[f.Op]; exists {
+		return fmt.Sprintf("%s(%q, %s)", name, f.Field, filterValueString(f.Value))
+	}
+	return fmt.Sprintf("PropertyFilter{%q, %q, %s}", f.Field, f.Op, filterValueString(f.Value))
+}
+
+func filterValueString(v interface{}) string {
+	switch val := v.(type) {
+	case string:   return fmt.Sprintf("%q", val)
+	case []string: return fmt.Sprintf("%q", val)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Validate checks the filter has a field and a known operator.
+func (f PropertyFilter)Validate() error {
+	if f.Field == "" {
+		return fmt.Errorf("filter with empty field name")
+	}
+	for _,op := range allOperators {
+		if f.Op == op { return nil }
+	}
+	return fmt.Errorf("filter on %q has bad operator %q", f.Field, f.Op)
+}
+
+// ParseFilter turns a filter string in the style of the datastore APIs, like "Time >", into a
+// PropertyFilter. As with those APIs, the operator defaults to equality.
+func ParseFilter(fieldAndOp string, val interface{}) (PropertyFilter, error) {
+	s := strings.TrimSpace(fieldAndOp)
+	for _,op := range allOperators {
+		symbolic := op != OpIn && op != OpNotIn // These need whitespace before them
+		if strings.HasSuffix(s, " "+string(op)) || (symbolic && strings.HasSuffix(s, string(op))) {
+			field := strings.TrimSpace(strings.TrimSuffix(s, string(op)))
+			if field == "" {
+				return PropertyFilter{}, fmt.Errorf("empty field name in filter %q", fieldAndOp)
+			}
+			return PropertyFilter{field, op, val}, nil
+		}
+	}
+	if s == "" || strings.ContainsAny(s, " \t") {
+		return PropertyFilter{}, fmt.Errorf("bad filter %q", fieldAndOp)
+	}
+	return PropertyFilter{s, OpEqual, val}, nil
+}
+
+// }}}
+// {{{ Filter
+
+// Filter is the original form of a property filter, as added by Query.Filter; the field and
+// operator are a single string, e.g. "Time >".
+type Filter struct {
+	Field string
+	Value interface{}
+}
+
+func (Filter)isEntityFilter() {}
+
+// Property parses the filter. If it can't be parsed, the result has no operator, and fails
+// to validate.
+func (f Filter)Property() PropertyFilter {
+	pf,err := ParseFilter(f.Field, f.Value)
+	if err != nil {
+		return PropertyFilter{Field:f.Field, Value:f.Value}
+	}
+	return pf
+}
+
+func (f Filter)String() string {
+	return fmt.Sprintf("Filter{%q, %s}", f.Field, filterValueString(f.Value))
+}
+
+func (f Filter)Validate() error {
+	if _,err := ParseFilter(f.Field, f.Value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// }}}
+// {{{ CompositeFilter
+
+type CompositeOp string
+
+const(
+	CompositeAnd CompositeOp = "AND"
+	CompositeOr  CompositeOp = "OR"
+)
+
+// CompositeFilter combines a list of filters; an entity matches an AND if it matches every
+// filter in the list, and an OR if it matches any of them.
+type CompositeFilter struct {
+	Op      CompositeOp
+	Filters []EntityFilter
+}
+
+func (CompositeFilter)isEntityFilter() {}
+
+func And(filters ...EntityFilter) CompositeFilter { return CompositeFilter{CompositeAnd, filters} }
+func Or(filters ...EntityFilter) CompositeFilter  { return CompositeFilter{CompositeOr, filters} }
+
+func (cf CompositeFilter)String() string {
+	strs := []string{}
+	for _,f := range cf.Filters {
+		strs = append(strs, f.String())
+	}
+	name := "And"
+	if cf.Op == CompositeOr { name = "Or" }
+	return fmt.Sprintf("%s(%s)", name, strings.Join(strs, ", "))
+}
+
+// Validate checks the whole tree under the composite filter.
+func (cf CompositeFilter)Validate() error {
+	if cf.Op != CompositeAnd && cf.Op != CompositeOr {
+		return fmt.Errorf("composite filter has bad operator %q", cf.Op)
+	} else if len(cf.Filters) == 0 {
+		return fmt.Errorf("composite filter %s has no subfilters", cf.Op)
+	}
+	for _,f := range cf.Filters {
+		if err := validateFilter(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateFilter(ef EntityFilter) error {
+	switch f := ef.(type) {
+	case PropertyFilter:  return f.Validate()
+	case Filter:          return f.Validate()
+	case CompositeFilter: return f.Validate()
+	}
+	return fmt.Errorf("unknown filter type %T", ef)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
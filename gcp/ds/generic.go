@@ -0,0 +1,110 @@
+package ds
+
+import(
+	"context"
+	"iter"
+	"reflect"
+)
+
+/*
+
+ for k,foo := range ds.All[MyObject](ctx, p, q) {
+   fmt.Printf("k=%v, v=%s\n", k, foo)   // foo is a MyObject; no type assertions
+ }
+
+ // If you need to check for errors, or tweak the paging, use the iterator directly
+ it := ds.NewTypedIterator[MyObject](ctx, p, q)
+ it.PageSize = 100
+ defer it.Close()
+ for k,foo,ok := it.Next(); ok; k,foo,ok = it.Next() {
+   ...
+ }
+ if it.Err() != nil {
+   return it.Err()
+ }
+
+ keyers,foos,err := ds.GetAll[MyObject](ctx, p, q)
+ foos,err := ds.GetMulti[MyObject](ctx, p, keyers)
+
+ */
+
+// TypedIterator is a type-safe wrapper around Iterator, for results of type T. (It can't be
+// called Iterator[T], as that name is taken.) The embedded Iterator's PageSize and Prefetch
+// can be set before the first call to Next.
+type TypedIterator[T any] struct {
+	*Iterator
+	ctx context.Context
+}
+
+// typeOf works even when T is an interface type, unlike reflect.TypeOf on a zero T.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// NewTypedIterator is the generic version of NewIterator.
+func NewTypedIterator[T any](ctx context.Context, p DatastoreProvider, q *Query) *TypedIterator[T] {
+	it := NewIterator(ctx, p, q, nil)
+	it.ty = typeOf[T]()
+	return &TypedIterator[T]{it, ctx}
+}
+
+// NewTypedStreamingIterator is the generic version of NewStreamingIterator.
+func NewTypedStreamingIterator[T any](ctx context.Context, p DatastoreProvider, q *Query) *TypedIterator[T] {
+	it := NewStreamingIterator(ctx, p, q, nil)
+	it.ty = typeOf[T]()
+	return &TypedIterator[T]{it, ctx}
+}
+
+// Next returns the next result, and its key; the bool is false when there are no more results
+// (or there was an error; check Err).
+func (ti *TypedIterator[T])Next() (Keyer, T, bool) {
+	var zero T
+	if !ti.Iterate(ti.ctx) {
+		return nil, zero, false
+	}
+	val,_ := ti.ValAsInterface().(T) // Can only fail if T is an interface and val was nil
+	return ti.keyer, val, true
+}
+
+// All returns the remaining results as a range-able sequence. The iterator is closed when the
+// loop ends, even if it ends early. Check Err afterwards.
+func (ti *TypedIterator[T])All() iter.Seq2[Keyer, T] {
+	return func(yield func(Keyer, T) bool) {
+		defer ti.Close()
+		for {
+			k,v,ok := ti.Next()
+			if !ok || !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// All returns the results of the query as a range-able sequence. There is no way to return an
+// error from a range loop, so errors are logged via p.Errorf, and the sequence ends early; use
+// NewTypedIterator if you need to check for them.
+func All[T any](ctx context.Context, p DatastoreProvider, q *Query) iter.Seq2[Keyer, T] {
+	return func(yield func(Keyer, T) bool) {
+		it := NewTypedIterator[T](ctx, p, q)
+		defer it.Close()
+		it.All()(yield)
+		if it.Err() != nil {
+			p.Errorf(ctx, "ds.All: %v", it.Err())
+		}
+	}
+}
+
+// GetAll is the generic version of p.GetAll.
+func GetAll[T any](ctx context.Context, p DatastoreProvider, q *Query) ([]Keyer, []T, error) {
+	dst := []T{}
+	keyers,err := p.GetAll(ctx, q, &dst)
+	return keyers, dst, err
+}
+
+// GetMulti is the generic version of p.GetMulti. As with that, any error may be a MultiError,
+// in which case the vals for the keys that were found are still populated.
+func GetMulti[T any](ctx context.Context, p DatastoreProvider, keyers []Keyer) ([]T, error) {
+	dst := make([]T, len(keyers))
+	err := p.GetMulti(ctx, keyers, dst)
+	return dst, err
+}
@@ -0,0 +1,57 @@
+package ds
+
+import(
+	"testing"
+)
+
+func TestTypedIterator(t *testing.T) {
+	p,root := newTestProvider(t)
+	q := NewQuery("Foo").Ancestor(root).Order("I")
+
+	n := 0
+	for k,foo := range All[Foo](ctx, p, q) {
+		if foo.I != n || k == nil {
+			t.Errorf("All result %d had I=%d, k=%v", n, foo.I, k)
+		}
+		n++
+		if n == 3 { break }
+	}
+	if n != 3 {
+		t.Errorf("All, broke out after %d results, expected 3", n)
+	}
+
+	it := NewTypedStreamingIterator[*Foo](ctx, p, q)
+	it.PageSize = 2
+	defer it.Close()
+	n = 0
+	for k,foo,ok := it.Next(); ok; k,foo,ok = it.Next() {
+		if foo == nil || foo.I != n || k == nil {
+			t.Errorf("Next result %d was %v, k=%v", n, foo, k)
+		}
+		n++
+	}
+	if it.Err() != nil {
+		t.Errorf("typed iterator err: %v", it.Err())
+	} else if n != 5 {
+		t.Errorf("typed iterator returned %d results, expected 5", n)
+	}
+}
+
+func TestGenericGets(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	keyers,foos,err := GetAll[Foo](ctx, p, NewQuery("Foo").Order("-I"))
+	if err != nil {
+		t.Fatalf("GetAll err: %v", err)
+	} else if len(keyers) != 5 || len(foos) != 5 || foos[0].I != 4 {
+		t.Errorf("GetAll, bad results: %v, %+v", keyers, foos)
+	}
+
+	keyers = []Keyer{keyers[0], p.NewIDKey(ctx, "Foo", 999, root)}
+	foos,err = GetMulti[Foo](ctx, p, keyers)
+	if me,ok := err.(MultiError); !ok || len(me) != 2 || me[1] != ErrNoSuchEntity {
+		t.Errorf("GetMulti, expected a MultiError for the missing key, got %v", err)
+	} else if len(foos) != 2 || foos[0].I != 4 {
+		t.Errorf("GetMulti, bad results: %+v", foos)
+	}
+}
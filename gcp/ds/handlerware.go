@@ -7,7 +7,11 @@ import(
 
 // To prevent other libs colliding with us in the context.Value keyspace, use this private key
 type contextKey int
-const datastoreProviderKey contextKey = 0
+const(
+	datastoreProviderKey contextKey = iota
+	namespaceKey
+	logAttrsKey
+)
 
 
 // SetProvider embeds a provider inside a Context, for later retrieval
@@ -21,3 +25,20 @@ func GetProviderOrPanic(ctx context.Context) DatastoreProvider {
 	if !ok { panic("GetDSProvider called on a context that had no DSPROvider") }
 	return p
 }
+
+// SetNamespace overrides the provider's default namespace, for keys and queries made with the
+// returned context.
+func SetNamespace(ctx context.Context, ns string) context.Context {
+	return context.WithValue(ctx, namespaceKey, ns)
+}
+
+// GetNamespace returns the namespace set via SetNamespace, if any.
+func GetNamespace(ctx context.Context) (string, bool) {
+	ns, ok := ctx.Value(namespaceKey).(string)
+	return ns, ok
+}
+
+// SetProviderInNamespace embeds a provider, and a namespace for it to work in
+func SetProviderInNamespace(ctx context.Context, p DatastoreProvider, ns string) context.Context {
+	return SetNamespace(SetProvider(ctx, p), ns)
+}
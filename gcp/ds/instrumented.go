@@ -0,0 +1,303 @@
+package ds
+
+import(
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+
+ m := metrics.NewMetrics()
+ ip := ds.NewInstrumentedProvider(p, &m)  // Or a histogram.Set
+ ... use ip wherever you'd have used p ...
+
+ http.HandleFunc("/admin/ds-stats", ip.StatsHandler)
+
+ */
+
+// MetricsRecorder is where the latency histograms go; *metrics.Metrics and histogram.Set
+// both fit.
+type MetricsRecorder interface {
+	RecordValue(name string, val int64)
+	String() string
+}
+
+// OpStats are the running totals for one operation on one kind.
+type OpStats struct {
+	Calls     int64
+	Errors    int64
+	Entities  int64 // Entities read, written, or deleted
+	Latency   time.Duration // Total, across all the calls
+}
+
+// InstrumentedProvider wraps another provider, and keeps track of how many calls it handles,
+// and how long they take, broken down by operation and kind. The latency of each call (in
+// milliseconds) goes into the MetricsRecorder as "<op>/<kind>".
+type InstrumentedProvider struct {
+	DatastoreProvider
+
+	mu        sync.Mutex // Guards both of these; MetricsRecorders aren't thread safe
+	metrics   MetricsRecorder
+	stats     map[string]*OpStats
+}
+
+func NewInstrumentedProvider(p DatastoreProvider, m MetricsRecorder) *InstrumentedProvider {
+	return &InstrumentedProvider{
+		DatastoreProvider: p,
+		metrics: m,
+		stats: map[string]*OpStats{},
+	}
+}
+
+// {{{ record
+
+// record notes a completed call. For MultiErrors, each failed entity counts as an error.
+func (ip *InstrumentedProvider)record(op, kind string, start time.Time, n int, err error) {
+	if kind == "" { kind = "-" }
+	name := op + "/" + kind
+	elapsed := time.Since(start)
+
+	numErrs := int64(0)
+	if me,isMulti := err.(MultiError); isMulti {
+		numErrs = int64(len(me.OtherErrors()) + len(me.MissingIndices()) + len(me.MismatchIndices()))
+	} else if err != nil && err != ErrDone {
+		numErrs = 1
+	}
+
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	s,exists := ip.stats[name]
+	if !exists {
+		s = &OpStats{}
+		ip.stats[name] = s
+	}
+	s.Calls++
+	s.Errors += numErrs
+	s.Entities += int64(n)
+	s.Latency += elapsed
+	if ip.metrics != nil {
+		ip.metrics.RecordValue(name, elapsed.Milliseconds())
+	}
+}
+
+// kindOf names the kind of a batch of keys; "*" if there's more than one kind.
+func kindOf(keyers []Keyer) string {
+	kind := ""
+	for _,k := range keyers {
+		if k == nil { continue }
+		if kind == "" {
+			kind = keyKind(k)
+		} else if keyKind(k) != kind {
+			return "*"
+		}
+	}
+	return kind
+}
+
+// }}}
+// {{{ Stats, StatsHandler
+
+// Stats returns a copy of the running totals, keyed by "<op>/<kind>".
+func (ip *InstrumentedProvider)Stats() map[string]OpStats {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	out := map[string]OpStats{}
+	for name,s := range ip.stats {
+		out[name] = *s
+	}
+	return out
+}
+
+func (ip *InstrumentedProvider)String() string {
+	stats := ip.Stats()
+	names := []string{}
+	for name := range stats { names = append(names, name) }
+	sort.Strings(names)
+
+	str := fmt.Sprintf("%-30.30s %8s %8s %10s %10s\n", "op/kind", "calls", "errors", "entities", "mean(ms)")
+	for _,name := range names {
+		s := stats[name]
+		mean := float64(s.Latency.Microseconds()) / 1000.0 / float64(s.Calls)
+		str += fmt.Sprintf("%-30.30s %8d %8d %10d %10.1f\n", name, s.Calls, s.Errors, s.Entities, mean)
+	}
+	return str
+}
+
+// StatsHandler renders the totals, and the latency histograms, as text.
+func (ip *InstrumentedProvider)StatsHandler(w http.ResponseWriter, r *http.Request) {
+	str := ip.String()
+	if ip.metrics != nil {
+		ip.mu.Lock()
+		str += "\nLatencies (ms):-\n" + ip.metrics.String()
+		ip.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(str))
+}
+
+// }}}
+
+// {{{ Reads
+
+func (ip *InstrumentedProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.Get(ctx, keyer, dst)
+	ip.record("Get", keyKind(keyer), start, numLoaded(err, 1), err)
+	return err
+}
+
+func (ip *InstrumentedProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.GetMulti(ctx, keyers, dst)
+	ip.record("GetMulti", kindOf(keyers), start, numLoaded(err, len(keyers)), err)
+	return err
+}
+
+// numLoaded counts the entities that a batch read actually loaded; missing ones don't count.
+func numLoaded(err error, n int) int {
+	if err == nil {
+		return n
+	}
+	me := AsMultiError(err, n)
+	return len(me.FoundIndices()) + len(me.MismatchIndices())
+}
+
+// numSucceeded counts the keys that a batch write succeeded for.
+func numSucceeded(err error, n int) int {
+	if err == nil {
+		return n
+	}
+	return len(AsMultiError(err, n).FoundIndices())
+}
+
+func (ip *InstrumentedProvider)GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error) {
+	start := time.Now()
+	keyers,err := ip.DatastoreProvider.GetAll(ctx, q, dst)
+	ip.record("GetAll", q.Kind, start, len(keyers), err)
+	return keyers, err
+}
+
+func (ip *InstrumentedProvider)Count(ctx context.Context, q *Query) (int, error) {
+	start := time.Now()
+	n,err := ip.DatastoreProvider.Count(ctx, q)
+	ip.record("Count", q.Kind, start, 0, err)
+	return n, err
+}
+
+func (ip *InstrumentedProvider)Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	start := time.Now()
+	res,err := ip.DatastoreProvider.Aggregate(ctx, q, aggs...)
+	ip.record("Aggregate", q.Kind, start, 0, err)
+	return res, err
+}
+
+// Run is recorded when the iterator runs out (or fails); the latency covers the whole thing.
+func (ip *InstrumentedProvider)Run(ctx context.Context, q *Query) QueryIterator {
+	return &instrumentedIterator{
+		QueryIterator: ip.DatastoreProvider.Run(ctx, q),
+		ip: ip,
+		kind: q.Kind,
+		start: time.Now(),
+	}
+}
+
+type instrumentedIterator struct {
+	QueryIterator
+	ip       *InstrumentedProvider
+	kind      string
+	start     time.Time
+	n         int
+	recorded  bool
+}
+
+func (it *instrumentedIterator)Next(dst interface{}) (Keyer, error) {
+	keyer,err := it.QueryIterator.Next(dst)
+	if err == nil {
+		it.n++
+	} else if !it.recorded {
+		it.recorded = true
+		it.ip.record("Run", it.kind, it.start, it.n, err)
+	}
+	return keyer, err
+}
+
+// }}}
+// {{{ Writes
+
+func (ip *InstrumentedProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
+	start := time.Now()
+	out,err := ip.DatastoreProvider.Put(ctx, keyer, src)
+	ip.record("Put", keyKind(keyer), start, numSucceeded(err, 1), err)
+	return out, err
+}
+
+func (ip *InstrumentedProvider)PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error) {
+	start := time.Now()
+	out,err := ip.DatastoreProvider.PutMulti(ctx, keyers, src)
+	ip.record("PutMulti", kindOf(keyers), start, numSucceeded(err, len(keyers)), err)
+	return out, err
+}
+
+func (ip *InstrumentedProvider)Delete(ctx context.Context, keyer Keyer) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.Delete(ctx, keyer)
+	ip.record("Delete", keyKind(keyer), start, numSucceeded(err, 1), err)
+	return err
+}
+
+func (ip *InstrumentedProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.DeleteMulti(ctx, keyers)
+	ip.record("DeleteMulti", kindOf(keyers), start, numSucceeded(err, len(keyers)), err)
+	return err
+}
+
+func (ip *InstrumentedProvider)Mutate(ctx context.Context, muts ...Mutation) ([]Keyer, error) {
+	keyers := []Keyer{}
+	for _,m := range muts { keyers = append(keyers, m.Keyer) }
+	start := time.Now()
+	out,err := ip.DatastoreProvider.Mutate(ctx, muts...)
+	n := len(muts)
+	if err != nil {
+		n = 0 // Mutations are all or nothing
+	}
+	ip.record("Mutate", kindOf(keyers), start, n, err)
+	return out, err
+}
+
+// RunInTransaction is recorded as a whole, under the kind "-"; the calls made on the
+// transaction aren't broken out.
+func (ip *InstrumentedProvider)RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts *TransactionOptions) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.RunInTransaction(ctx, f, opts)
+	ip.record("RunInTransaction", "", start, 0, err)
+	return err
+}
+
+func (ip *InstrumentedProvider)AllocateIDs(ctx context.Context, keyers []Keyer) ([]Keyer, error) {
+	start := time.Now()
+	out,err := ip.DatastoreProvider.AllocateIDs(ctx, keyers)
+	ip.record("AllocateIDs", kindOf(keyers), start, numSucceeded(err, len(keyers)), err)
+	return out, err
+}
+
+func (ip *InstrumentedProvider)ReserveIDs(ctx context.Context, keyers []Keyer) error {
+	start := time.Now()
+	err := ip.DatastoreProvider.ReserveIDs(ctx, keyers)
+	ip.record("ReserveIDs", kindOf(keyers), start, numSucceeded(err, len(keyers)), err)
+	return err
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,76 @@
+package ds
+
+import(
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skypies/util/histogram"
+	"github.com/skypies/util/metrics"
+)
+
+func TestInstrumentedProvider(t *testing.T) {
+	p,root := newTestProvider(t)
+	m := metrics.NewMetrics()
+	ip := NewInstrumentedProvider(p, &m)
+
+	foos := []Foo{}
+	if _,err := ip.GetAll(ctx, NewQuery("Foo"), &foos); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	keyers := []Keyer{p.NewIDKey(ctx, "Foo", 100, root), p.NewIDKey(ctx, "Foo", 999, root)}
+	ip.GetMulti(ctx, keyers, make([]Foo, 2))
+	ip.Put(ctx, p.NewNameKey(ctx, "Bar", "b", nil), &Bar{})
+	ip.DeleteMulti(ctx, []Keyer{keyers[0], p.NewNameKey(ctx, "Bar", "b", nil)})
+	ip.AllocateIDs(ctx, []Keyer{p.NewIncompleteKey(ctx, "Baz", nil)})
+	ip.ReserveIDs(ctx, []Keyer{p.NewIDKey(ctx, "Baz", 7, nil)})
+
+	// Failures only count the entities that got read or written
+	ip.Get(ctx, keyers[1], &Foo{})
+	ip.PutMulti(ctx, []Keyer{nil, p.NewNameKey(ctx, "Qux", "q", nil)}, []Bar{{}, {}})
+	ip.Delete(ctx, p.NewIncompleteKey(ctx, "Qux", nil))
+	ip.Mutate(ctx, NewUpsert(p.NewNameKey(ctx, "Qux", "q2", nil), &Bar{}),
+		NewInsert(p.NewNameKey(ctx, "Qux", "q", nil), &Bar{}))
+
+	it := ip.Run(ctx, NewQuery("Foo"))
+	for _,err := it.Next(nil); err == nil; _,err = it.Next(nil) {}
+
+	stats := ip.Stats()
+	exp := map[string]OpStats{
+		"GetAll/Foo":      {Calls:1, Entities:5},
+		"GetMulti/Foo":    {Calls:1, Entities:1, Errors:1}, // The missing one wasn't read
+		"AllocateIDs/Baz": {Calls:1, Entities:1},
+		"ReserveIDs/Baz":  {Calls:1, Entities:1},
+		"Put/Bar":         {Calls:1, Entities:1},
+		"DeleteMulti/*":   {Calls:1, Entities:2},
+		"Run/Foo":         {Calls:1, Entities:4},
+		"Get/Foo":         {Calls:1, Errors:1},
+		"PutMulti/Qux":    {Calls:1, Entities:1, Errors:1},
+		"Delete/Qux":      {Calls:1, Errors:1},
+		"Mutate/Qux":      {Calls:1, Errors:1},
+	}
+	if len(stats) != len(exp) {
+		t.Errorf("expected %d stats, got %v", len(exp), stats)
+	}
+	for name,want := range exp {
+		got := stats[name]
+		got.Latency = 0
+		if got != want {
+			t.Errorf("stats[%s]: expected %+v, got %+v", name, want, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ip.StatsHandler(w, httptest.NewRequest("GET", "/admin/ds", nil))
+	if body := w.Body.String(); !strings.Contains(body, "GetMulti/Foo") || !strings.Contains(body, "Latencies") {
+		t.Errorf("bad StatsHandler output:\n%s", body)
+	}
+
+	// A histogram.Set works as the recorder too
+	s := histogram.NewSet(100)
+	ip = NewInstrumentedProvider(p, s)
+	ip.Count(ctx, NewQuery("Foo"))
+	if !strings.Contains(s.String(), "Count/Foo") {
+		t.Errorf("histogram.Set didn't get the latency:\n%s", s)
+	}
+}
@@ -4,6 +4,7 @@ import(
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
 )
 
 /*
@@ -23,16 +24,38 @@ import(
    return it.Err()
  }
 
+
+ // For very large result sets, stream the results a page at a time instead; and checkpoint
+ // the cursor, so a later request can pick up where this one left off.
+ it := db.NewStreamingIterator(ctx, p, q.Start(savedCursor), MyObject{})
+ for it.Iterate(ctx) {
+   ...
+   savedCursor,_ = it.Cursor()
+ }
+
+
+ // Either kind can fetch upcoming pages in the background, while the caller works through
+ // the current one. The prefetchers stop when Iterate returns false; if you bail out early,
+ // Close() it (or cancel ctx), or they will sit waiting for you to take the next page.
+ it := db.NewIterator(ctx, p, q, MyObject{})
+ it.Prefetch = 4
+ defer it.Close()
+
  */
 
 // Iterator is a batching iterator that executes the full query up front, to get a list of all
 // keys; then it fetches pages of results as it works through the keys. We don't use
 // datastore.Iterator, as it times out the result set after 60 seconds, out of abundance of
-// caution.
+// caution. Entities that get deleted after the keys were fetched are silently skipped.
+//
+// In streaming mode, it doesn't get the keys up front; instead it runs the query once per
+// page, using cursors to pick up where the previous page left off. So no single query lives
+// long enough to time out.
 type Iterator struct {
 	p            DatastoreProvider
 	ty           reflect.Type // the type of the thing the caller wants us to get
 	PageSize     int
+	f           *fetcher      // Built from the above on first use
 
 	keyers     []Keyer        // Keys for the (unfetched remainder of the) full result set
 
@@ -42,13 +65,55 @@ type Iterator struct {
 	val          interface{}  // The currently fetched value
 	keyer        Keyer        // ... and its key ...
 	err          error        // ... or the error we bumped into
+
+	// Streaming mode
+	q           *Query        // The query to page through; nil if not streaming
+	sliceCursors []Cursor     // The cursor after each val in the current page
+	cursor       Cursor       // The cursor after the current val
+
+	// Prefetching
+	Prefetch     int          // How many upcoming pages to fetch in the background; 0 to disable
+	pf          *prefetcher
+	closed       bool
+}
+
+// fetcher fetches pages. It is separate from Iterator so that the prefetching goroutines
+// don't share any state with the caller's goroutine.
+type fetcher struct {
+	p            DatastoreProvider
+	ty           reflect.Type
+	pageSize     int
+
+	// Streaming mode
+	q           *Query
+	nextCursor   Cursor       // Where the next page starts
+	queryDone    bool         // We've fetched the final page
+	numFetched   int          // How many results we've fetched, in case q has a limit
+}
+
+// prefetcher is the state of the background prefetching.
+type prefetcher struct {
+	pages        chan chan page // Pages, in order, which may still be being fetched
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+}
+
+// page is a fetched page of results, and its keys (and, if streaming, cursors).
+type page struct {
+	slice        reflect.Value
+	keys       []Keyer
+	cursors    []Cursor
+	numKeys      int          // How many of iter.keyers the page used up (some may be missing)
+	err          error
 }
 
 // {{{ NewIterator
 
-// Snarf down all the keys from the get go.
+// Snarf down all the keys from the get go. (Works on a copy of q, so the caller's query isn't
+// left as keys-only.)
 func NewIterator(ctx context.Context, p DatastoreProvider, q *Query, obj interface{}) *Iterator {
-	keyers,err := p.GetAll(ctx, q.KeysOnly(), nil)
+	qCopy := *q
+	keyers,err := p.GetAll(ctx, qCopy.KeysOnly(), nil)
 	iter := Iterator{
 		p: p,
 		ty: reflect.TypeOf(obj),
@@ -59,19 +124,41 @@ func NewIterator(ctx context.Context, p DatastoreProvider, q *Query, obj interfa
 	return &iter
 }
 
+// }}}
+// {{{ NewStreamingIterator
+
+// NewStreamingIterator returns an iterator that fetches results a page at a time, without
+// getting all the keys up front. Use q.Start() to resume from a cursor.
+func NewStreamingIterator(ctx context.Context, p DatastoreProvider, q *Query, obj interface{}) *Iterator {
+	qCopy := *q
+	iter := Iterator{
+		p: p,
+		ty: reflect.TypeOf(obj),
+		PageSize: 10,
+		q: &qCopy,
+		cursor: q.StartCursor,
+	}
+	return &iter
+}
+
 // }}}
 // {{{ Iterate
 
+// Iterate moves on to the next result; once it returns false, the iterator is closed.
 func (iter *Iterator)Iterate(ctx context.Context) bool {
-	if iter.err != nil { return false }
-	ok := iter.nextInPage(ctx)
-	return (ok && iter.err == nil)
+	if iter.err != nil || iter.closed { return false }
+	if ok := iter.nextInPage(ctx); ok && iter.err == nil {
+		return true
+	}
+	iter.Close()
+	return false
 }
 
 // }}}
 // {{{ Remaining
 
-// Remaining returns how many items are yet to be processed by the caller
+// Remaining returns how many items are yet to be processed by the caller. In streaming mode,
+// we don't know; it only counts the items in the current page.
 func (iter *Iterator)Remaining() int {
 	return iter.currSliceSize() + len(iter.keyers)
 }
@@ -87,6 +174,32 @@ func (iter *Iterator)Err() error {
 // Convenience function for things that wrap iterator
 func (iter *Iterator)SetErr(err error) { iter.err = err }
 
+// }}}
+// {{{ Close
+
+// Close stops any background prefetching, and waits for it to wind down. The iterator won't
+// return any more results. It is safe to call more than once, or on an iterator that isn't
+// prefetching.
+func (iter *Iterator)Close() {
+	iter.closed = true
+	if iter.pf != nil {
+		iter.pf.cancel()
+		iter.pf.wg.Wait()
+	}
+}
+
+// }}}
+// {{{ Cursor
+
+// Cursor returns a cursor pointing just after the most recent val, for checkpointing; pass it
+// to the query's Start() to resume. Only available in streaming mode.
+func (iter *Iterator)Cursor() (Cursor, error) {
+	if iter.q == nil {
+		return "", fmt.Errorf("dsprovider.iterator: Cursor() needs NewStreamingIterator")
+	}
+	return iter.cursor, nil
+}
+
 // }}}
 // {{{ Val
 
@@ -115,22 +228,20 @@ func (iter *Iterator)currSliceSize() int {
 	return reflect.ValueOf(iter.Slice).Len()
 }
 
-func (iter *Iterator)newSlice(size int) {
-	newSlcVal := reflect.MakeSlice(reflect.SliceOf(iter.ty), size, size)
+func (f *fetcher)newSlice(size int) reflect.Value {
+	return reflect.MakeSlice(reflect.SliceOf(f.ty), size, size)
+}
 
+func (iter *Iterator)setSlice(slcVal reflect.Value) {
 	// iter.slice might be nil, so can't do reflect.ValueOf(iter.slice).Set(newSlcVal); go up a level
 	iterVal := reflect.ValueOf(iter).Elem() // .Elem to dereference the pointer iter
-	iterVal.FieldByName("Slice").Set(newSlcVal)
+	iterVal.FieldByName("Slice").Set(slcVal)
 }
 
 func (iter *Iterator)sliceShift() interface{} {
 	slcVal := reflect.ValueOf(iter.Slice)
 	ret := slcVal.Index(0).Interface()          // ret := slc[0]
-
-	newSlcVal := slcVal.Slice(1, slcVal.Len())  // newslc := slc[1:]
-
-	iterVal := reflect.ValueOf(iter).Elem()
-	iterVal.FieldByName("Slice").Set(newSlcVal) // slc = newslc
+	iter.setSlice(slcVal.Slice(1, slcVal.Len()))  // slc = slc[1:]
 	return ret
 }
 
@@ -143,43 +254,233 @@ func (iter *Iterator)nextInPage(ctx context.Context) (bool) {
 	if iter.err != nil { return false }
 	if iter.PageSize == 0 { panic("pageslice not fit for purpose") }
 	
-	// No new vals left in the cache; fetch some new ones
-	if iter.Slice == nil || iter.currSliceSize() == 0 {
-		if len(iter.keyers) == 0 {
+	// No new vals left in the cache; fetch some new ones (skipping any pages that came back
+	// empty because all their entities had been deleted)
+	for iter.Slice == nil || iter.currSliceSize() == 0 {
+		pg,more := iter.nextPage(ctx)
+		if !more {
 			return false // We're all done !
-		}
-
-		var keysForThisBatch []Keyer
-
-		nextSliceSize := iter.PageSize
-		if len(iter.keyers) < nextSliceSize {
-			// Remaining keys not enough for a full page; grab all of 'em
-			nextSliceSize = len(iter.keyers)
-		}
-
-		keysForThisBatch  = iter.keyers[0:nextSliceSize]
-		iter.keyers       = iter.keyers[nextSliceSize:]
-
-		iter.sliceKeys = keysForThisBatch
-		iter.newSlice(nextSliceSize)
-		
-		// Fetch the objects for the keys in this batch, into the user-provided slice.
-		// GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error)
-		// if err := datastore.GetMulti(iter.Ctx, keysForThisBatch, iter.PageSlice); err != nil {
-		if err := iter.p.GetMulti(ctx, keysForThisBatch, iter.Slice); err != nil {
-			iter.err = err
+		} else if pg.err != nil {
+			iter.err = pg.err
 			return false
 		}
+
+		iter.keyers = iter.keyers[pg.numKeys:]
+		iter.setSlice(pg.slice)
+		iter.sliceKeys = pg.keys
+		iter.sliceCursors = pg.cursors
 	}
 
 	// We should have unreturned results in the cache, one way or another; shift & return the first
 	iter.val = iter.sliceShift()
 	iter.keyer = iter.sliceKeys[0]
 	iter.sliceKeys = iter.sliceKeys[1:]
+	if iter.q != nil {
+		iter.cursor = iter.sliceCursors[0]
+		iter.sliceCursors = iter.sliceCursors[1:]
+	}
 	
 	return true
 }
 
+// }}}
+// {{{ nextPage
+
+// nextPage returns the next page, either from the prefetchers or by fetching it now. The
+// bool is false when there are no more pages.
+func (iter *Iterator)nextPage(ctx context.Context) (page, bool) {
+	if iter.f == nil {
+		iter.f = &fetcher{p:iter.p, ty:iter.ty, pageSize:iter.PageSize}
+		if iter.q != nil {
+			iter.f.q, iter.f.nextCursor = iter.q, iter.q.StartCursor
+		}
+	}
+
+	if iter.Prefetch <= 0 {
+		if iter.q != nil {
+			return iter.f.fetchStreamPage(ctx)
+		} else if len(iter.keyers) == 0 {
+			return page{}, false
+		}
+		return iter.f.fetchKeysPage(ctx, iter.f.nextKeys(iter.keyers)), true
+	}
+
+	if iter.pf == nil {
+		iter.startPrefetching(ctx)
+	}
+	future,more := <-iter.pf.pages
+	if !more {
+		if err := ctx.Err(); err != nil {
+			return page{err:err}, true // The prefetcher gave up early
+		}
+		return page{}, false
+	}
+	return <-future, true
+}
+
+func (f *fetcher)nextKeys(keyers []Keyer) []Keyer {
+	if len(keyers) < f.pageSize {
+		// Remaining keys not enough for a full page; grab all of 'em
+		return keyers
+	}
+	return keyers[:f.pageSize]
+}
+
+// }}}
+// {{{ startPrefetching
+
+// startPrefetching kicks off a goroutine that lines up pages in pf.pages, in order. Each page
+// is a channel that will deliver the page once it has been fetched. There can be at most
+// iter.Prefetch pages waiting in pf.pages, which bounds the memory used.
+//
+// Key pages are independent, so they are all fetched concurrently. Streaming pages each need
+// the cursor from the previous page, so they are fetched one after the other, but still ahead
+// of the caller.
+//
+// The goroutines stop when they run out of pages, when Close cancels them, or when ctx is
+// done; until then, they hold on to at most iter.Prefetch pages.
+func (iter *Iterator)startPrefetching(ctx context.Context) {
+	pf := &prefetcher{pages: make(chan chan page, iter.Prefetch)}
+	ctx,pf.cancel = context.WithCancel(ctx)
+	iter.pf = pf
+
+	// Returns false if we should stop
+	enqueue := func(future chan page) bool {
+		select {
+		case pf.pages <- future:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	f := iter.f
+	streaming := iter.q != nil
+	keyers := iter.keyers // The caller's goroutine will be trimming iter.keyers as it goes
+
+	pf.wg.Add(1)
+	go func() {
+		defer pf.wg.Done()
+		defer close(pf.pages)
+
+		for {
+			future := make(chan page, 1) // Buffered, so fetchers never block
+			if streaming {
+				pg,more := f.fetchStreamPage(ctx)
+				if !more {
+					return
+				}
+				future <- pg
+				if !enqueue(future) || pg.err != nil {
+					return
+				}
+
+			} else {
+				if len(keyers) == 0 {
+					return
+				}
+				keysForThisBatch := f.nextKeys(keyers)
+				keyers = keyers[len(keysForThisBatch):]
+				if !enqueue(future) {
+					return
+				}
+				pf.wg.Add(1)
+				go func() {
+					defer pf.wg.Done()
+					future <- f.fetchKeysPage(ctx, keysForThisBatch)
+				}()
+			}
+		}
+	}()
+}
+
+// }}}
+// {{{ fetchKeysPage
+
+// Fetches the objects for the keys in this batch.
+func (f *fetcher)fetchKeysPage(ctx context.Context, keysForThisBatch []Keyer) page {
+	pg := page{
+		slice: f.newSlice(len(keysForThisBatch)),
+		keys: keysForThisBatch,
+		numKeys: len(keysForThisBatch),
+	}
+
+	if err := f.p.GetMulti(ctx, keysForThisBatch, pg.slice.Interface()); err != nil {
+		me,isMulti := err.(MultiError)
+		if !isMulti || !me.OnlyMissing() {
+			pg.err = err
+			return pg
+		}
+
+		// Some entities were deleted since we ran the query; drop them from the page.
+		found := me.FoundIndices()
+		newSlcVal := reflect.MakeSlice(pg.slice.Type(), 0, len(found))
+		newKeys := []Keyer{}
+		for _,i := range found {
+			newSlcVal = reflect.Append(newSlcVal, pg.slice.Index(i))
+			newKeys = append(newKeys, pg.keys[i])
+		}
+		pg.slice, pg.keys = newSlcVal, newKeys
+	}
+
+	return pg
+}
+
+// }}}
+// {{{ fetchStreamPage
+
+// Runs the query for the next page, in streaming mode. Returns false if there were no more
+// results.
+func (f *fetcher)fetchStreamPage(ctx context.Context) (page, bool) {
+	if f.queryDone { return page{}, false }
+
+	pageSize := f.pageSize
+	if f.q.LimitVal > 0 && f.q.LimitVal - f.numFetched < pageSize {
+		pageSize = f.q.LimitVal - f.numFetched
+	}
+	if pageSize <= 0 { return page{}, false }
+
+	q := *f.q
+	q.LimitVal = pageSize
+	q.StartCursor = f.nextCursor
+	if f.numFetched > 0 {
+		q.OffsetVal = 0 // The offset was applied to the first page
+	}
+
+	it := f.p.Run(ctx, &q)
+	pg := page{slice: f.newSlice(pageSize), keys: []Keyer{}, cursors: []Cursor{}}
+
+	for i:=0; i<pageSize; i++ {
+		keyer,err := it.Next(sliceElemPtr(pg.slice.Index(i)))
+		if err == ErrDone {
+			break
+		} else if err != nil {
+			pg.err = err
+			return pg, true
+		}
+		c,err := it.Cursor()
+		if err != nil {
+			pg.err = err
+			return pg, true
+		}
+		pg.keys = append(pg.keys, keyer)
+		pg.cursors = append(pg.cursors, c)
+	}
+
+	n := len(pg.keys)
+	f.numFetched += n
+	if n < pageSize {
+		f.queryDone = true
+		pg.slice = pg.slice.Slice(0, n)
+	}
+	if n == 0 {
+		return page{}, false
+	}
+	f.nextCursor = pg.cursors[n-1]
+
+	return pg, true
+}
+
 // }}}
 
 // {{{ -------------------------={ E N D }=----------------------------------
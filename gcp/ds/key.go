@@ -0,0 +1,198 @@
+package ds
+
+import(
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+/*
+
+ // Pick apart any key from a provider
+ fmt.Printf("%s/%d in ns %q\n", p.KeyKind(k), p.KeyID(k), p.KeyNamespace(k))
+ for _,elem := range p.KeyPath(k) { ... }
+
+ // Or build keys without a provider (or a client); they can be passed to any provider
+ k := ds.NewKey("", ds.PathName("Root", "root"), ds.PathID("Foo", 123))
+ k2 := ds.KeyOf(keyerFromSomewhere)
+ if k.Equal(k2) { ... }
+ str := k.Encode()          // Same encoding as the providers use; ParseKey() undoes it
+
+ */
+
+// PathElement is one step in a key's ancestor path. A complete key has either a Name or a
+// non-zero ID, but not both.
+type PathElement struct {
+	Kind string
+	Name string
+	ID   int64
+}
+
+func PathName(kind, name string) PathElement { return PathElement{Kind:kind, Name:name} }
+func PathID(kind string, id int64) PathElement { return PathElement{Kind:kind, ID:id} }
+
+func (pe PathElement)String() string {
+	if pe.Name != "" { return fmt.Sprintf("%s,%s", pe.Kind, pe.Name) }
+	return fmt.Sprintf("%s,%d", pe.Kind, pe.ID)
+}
+
+// {{{ Key
+
+// Key is a provider-neutral key; it is a Keyer, so can be passed to any provider. The path
+// runs from the root down to the key itself. Keys should be compared with Equal, not ==.
+type Key struct {
+	Namespace string
+	Path    []PathElement
+}
+
+func NewKey(ns string, path ...PathElement) Key { return Key{Namespace:ns, Path:path} }
+
+// KeyOf converts any Keyer into a Key; nil becomes the zero Key.
+func KeyOf(keyer Keyer) Key {
+	k := toDatastoreKey(keyer)
+	if k == nil { return Key{} }
+	out := Key{Namespace:k.Namespace}
+	for ; k != nil; k = k.Parent {
+		out.Path = append([]PathElement{{Kind:k.Kind, Name:k.Name, ID:k.ID}}, out.Path...)
+	}
+	return out
+}
+
+// ParseKey decodes the output of Key.Encode (or of any provider key's Encode).
+func ParseKey(encoded string) (Key, error) {
+	k,err := datastore.DecodeKey(encoded)
+	if err != nil {
+		return Key{}, err
+	}
+	return KeyOf(k), nil
+}
+
+func (k Key)last() PathElement {
+	if len(k.Path) == 0 { return PathElement{} }
+	return k.Path[len(k.Path)-1]
+}
+
+func (k Key)Kind() string { return k.last().Kind }
+func (k Key)Name() string { return k.last().Name }
+func (k Key)ID() int64    { return k.last().ID }
+func (k Key)Incomplete() bool { return k.Name() == "" && k.ID() == 0 }
+
+// Parent returns the parent key; false if the key is a root key.
+func (k Key)Parent() (Key, bool) {
+	if len(k.Path) < 2 { return Key{}, false }
+	return Key{Namespace:k.Namespace, Path:k.Path[:len(k.Path)-1]}, true
+}
+
+// Child returns a new key under this one.
+func (k Key)Child(elem PathElement) Key {
+	path := append(append([]PathElement{}, k.Path...), elem)
+	return Key{Namespace:k.Namespace, Path:path}
+}
+
+func (k Key)Equal(o Key) bool {
+	if k.Namespace != o.Namespace || len(k.Path) != len(o.Path) { return false }
+	for i := range k.Path {
+		if k.Path[i] != o.Path[i] { return false }
+	}
+	return true
+}
+
+// Encode implements Keyer, using the same encoding as the datastore library.
+func (k Key)Encode() string {
+	if dsKey := k.datastoreKey(); dsKey != nil {
+		return dsKey.Encode()
+	}
+	return ""
+}
+
+// String renders the key like datastore.Key does, e.g. /Root,root/Foo,123
+func (k Key)String() string {
+	strs := []string{}
+	for _,pe := range k.Path {
+		strs = append(strs, pe.String())
+	}
+	return "/" + strings.Join(strs, "/")
+}
+
+// MarshalText and UnmarshalText let keys be stored as encoded strings in JSON, etc.
+func (k Key)MarshalText() ([]byte, error) {
+	return []byte(k.Encode()), nil
+}
+func (k *Key)UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*k = Key{}
+		return nil
+	}
+	parsed,err := ParseKey(string(b))
+	if err != nil {
+		return err
+	}
+	*k = parsed
+	return nil
+}
+
+func (k Key)datastoreKey() *datastore.Key {
+	var out *datastore.Key
+	for _,pe := range k.Path {
+		out = &datastore.Key{Kind:pe.Kind, Name:pe.Name, ID:pe.ID, Parent:out, Namespace:k.Namespace}
+	}
+	return out
+}
+
+// }}}
+// {{{ toDatastoreKey
+
+// toDatastoreKey unpacks a Keyer for the providers, which all work with *datastore.Key.
+func toDatastoreKey(keyer Keyer) *datastore.Key {
+	switch k := keyer.(type) {
+	case nil:
+		return nil
+	case *datastore.Key:
+		return k
+	case Key:
+		return k.datastoreKey()
+	case *Key:
+		if k == nil { return nil }
+		return k.datastoreKey()
+	}
+	panic(fmt.Sprintf("dsprovider: unknown Keyer type %T", keyer))
+}
+
+// }}}
+// {{{ key inspection
+
+// These do the work for the providers' Key* methods.
+
+func keyKind(keyer Keyer) string {
+	if k := toDatastoreKey(keyer); k != nil { return k.Kind }
+	return ""
+}
+func keyID(keyer Keyer) int64 {
+	if k := toDatastoreKey(keyer); k != nil { return k.ID }
+	return 0
+}
+func keyNamespace(keyer Keyer) string {
+	if k := toDatastoreKey(keyer); k != nil { return k.Namespace }
+	return ""
+}
+func keyPath(keyer Keyer) []PathElement {
+	return KeyOf(keyer).Path
+}
+func keyEqual(a, b Keyer) bool {
+	ak,bk := toDatastoreKey(a), toDatastoreKey(b)
+	if ak == nil || bk == nil {
+		return ak == nil && bk == nil
+	}
+	return ak.Equal(bk)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
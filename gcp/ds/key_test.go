@@ -0,0 +1,85 @@
+package ds
+
+import(
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestKeyInspection(t *testing.T) {
+	p := NewMemoryProvider()
+	nsCtx := SetNamespace(ctx, "ns1")
+	root := p.NewNameKey(nsCtx, "Root", "root", nil)
+	k := p.NewIDKey(ctx, "Foo", 123, root)
+
+	if p.KeyKind(k) != "Foo" || p.KeyID(k) != 123 || p.KeyName(k) != "" || p.KeyNamespace(k) != "ns1" {
+		t.Errorf("bad key inspection: %q %d %q %q", p.KeyKind(k), p.KeyID(k), p.KeyName(k), p.KeyNamespace(k))
+	}
+	if path := p.KeyPath(k); fmt.Sprintf("%v", path) != "[Root,root Foo,123]" {
+		t.Errorf("bad KeyPath: %v", path)
+	}
+	if !p.KeyEqual(k, p.NewIDKey(ctx, "Foo", 123, root)) || p.KeyEqual(k, root) || p.KeyEqual(k, nil) {
+		t.Errorf("bad KeyEqual")
+	}
+
+	// A neutral key, built without a provider, should be interchangeable with the provider's
+	dk := NewKey("ns1", PathName("Root", "root"), PathID("Foo", 123))
+	if dk.Encode() != k.Encode() || !p.KeyEqual(dk, k) || !dk.Equal(KeyOf(k)) {
+		t.Errorf("neutral key %v doesn't match provider key %v", dk, k)
+	}
+	if parent,ok := dk.Parent(); !ok || !p.KeyEqual(parent, root) || p.KeyKind(dk) != "Foo" {
+		t.Errorf("neutral key, bad parent %v", parent)
+	}
+	if _,err := p.Put(ctx, dk.Child(PathName("Bar", "b")), &Bar{S:"x"}); err != nil {
+		t.Fatalf("Put with neutral key: %v", err)
+	}
+	bar := Bar{}
+	if err := p.Get(ctx, p.NewNameKey(ctx, "Bar", "b", k), &bar); err != nil || bar.S != "x" {
+		t.Errorf("Get after Put with neutral key: %v, %+v", err, bar)
+	}
+
+	// Serialization
+	parsed,err := ParseKey(dk.Encode())
+	if err != nil || !parsed.Equal(dk) {
+		t.Errorf("ParseKey, got %v, %v", parsed, err)
+	}
+	type wrapper struct { K Key }
+	js,err := json.Marshal(wrapper{dk})
+	out := wrapper{}
+	if err != nil {
+		t.Errorf("json.Marshal: %v", err)
+	} else if err := json.Unmarshal(js, &out); err != nil || !out.K.Equal(dk) {
+		t.Errorf("json round trip, got %v (%v) from %s", out.K, err, js)
+	}
+	if dk.String() != "/Root,root/Foo,123" || !NewKey("", PathID("Foo", 0)).Incomplete() {
+		t.Errorf("bad String, or Incomplete: %s", dk)
+	}
+}
+
+func TestKeyFilterValues(t *testing.T) {
+	p,_ := newTestProvider(t)
+	dk := NewKey("", PathName("Root", "root"), PathID("Foo", 102))
+
+	// Neutral keys work as filter values, not just the provider's own
+	keyers,err := p.GetAll(ctx, NewQuery("Foo").Filter("__key__ >", dk), nil)
+	if err != nil || len(keyers) != 2 {
+		t.Errorf("filter on neutral key, expected 2 results, got %v (err: %v)", keyers, err)
+	}
+	keyers,err = p.GetAll(ctx, NewQuery("Foo").FilterEntity(In("__key__", []Key{dk})), nil)
+	if err != nil || len(keyers) != 1 || !p.KeyEqual(keyers[0], dk) {
+		t.Errorf("IN filter on neutral keys, got %v (err: %v)", keyers, err)
+	}
+
+	// The cloud provider hands the library *datastore.Keys
+	if k,ok := filterValue(dk).(*datastore.Key); !ok || k.ID != 102 {
+		t.Errorf("filterValue(Key), got %#v", filterValue(dk))
+	}
+	if ks,ok := filterValue([]Key{dk}).([]*datastore.Key); !ok || len(ks) != 1 || ks[0].ID != 102 {
+		t.Errorf("filterValue([]Key), got %#v", filterValue([]Key{dk}))
+	}
+	if v := filterValue([]string{"a"}); fmt.Sprintf("%v", v) != "[a]" {
+		t.Errorf("filterValue([]string), got %#v", v)
+	}
+}
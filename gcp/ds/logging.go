@@ -0,0 +1,188 @@
+package ds
+
+import(
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+/*
+
+ // Cloud Logging picks up JSON lines on stdout (Cloud Run, GKE, etc) as structured entries
+ p,err := ds.NewCloudDSProvider(ctx, "myproject",
+   ds.WithLogHandler(ds.NewCloudLoggingHandler(os.Stdout, slog.LevelDebug)),
+   ds.WithLogLevel(slog.LevelDebug))
+
+ // Attributes attached to the context turn up in every record logged with it
+ ctx = ds.WithLogAttrs(ctx, ds.TraceAttr("myproject", ds.CloudTraceID(r)), slog.String("user", u))
+ p.Infof(ctx, "fetched %d flights", n)
+ p.Logger().InfoContext(ctx, "fetched flights", "n", n)
+
+ p.SetLogLevel(slog.LevelDebug) // Just for this provider
+
+ */
+
+// LevelCritical is above slog.LevelError; Cloud Logging calls it CRITICAL.
+const LevelCritical = slog.Level(12)
+
+// {{{ providerLogger
+
+// providerLogger is embedded in the providers, to give them the DatastoreProvider logging
+// methods. Each provider has its own level, so debug output can be turned on for just one.
+type providerLogger struct {
+	logger *slog.Logger
+	level  *slog.LevelVar
+}
+
+// newDefaultLogHandler lets everything through; the provider's level does the filtering.
+func newDefaultLogHandler(w io.Writer) slog.Handler {
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+}
+
+func newProviderLogger(h slog.Handler, level slog.Level) providerLogger {
+	lv := new(slog.LevelVar)
+	lv.Set(level)
+	return providerLogger{slog.New(&contextHandler{h, lv}), lv}
+}
+
+// Logger returns the provider's logger, for structured logging. Records logged with the
+// *Context methods pick up any attributes from WithLogAttrs.
+func (pl providerLogger)Logger() *slog.Logger {
+	if pl.logger == nil { return slog.Default() } // Provider wasn't built by its constructor
+	return pl.logger
+}
+
+// SetLogLevel sets the minimum level that the provider logs; e.g. slog.LevelDebug to turn on
+// its Debugf output.
+func (pl providerLogger)SetLogLevel(level slog.Level) {
+	if pl.level != nil { pl.level.Set(level) }
+}
+
+func (pl providerLogger)logf(ctx context.Context, level slog.Level, format string, args ...interface{}) {
+	l := pl.Logger()
+	if !l.Enabled(ctx, level) { return } // Don't bother formatting
+	l.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (pl providerLogger)Debugf(ctx context.Context, format string, args ...interface{}) {
+	pl.logf(ctx, slog.LevelDebug, format, args...)
+}
+func (pl providerLogger)Infof(ctx context.Context, format string, args ...interface{}) {
+	pl.logf(ctx, slog.LevelInfo, format, args...)
+}
+func (pl providerLogger)Warningf(ctx context.Context, format string, args ...interface{}) {
+	pl.logf(ctx, slog.LevelWarn, format, args...)
+}
+func (pl providerLogger)Errorf(ctx context.Context, format string, args ...interface{}) {
+	pl.logf(ctx, slog.LevelError, format, args...)
+}
+func (pl providerLogger)Criticalf(ctx context.Context, format string, args ...interface{}) {
+	pl.logf(ctx, LevelCritical, format, args...)
+}
+
+// }}}
+// {{{ contextHandler
+
+// contextHandler applies the provider's level, and adds the attributes from the context.
+type contextHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *contextHandler)Enabled(ctx context.Context, level slog.Level) bool {
+	min := h.level.Level()
+	if Debug && min > slog.LevelDebug { min = slog.LevelDebug }
+	return level >= min && h.Handler.Enabled(ctx, level)
+}
+
+func (h *contextHandler)Handle(ctx context.Context, r slog.Record) error {
+	if attrs := LogAttrs(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler)WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h *contextHandler)WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// WithLogAttrs returns a context that adds the attributes to everything the providers log
+// with it (on top of any already in ctx).
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	all := append(append([]slog.Attr{}, LogAttrs(ctx)...), attrs...)
+	return context.WithValue(ctx, logAttrsKey, all)
+}
+
+// LogAttrs returns the attributes set with WithLogAttrs.
+func LogAttrs(ctx context.Context) []slog.Attr {
+	attrs,_ := ctx.Value(logAttrsKey).([]slog.Attr)
+	return attrs
+}
+
+// }}}
+// {{{ Cloud Logging
+
+// NewCloudLoggingHandler writes JSON in the format that Cloud Logging's agents parse into
+// structured log entries: "severity" and "message" fields, with slog's levels mapped onto
+// Cloud Logging's severities.
+func NewCloudLoggingHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.MessageKey:
+				a.Key = "message"
+			case slog.LevelKey:
+				a.Key = "severity"
+				a.Value = slog.StringValue(cloudSeverity(a.Value.Any().(slog.Level)))
+			}
+			return a
+		},
+	})
+}
+
+func cloudSeverity(l slog.Level) string {
+	switch {
+	case l >= LevelCritical:  return "CRITICAL"
+	case l >= slog.LevelError: return "ERROR"
+	case l >= slog.LevelWarn:  return "WARNING"
+	case l >= slog.LevelInfo:  return "INFO"
+	}
+	return "DEBUG"
+}
+
+// TraceAttr links log entries to a Cloud Trace trace, so they get grouped with the request.
+func TraceAttr(project, traceID string) slog.Attr {
+	return slog.String("logging.googleapis.com/trace", fmt.Sprintf("projects/%s/traces/%s", project, traceID))
+}
+
+// CloudTraceID pulls the trace ID out of the X-Cloud-Trace-Context header, which looks like
+// "TRACE_ID/SPAN_ID;o=1"; empty if there isn't one.
+func CloudTraceID(r *http.Request) string {
+	h := r.Header.Get("X-Cloud-Trace-Context")
+	if i := strings.IndexAny(h, "/;"); i >= 0 {
+		h = h[:i]
+	}
+	return h
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,55 @@
+package ds
+
+import(
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProviderLogging(t *testing.T) {
+	buf := bytes.Buffer{}
+	p := NewMemoryProvider()
+	p.SetLogHandler(NewCloudLoggingHandler(&buf, slog.LevelDebug))
+	other := NewMemoryProvider()
+
+	p.Debugf(ctx, "not yet")
+	if buf.Len() != 0 {
+		t.Errorf("Debugf logged at the default level: %s", buf.String())
+	}
+	Debug = true // The deprecated global still works
+	if !other.Logger().Enabled(ctx, slog.LevelDebug) {
+		t.Errorf("ds.Debug didn't enable Debugf")
+	}
+	Debug = false
+	p.SetLogLevel(slog.LevelDebug)
+	if other.Logger().Enabled(ctx, slog.LevelDebug) {
+		t.Errorf("SetLogLevel leaked into another provider")
+	}
+
+	r,_ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "abc123/456;o=1")
+	lctx := WithLogAttrs(ctx, TraceAttr("proj", CloudTraceID(r)))
+	lctx = WithLogAttrs(lctx, slog.String("user", "u1"))
+
+	p.Debugf(lctx, "hello %d", 1)
+	p.Criticalf(ctx, "oh no")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got: %s", buf.String())
+	}
+	rec := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("bad JSON %q: %v", lines[0], err)
+	}
+	if rec["severity"] != "DEBUG" || rec["message"] != "hello 1" || rec["user"] != "u1" ||
+		rec["logging.googleapis.com/trace"] != "projects/proj/traces/abc123" {
+		t.Errorf("bad log record: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"severity":"CRITICAL"`) || strings.Contains(lines[1], "user") {
+		t.Errorf("bad log record: %s", lines[1])
+	}
+}
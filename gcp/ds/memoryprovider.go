@@ -0,0 +1,759 @@
+package ds
+
+import(
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+/*
+
+ p := ds.NewMemoryProvider()  // Implements DatastoreProvider, entirely in memory
+
+ k := p.NewNameKey(ctx, "Foo", "foo1", nil)
+ if _,err := p.Put(ctx, k, &Foo{S:"hello"}); err != nil { ... }
+
+ foos := []Foo{}
+ keyers,err := p.GetAll(ctx, ds.NewQuery("Foo").Filter("S =", "hello"), &foos)
+
+ */
+
+// MemoryProvider implements the DatastoreProvider interface on top of an in-memory map, for
+// hermetic tests of code that is written against DatastoreProvider. Keyers are
+// *datastore.Key, just as with CloudDSProvider, and entities are stored as the property lists
+// that the cloud library would have sent over the wire, so struct tags, PropertyLoadSavers
+// and field mismatches behave as they would against the real thing.
+type MemoryProvider struct {
+	Namespace  string // The default namespace for new root keys, and queries; see namespace.go
+	providerLogger    // Debugf etc; see logging.go
+
+	mu         sync.Mutex
+	entities   map[string]*memEntity // Keyed by the encoded key
+	lastID     int64                 // For completing incomplete keys
+
+	// Every write to a key bumps its version; transactions use these to detect contention.
+	versions   map[string]int64
+	lastVersion int64
+}
+
+type memEntity struct {
+	key    *datastore.Key
+	props  []datastore.Property
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{
+		providerLogger: newProviderLogger(newDefaultLogHandler(os.Stderr), slog.LevelInfo),
+		entities: map[string]*memEntity{},
+		versions: map[string]int64{},
+	}
+}
+
+// {{{ property load/save
+
+func memSave(src interface{}) ([]datastore.Property, error) {
+	if pls,ok := src.(datastore.PropertyLoadSaver); ok {
+		props,err := pls.Save()
+		return copyProperties(props), err
+	}
+	props,err := datastore.SaveStruct(src)
+	return copyProperties(props), err
+}
+
+func memLoad(dst interface{}, props []datastore.Property) error {
+	props = copyProperties(props)
+	if pls,ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	if err := datastore.LoadStruct(dst, props); err != nil {
+		if _,assertionOk := err.(*datastore.ErrFieldMismatch); assertionOk {
+			return ErrFieldMismatch
+		}
+		return err
+	}
+	return nil
+}
+
+// copyProperties makes sure the stored properties don't share any mutable state with the
+// caller's objects.
+func copyProperties(in []datastore.Property) []datastore.Property {
+	out := make([]datastore.Property, len(in)) // Never nil; nil props mean a deletion
+	for i,p := range in {
+		out[i] = p
+		out[i].Value = copyValue(p.Value)
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []byte:
+		return append([]byte{}, val...)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i := range val { out[i] = copyValue(val[i]) }
+		return out
+	case *datastore.Entity:
+		if val == nil { return val }
+		return &datastore.Entity{Key: val.Key, Properties: copyProperties(val.Properties)}
+	}
+	return v
+}
+
+// sliceElemPtr returns something from a slice element that memLoad or memSave can work on; a
+// struct pointer, or a PropertyLoadSaver. Nil pointers are allocated.
+func sliceElemPtr(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() { v.Set(reflect.New(v.Type().Elem())) }
+		return v.Interface()
+	case reflect.Interface:
+		return v.Elem().Interface()
+	}
+	return v.Addr().Interface()
+}
+
+func sliceArg(funcName string, arg interface{}, n int) (reflect.Value, error) {
+	v := reflect.ValueOf(arg)
+	if v.Kind() != reflect.Slice {
+		return v, fmt.Errorf("%s{memory}: expected a slice, got %T", funcName, arg)
+	} else if v.Len() != n {
+		return v, fmt.Errorf("%s{memory}: %d keys, but slice had %d elements", funcName, n, v.Len())
+	}
+	return v, nil
+}
+
+// }}}
+// {{{ key handling
+
+func (p *MemoryProvider)unpackKeyer(in Keyer) *datastore.Key {
+	return toDatastoreKey(in)
+}
+
+// completeKeyOrErr unpacks a key for reading or deleting, which (as in the cloud API) needs a
+// complete key.
+func (p *MemoryProvider)completeKeyOrErr(in Keyer) (*datastore.Key, error) {
+	k := p.unpackKeyer(in)
+	if k == nil || k.Incomplete() {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// completeKey assigns an ID to an incomplete key; must be called with the lock held.
+func (p *MemoryProvider)completeKey(k *datastore.Key) *datastore.Key {
+	if !k.Incomplete() { return k }
+	p.lastID++
+	newKey := datastore.IDKey(k.Kind, p.lastID, k.Parent)
+	newKey.Namespace = k.Namespace
+	return newKey
+}
+
+// write stores (or, if props is nil, deletes) an entity; must be called with the lock held.
+func (p *MemoryProvider)write(k *datastore.Key, props []datastore.Property) *datastore.Key {
+	k = p.completeKey(k)
+	encoded := k.Encode()
+	if props == nil {
+		delete(p.entities, encoded)
+	} else {
+		p.entities[encoded] = &memEntity{key:k, props:props}
+	}
+	p.lastVersion++
+	p.versions[encoded] = p.lastVersion
+	return k
+}
+
+// }}}
+
+// {{{ Get, GetMulti, GetAll
+
+func (p *MemoryProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	k,err := p.completeKeyOrErr(keyer)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	ent,exists := p.entities[k.Encode()]
+	p.mu.Unlock()
+
+	if !exists {
+		return ErrNoSuchEntity
+	}
+	return memLoad(dst, ent.props)
+}
+
+// GetMulti returns a MultiError if some keys could not be fetched.
+func (p *MemoryProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	v,err := sliceArg("GetMulti", dst, len(keyers))
+	if err != nil { return err }
+
+	me := make(MultiError, len(keyers))
+	for i,keyer := range keyers {
+		me[i] = p.Get(ctx, keyer, sliceElemPtr(v.Index(i)))
+	}
+	return me.errOrNil()
+}
+
+func (p *MemoryProvider)GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error) {
+	warnIfInvalid(ctx, p, q)
+	p.mu.Lock()
+	results,_,err := p.runQuery(queryNamespace(ctx, q, p.Namespace), q)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("GetAll{memory}: %v\nQuery: %s", err, q)
+	}
+
+	keyers := []Keyer{}
+	for _,ent := range results {
+		keyers = append(keyers, Keyer(ent.key))
+	}
+	if q.KeysOnlyVal || dst == nil {
+		return keyers, nil
+	}
+
+	slcPtr := reflect.ValueOf(dst)
+	if slcPtr.Kind() != reflect.Ptr || slcPtr.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("GetAll{memory}: dst must be a pointer to a slice, got %T", dst)
+	}
+	slc := slcPtr.Elem()
+	elemType := slc.Type().Elem()
+
+	var mismatchErr error
+	for _,ent := range results {
+		elem := reflect.New(elemType).Elem()
+		if err := memLoad(sliceElemPtr(elem), ent.props); err == ErrFieldMismatch {
+			mismatchErr = err
+		} else if err != nil {
+			return nil, fmt.Errorf("GetAll{memory}: %v\nQuery: %s", err, q)
+		}
+		slc.Set(reflect.Append(slc, elem))
+	}
+
+	return keyers, mismatchErr
+}
+
+// }}}
+// {{{ Count, Aggregate
+
+func (p *MemoryProvider)Count(ctx context.Context, q *Query) (int, error) {
+	agg := AggregateCount("")
+	res,err := p.Aggregate(ctx, q, agg)
+	return int(res.Int(agg.Alias)), err
+}
+
+func (p *MemoryProvider)Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	warnIfInvalid(ctx, p, q)
+	p.mu.Lock()
+	results,_,err := p.runQuery(queryNamespace(ctx, q, p.Namespace), q)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate{memory}: %v\nQuery: %s", err, q)
+	}
+
+	out := AggregationResult{}
+	for _,agg := range aggs {
+		agg = agg.withDefaultAlias()
+		switch agg.Type {
+		case AggCount:
+			out[agg.Alias] = int64(len(results))
+		case AggSum, AggAvg:
+			out[agg.Alias] = aggregateField(results, agg)
+		default:
+			return nil, fmt.Errorf("Aggregate{memory}: unknown aggregation %q", agg.Type)
+		}
+	}
+	return out, nil
+}
+
+// }}}
+// {{{ Run
+
+func (p *MemoryProvider)Run(ctx context.Context, q *Query) QueryIterator {
+	warnIfInvalid(ctx, p, q)
+	p.mu.Lock()
+	results,lastSkipped,err := p.runQuery(queryNamespace(ctx, q, p.Namespace), q)
+	p.mu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("Run{memory}: %v\nQuery: %s", err, q)
+	}
+
+	return &memIterator{
+		p: p,
+		results: results,
+		keysOnly: q.KeysOnlyVal,
+		last: lastSkipped,
+		startCursor: q.StartCursor,
+		orders: q.allOrders(),
+		err: err,
+	}
+}
+
+// memIterator runs over a snapshot of the results, taken when the query was run.
+type memIterator struct {
+	p           *MemoryProvider
+	results   []*memEntity
+	keysOnly    bool
+	last        *memEntity // The most recently returned (or skipped) result
+	startCursor Cursor
+	orders    []Order
+	err         error
+}
+
+func (it *memIterator)Next(dst interface{}) (Keyer, error) {
+	if it.err != nil {
+		return nil, it.err
+	} else if len(it.results) == 0 {
+		return nil, ErrDone
+	}
+
+	ent := it.results[0]
+	it.results = it.results[1:]
+	it.last = ent
+
+	if it.keysOnly || dst == nil {
+		return Keyer(ent.key), nil
+	}
+	return Keyer(ent.key), memLoad(dst, ent.props)
+}
+
+func (it *memIterator)Cursor() (Cursor, error) {
+	if it.err != nil {
+		return "", it.err
+	} else if it.last == nil {
+		return it.startCursor, nil
+	}
+	return encodeMemCursor(it.last, it.orders)
+}
+
+// The types that can turn up in a datastore.Property's Value, which gob needs to know about;
+// for the cursors, and for the properties that a CachingProvider caches.
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(&datastore.Key{})
+	gob.Register(datastore.GeoPoint{})
+	gob.Register(&datastore.Entity{})
+	gob.Register([]interface{}{})
+}
+
+// memCursor is what a MemoryProvider cursor holds: the entity it points after, with just the
+// properties the query was sorted on. So the provider doesn't need to keep track of cursors.
+type memCursor struct {
+	Key    string
+	Props  []datastore.Property
+}
+
+func encodeMemCursor(ent *memEntity, orders []Order) (Cursor, error) {
+	mc := memCursor{Key: ent.key.Encode()}
+	for _,prop := range ent.props {
+		for _,o := range orders {
+			if prop.Name == o.Field { mc.Props = append(mc.Props, prop); break }
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(mc); err != nil {
+		return "", fmt.Errorf("Cursor{memory}: %v", err)
+	}
+	return Cursor(base64.RawURLEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func decodeMemCursor(c Cursor) (*memEntity, error) {
+	b,err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return nil, err
+	}
+	mc := memCursor{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&mc); err != nil {
+		return nil, err
+	}
+	k,err := datastore.DecodeKey(mc.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &memEntity{key:k, props:mc.Props}, nil
+}
+
+// }}}
+// {{{ Put, PutMulti
+
+func (p *MemoryProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
+	k := p.unpackKeyer(keyer)
+	if k == nil {
+		return nil, fmt.Errorf("Put{memory}: nil key")
+	}
+
+	props,err := memSave(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Keyer(p.write(k, props)), nil
+}
+
+func (p *MemoryProvider)PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error) {
+	v,err := sliceArg("PutMulti", src, len(keyers))
+	if err != nil { return nil, err }
+
+	out := []Keyer{}
+	me := make(MultiError, len(keyers))
+	for i,keyer := range keyers {
+		var k Keyer
+		k,me[i] = p.Put(ctx, keyer, sliceElemPtr(v.Index(i)))
+		out = append(out, k)
+	}
+	return out, me.errOrNil()
+}
+
+// }}}
+// {{{ Delete, DeleteMulti
+
+// Delete silently succeeds if the entity does not exist, as does the cloud API.
+func (p *MemoryProvider)Delete(ctx context.Context, keyer Keyer) error {
+	k,err := p.completeKeyOrErr(keyer)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.write(k, nil)
+	return nil
+}
+
+func (p *MemoryProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
+	me := make(MultiError, len(keyers))
+	for i,keyer := range keyers {
+		me[i] = p.Delete(ctx, keyer)
+	}
+	return me.errOrNil()
+}
+
+// }}}
+
+// {{{ Mutate
+
+// memPrepareMutations validates the mutations and saves their srcs; deletes get nil props.
+func (p *MemoryProvider)memPrepareMutations(muts []Mutation) ([]*datastore.Key, [][]datastore.Property, error) {
+	keys := make([]*datastore.Key, len(muts))
+	props := make([][]datastore.Property, len(muts))
+	me := make(MultiError, len(muts))
+	for i,m := range muts {
+		if me[i] = m.validate(); me[i] != nil {
+			continue
+		}
+		keys[i] = p.unpackKeyer(m.Keyer)
+		if keys[i] == nil {
+			me[i] = ErrInvalidKey // e.g. a typed nil *datastore.Key, or an empty Key{}
+		} else if m.Op == MutationDelete {
+			if keys[i].Incomplete() { me[i] = fmt.Errorf("%s: incomplete key", m) }
+		} else {
+			props[i],me[i] = memSave(m.Src)
+		}
+	}
+	return keys, props, me.errOrNil()
+}
+
+// checkMutations sees whether each mutation's precondition holds, taking into account the
+// effects of the earlier mutations in the list.
+func checkMutations(muts []Mutation, keys []*datastore.Key, exists func(encoded string) bool) error {
+	me := make(MultiError, len(muts))
+	overlay := map[string]bool{}
+	for i,m := range muts {
+		if keys[i].Incomplete() {
+			if m.Op == MutationUpdate { me[i] = ErrNoSuchEntity }
+			continue // Will get a brand new ID
+		}
+		encoded := keys[i].Encode()
+		found,seen := overlay[encoded]
+		if !seen {
+			found = exists(encoded)
+		}
+		if m.Op == MutationInsert && found {
+			me[i] = ErrEntityExists
+		} else if m.Op == MutationUpdate && !found {
+			me[i] = ErrNoSuchEntity
+		}
+		overlay[encoded] = m.Op != MutationDelete
+	}
+	return me.errOrNil()
+}
+
+func (p *MemoryProvider)Mutate(ctx context.Context, muts ...Mutation) ([]Keyer, error) {
+	keys,props,err := p.memPrepareMutations(muts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = checkMutations(muts, keys, func(encoded string) bool {
+		_,exists := p.entities[encoded]
+		return exists
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := []Keyer{}
+	for i := range muts {
+		out = append(out, Keyer(p.write(keys[i], props[i])))
+	}
+	return out, nil
+}
+
+// }}}
+
+// {{{ RunInTransaction
+
+// RunInTransaction uses optimistic concurrency; the transaction remembers the version of
+// every key it reads, and fails to commit (with ErrConcurrentTransaction) if any of them were
+// written to by someone else in the meantime.
+func (p *MemoryProvider)RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts *TransactionOptions) error {
+	for i:=0; i<opts.maxAttempts(); i++ {
+		tx := &memTransaction{p:p, readOnly:opts.readOnly(), reads:map[string]int64{}}
+		if err := f(tx); err != nil {
+			return err
+		}
+		if tx.commit() {
+			return nil
+		}
+	}
+	return ErrConcurrentTransaction
+}
+
+type memTransaction struct {
+	p         *MemoryProvider
+	readOnly   bool
+	reads      map[string]int64 // encoded key -> the version we read
+	writes   []memWrite
+}
+
+type memWrite struct {
+	key    *datastore.Key
+	props  []datastore.Property // nil for deletes
+}
+
+func (tx *memTransaction)commit() bool {
+	tx.p.mu.Lock()
+	defer tx.p.mu.Unlock()
+
+	for encoded,version := range tx.reads {
+		if tx.p.versions[encoded] != version {
+			return false
+		}
+	}
+	for _,w := range tx.writes {
+		tx.p.write(w.key, w.props)
+	}
+	return true
+}
+
+func (tx *memTransaction)Get(keyer Keyer, dst interface{}) error {
+	k,err := tx.p.completeKeyOrErr(keyer)
+	if err != nil {
+		return err
+	}
+	encoded := k.Encode()
+
+	tx.p.mu.Lock()
+	ent,exists := tx.p.entities[encoded]
+	if _,seen := tx.reads[encoded]; !seen {
+		tx.reads[encoded] = tx.p.versions[encoded]
+	}
+	tx.p.mu.Unlock()
+
+	if !exists {
+		return ErrNoSuchEntity
+	}
+	return memLoad(dst, ent.props)
+}
+
+func (tx *memTransaction)GetMulti(keyers []Keyer, dst interface{}) error {
+	v,err := sliceArg("GetMulti", dst, len(keyers))
+	if err != nil { return err }
+
+	me := make(MultiError, len(keyers))
+	for i,keyer := range keyers {
+		me[i] = tx.Get(keyer, sliceElemPtr(v.Index(i)))
+	}
+	return me.errOrNil()
+}
+
+func (tx *memTransaction)Put(keyer Keyer, src interface{}) error {
+	if tx.readOnly { return ErrReadOnlyTransaction }
+	k := tx.p.unpackKeyer(keyer)
+	if k == nil {
+		return ErrInvalidKey // Catch it now, rather than when the commit tries to write it
+	}
+	props,err := memSave(src)
+	if err != nil {
+		return err
+	}
+	tx.writes = append(tx.writes, memWrite{k, props})
+	return nil
+}
+
+func (tx *memTransaction)PutMulti(keyers []Keyer, src interface{}) error {
+	v,err := sliceArg("PutMulti", src, len(keyers))
+	if err != nil { return err }
+
+	for i,keyer := range keyers {
+		if err := tx.Put(keyer, sliceElemPtr(v.Index(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memTransaction)Delete(keyer Keyer) error {
+	if tx.readOnly { return ErrReadOnlyTransaction }
+	k,err := tx.p.completeKeyOrErr(keyer)
+	if err != nil {
+		return err
+	}
+	tx.writes = append(tx.writes, memWrite{k, nil})
+	return nil
+}
+
+func (tx *memTransaction)DeleteMulti(keyers []Keyer) error {
+	for _,keyer := range keyers {
+		if err := tx.Delete(keyer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mutate checks the preconditions against what the transaction can see (including its own
+// earlier writes), and counts them as reads; so if someone else changes things before we
+// commit, the commit will fail.
+func (tx *memTransaction)Mutate(muts ...Mutation) error {
+	if tx.readOnly { return ErrReadOnlyTransaction }
+	keys,props,err := tx.p.memPrepareMutations(muts)
+	if err != nil {
+		return err
+	}
+
+	err = checkMutations(muts, keys, func(encoded string) bool {
+		for i:=len(tx.writes)-1; i>=0; i-- {
+			if tx.writes[i].key.Encode() == encoded {
+				return tx.writes[i].props != nil
+			}
+		}
+		tx.p.mu.Lock()
+		defer tx.p.mu.Unlock()
+		_,exists := tx.p.entities[encoded]
+		if _,seen := tx.reads[encoded]; !seen {
+			tx.reads[encoded] = tx.p.versions[encoded]
+		}
+		return exists
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range muts {
+		tx.writes = append(tx.writes, memWrite{keys[i], props[i]})
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ Keys
+
+func (p *MemoryProvider)NewIncompleteKey(ctx context.Context, kind string, root Keyer) Keyer {
+	key := datastore.IncompleteKey(kind, p.unpackKeyer(root))
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
+}
+func (p *MemoryProvider)NewNameKey(ctx context.Context, kind, name string, root Keyer) Keyer {
+	key := datastore.NameKey(kind, name, p.unpackKeyer(root))
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
+}
+func (p *MemoryProvider)NewIDKey(ctx context.Context, kind string, id int64, root Keyer) Keyer {
+	key := datastore.IDKey(kind, id, p.unpackKeyer(root))
+	return Keyer(newKeyNamespace(ctx, key, p.Namespace))
+}
+
+// AllocateIDs hands out IDs from the same sequence used to complete keys on Put.
+func (p *MemoryProvider)AllocateIDs(ctx context.Context, keyers []Keyer) ([]Keyer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := []Keyer{}
+	for _,keyer := range keyers {
+		k := p.unpackKeyer(keyer)
+		if k == nil || !k.Incomplete() {
+			return nil, fmt.Errorf("AllocateIDs{memory}: key %v is not incomplete", k)
+		}
+		out = append(out, Keyer(p.completeKey(k)))
+	}
+	return out, nil
+}
+
+// ReserveIDs moves the ID sequence past the reserved IDs. (The real datastore doesn't hand
+// out IDs in sequence, but nor will it hand out a reserved one.)
+func (p *MemoryProvider)ReserveIDs(ctx context.Context, keyers []Keyer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _,keyer := range keyers {
+		if k := p.unpackKeyer(keyer); k == nil || k.ID == 0 {
+			return fmt.Errorf("ReserveIDs{memory}: key %v does not have an ID", k)
+		}
+	}
+	for _,keyer := range keyers {
+		if id := p.unpackKeyer(keyer).ID; id > p.lastID {
+			p.lastID = id
+		}
+	}
+	return nil
+}
+
+func (p *MemoryProvider)DecodeKey(encoded string) (Keyer, error) {
+	key, err := datastore.DecodeKey(encoded)
+	return Keyer(key), err
+}
+func (p *MemoryProvider)KeyParent(in Keyer) Keyer {
+	if parentKey := p.unpackKeyer(in).Parent; parentKey != nil {
+		return Keyer(parentKey)
+	}
+	return nil
+}
+func (p *MemoryProvider)KeyName(in Keyer) string { return p.unpackKeyer(in).Name }
+func (p *MemoryProvider)KeyKind(in Keyer) string { return keyKind(in) }
+func (p *MemoryProvider)KeyID(in Keyer) int64 { return keyID(in) }
+func (p *MemoryProvider)KeyNamespace(in Keyer) string { return keyNamespace(in) }
+func (p *MemoryProvider)KeyPath(in Keyer) []PathElement { return keyPath(in) }
+func (p *MemoryProvider)KeyEqual(a, b Keyer) bool { return keyEqual(a, b) }
+
+// }}}
+// {{{ HTTPClient, logging
+
+func (p *MemoryProvider)HTTPClient(ctx context.Context) *http.Client {
+	c := http.Client{}
+	return &c
+}
+
+// SetLogHandler sends the provider's log records to h, instead of to stderr as text.
+func (p *MemoryProvider)SetLogHandler(h slog.Handler) {
+	p.providerLogger = newProviderLogger(h, p.level.Level())
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
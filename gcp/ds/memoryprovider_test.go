@@ -0,0 +1,778 @@
+package ds
+
+// go test -v github.com/skypies/util/gcp/ds
+
+import(
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type Foo struct {
+	S    string
+	I    int
+	T    time.Time
+	Tags []string
+}
+
+type Bar struct {
+	S    string
+}
+
+var ctx = context.Background()
+
+var t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Populates a provider with five Foos, all children of a single root, and a Bar.
+func newTestProvider(t *testing.T) (DatastoreProvider, Keyer) {
+	p := NewMemoryProvider()
+
+	root := p.NewNameKey(ctx, "Root", "root", nil)
+	keyers := []Keyer{}
+	foos := []Foo{}
+	for i:=0; i<5; i++ {
+		keyers = append(keyers, p.NewIDKey(ctx, "Foo", int64(100+i), root))
+		foos = append(foos, Foo{S:"foo", I:i, T:t0.Add(time.Duration(i)*time.Hour), Tags:[]string{"all"}})
+	}
+	foos[3].S = "bar"
+	foos[4].Tags = append(foos[4].Tags, "last")
+
+	if _,err := p.PutMulti(ctx, keyers, foos); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if _,err := p.Put(ctx, p.NewNameKey(ctx, "Bar", "bar1", nil), &Bar{S:"foo"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	return p, root
+}
+
+func TestMemoryGetPutDelete(t *testing.T) {
+	p := NewMemoryProvider()
+
+	k := p.NewNameKey(ctx, "Foo", "foo1", nil)
+	foo := Foo{}
+	if err := p.Get(ctx, k, &foo); err != ErrNoSuchEntity {
+		t.Errorf("Get noexist, expected ErrNoSuchEntity, got: %v", err)
+	}
+
+	if _,err := p.Put(ctx, k, &Foo{S:"hello", I:7}); err != nil {
+		t.Errorf("Put, err: %v", err)
+	}
+	if err := p.Get(ctx, k, &foo); err != nil {
+		t.Errorf("Get, err: %v", err)
+	} else if foo.S != "hello" || foo.I != 7 {
+		t.Errorf("Get, bad result: %+v", foo)
+	}
+
+	bar := Bar{}
+	if err := p.Get(ctx, k, &bar); err != ErrFieldMismatch {
+		t.Errorf("Get into wrong type, expected ErrFieldMismatch, got: %v", err)
+	} else if bar.S != "hello" {
+		t.Errorf("Get into wrong type, matching fields not loaded: %+v", bar)
+	}
+
+	if err := p.Delete(ctx, k); err != nil {
+		t.Errorf("Delete, err: %v", err)
+	}
+	if err := p.Get(ctx, k, &foo); err != ErrNoSuchEntity {
+		t.Errorf("Get after delete, expected ErrNoSuchEntity, got: %v", err)
+	}
+}
+
+func TestMemoryKeys(t *testing.T) {
+	p := NewMemoryProvider()
+
+	root := p.NewNameKey(ctx, "Root", "root", nil)
+	k1,err := p.Put(ctx, p.NewIncompleteKey(ctx, "Foo", root), &Foo{S:"a"})
+	if err != nil {
+		t.Fatalf("Put incomplete, err: %v", err)
+	}
+	k2,_ := p.Put(ctx, p.NewIncompleteKey(ctx, "Foo", root), &Foo{S:"b"})
+	if k1.Encode() == k2.Encode() {
+		t.Errorf("incomplete keys were completed identically: %v", k1)
+	}
+
+	decoded,err := p.DecodeKey(k1.Encode())
+	if err != nil {
+		t.Fatalf("DecodeKey, err: %v", err)
+	}
+	foo := Foo{}
+	if err := p.Get(ctx, decoded, &foo); err != nil || foo.S != "a" {
+		t.Errorf("Get via decoded key, err: %v, foo: %+v", err, foo)
+	}
+	if parent := p.KeyParent(decoded); parent == nil || p.KeyName(parent) != "root" {
+		t.Errorf("KeyParent, got %v", parent)
+	}
+}
+
+func TestMemoryGetMulti(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	keyers := []Keyer{
+		p.NewIDKey(ctx, "Foo", 104, root),
+		p.NewIDKey(ctx, "Foo", 100, root),
+	}
+	foos := make([]*Foo, 2)
+	if err := p.GetMulti(ctx, keyers, foos); err != nil {
+		t.Fatalf("GetMulti, err: %v", err)
+	}
+	if foos[0].I != 4 || foos[1].I != 0 {
+		t.Errorf("GetMulti, results out of order: %+v, %+v", foos[0], foos[1])
+	}
+
+	keyers = append(keyers, p.NewIDKey(ctx, "Foo", 999, root))
+	foos2 := make([]Foo, 3)
+	err := p.GetMulti(ctx, keyers, foos2)
+	if me,ok := err.(MultiError); !ok {
+		t.Errorf("GetMulti with missing key, expected MultiError, got: %v", err)
+	} else if me[0] != nil || me[1] != nil || me[2] != ErrNoSuchEntity {
+		t.Errorf("GetMulti with missing key, bad MultiError: %#v", me)
+	} else if foos2[0].I != 4 || foos2[1].I != 0 {
+		t.Errorf("GetMulti with missing key, found entities not loaded: %+v", foos2)
+	}
+}
+
+func TestMemoryQueries(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	tests := []struct {
+		Q    *Query
+		Exp  []int  // The .I values of the expected results, in order
+	}{
+		{NewQuery("Foo"), []int{0,1,2,3,4}},
+		{NewQuery("Foo").Filter("S =", "foo"), []int{0,1,2,4}},
+		{NewQuery("Foo").Filter("S", "bar"), []int{3}},
+		{NewQuery("Foo").Filter("I >", 1).Filter("I <=", 3), []int{2,3}},
+		{NewQuery("Foo").Filter("I !=", 2), []int{0,1,3,4}},
+		{NewQuery("Foo").Filter("I in", []int{1,3,9}), []int{1,3}},
+		{NewQuery("Foo").Filter("I not-in", []int{1,3}), []int{0,2,4}},
+		{NewQuery("Foo").Filter("T >=", t0.Add(3*time.Hour)), []int{3,4}},
+		{NewQuery("Foo").Filter("Tags =", "last"), []int{4}},
+		{NewQuery("Foo").Order("-I"), []int{4,3,2,1,0}},
+		{NewQuery("Foo").Order("S").Limit(2), []int{3,0}},
+		{NewQuery("Foo").Order("S").Order("-I"), []int{3,4,2,1,0}},
+		{NewQuery("Foo").OrderDesc("S").OrderAsc("T").Limit(2), []int{0,1}},
+		{NewQuery("Foo").Ancestor(root).Order("-T").Limit(1), []int{4}},
+		{NewQuery("Foo").Ancestor(p.NewNameKey(ctx, "Root", "other", nil)), []int{}},
+		{NewQuery("Foo").Filter("Nope =", 1), []int{}},
+		{&Query{Kind:"Foo", OrderStr:"-I"}, []int{4,3,2,1,0}}, // Deprecated, but still honoured
+	}
+
+	for i,test := range tests {
+		foos := []Foo{}
+		keyers,err := p.GetAll(ctx, test.Q, &foos)
+		if err != nil {
+			t.Errorf("[%d] GetAll, err: %v", i, err)
+			continue
+		}
+		if len(keyers) != len(foos) || len(foos) != len(test.Exp) {
+			t.Errorf("[%d] expected %d results, got %d (%d keys)\n%s", i, len(test.Exp), len(foos),
+				len(keyers), test.Q)
+			continue
+		}
+		for j,foo := range foos {
+			if foo.I != test.Exp[j] {
+				t.Errorf("[%d] result %d: expected I=%d, got %d\n%s", i, j, test.Exp[j], foo.I, test.Q)
+			}
+		}
+	}
+}
+
+func TestMemoryQueryModifiers(t *testing.T) {
+	p,_ := newTestProvider(t)
+
+	keyers,err := p.GetAll(ctx, NewQuery("Foo").KeysOnly(), nil)
+	if err != nil || len(keyers) != 5 {
+		t.Errorf("KeysOnly, expected 5 keys, got %d (err: %v)", len(keyers), err)
+	}
+
+	foos := []Foo{}
+	if _,err := p.GetAll(ctx, NewQuery("Foo").Project("S").Distinct().Order("S"), &foos); err != nil {
+		t.Errorf("Project/Distinct, err: %v", err)
+	} else if len(foos) != 2 || foos[0].S != "bar" || foos[1].S != "foo" || foos[1].I != 0 {
+		t.Errorf("Project/Distinct, bad results: %+v", foos)
+	}
+
+	bars := []*Bar{}
+	if _,err := p.GetAll(ctx, NewQuery("Foo"), &bars); err != ErrFieldMismatch {
+		t.Errorf("GetAll into wrong type, expected ErrFieldMismatch, got %v", err)
+	} else if len(bars) != 5 {
+		t.Errorf("GetAll into wrong type, expected 5 partial results, got %d", len(bars))
+	}
+}
+
+func TestMemoryIterator(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	it := NewIterator(ctx, p, NewQuery("Foo").Ancestor(root).Order("I"), Foo{})
+	it.PageSize = 2
+	n := 0
+	for it.Iterate(ctx) {
+		foo := Foo{}
+		it.Val(&foo)
+		if foo.I != n {
+			t.Errorf("iterator result %d had I=%d", n, foo.I)
+		}
+		n++
+	}
+	if it.Err() != nil {
+		t.Errorf("iterator err: %v", it.Err())
+	} else if n != 5 {
+		t.Errorf("iterator returned %d results, expected 5", n)
+	}
+}
+
+func TestMemoryIteratorSkipsDeleted(t *testing.T) {
+	p,root := newTestProvider(t)
+
+	it := NewIterator(ctx, p, NewQuery("Foo").Order("I"), Foo{})
+	it.PageSize = 2
+	p.DeleteMulti(ctx, []Keyer{
+		p.NewIDKey(ctx, "Foo", 100, root),
+		p.NewIDKey(ctx, "Foo", 101, root),
+		p.NewIDKey(ctx, "Foo", 103, root),
+	})
+
+	got := []int{}
+	for it.Iterate(ctx) {
+		foo := Foo{}
+		it.Val(&foo)
+		got = append(got, foo.I)
+	}
+	if it.Err() != nil {
+		t.Errorf("iterator err: %v", it.Err())
+	} else if fmt.Sprintf("%v", got) != "[2 4]" {
+		t.Errorf("iterator, expected [2 4], got %v", got)
+	}
+}
+
+func TestMemoryTransactions(t *testing.T) {
+	p := NewMemoryProvider()
+	k := p.NewNameKey(ctx, "Foo", "counter", nil)
+
+	increment := func(tx Transaction) error {
+		foo := Foo{}
+		if err := tx.Get(k, &foo); err != nil && err != ErrNoSuchEntity {
+			return err
+		}
+		foo.I++
+		return tx.Put(k, &foo)
+	}
+	for i:=0; i<3; i++ {
+		if err := p.RunInTransaction(ctx, increment, nil); err != nil {
+			t.Fatalf("RunInTransaction, err: %v", err)
+		}
+	}
+	foo := Foo{}
+	if err := p.Get(ctx, k, &foo); err != nil || foo.I != 3 {
+		t.Errorf("after 3 increments, err: %v, foo: %+v", err, foo)
+	}
+
+	// Sneak in a non-transactional write during the first attempt; it should be retried.
+	attempts := 0
+	err := p.RunInTransaction(ctx, func(tx Transaction) error {
+		attempts++
+		if err := increment(tx); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			_,err := p.Put(ctx, k, &Foo{I:100})
+			return err
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Errorf("RunInTransaction with contention, err: %v", err)
+	} else if attempts != 2 {
+		t.Errorf("RunInTransaction with contention, expected 2 attempts, got %d", attempts)
+	} else if p.Get(ctx, k, &foo); foo.I != 101 {
+		t.Errorf("RunInTransaction with contention, expected 101, got %d", foo.I)
+	}
+
+	// Contention on every attempt
+	attempts = 0
+	err = p.RunInTransaction(ctx, func(tx Transaction) error {
+		attempts++
+		if err := increment(tx); err != nil {
+			return err
+		}
+		_,err := p.Put(ctx, k, &Foo{I:0})
+		return err
+	}, &TransactionOptions{MaxAttempts:2})
+	if err != ErrConcurrentTransaction || attempts != 2 {
+		t.Errorf("RunInTransaction, expected ErrConcurrentTransaction after 2 attempts, got %v/%d",
+			err, attempts)
+	}
+
+	err = p.RunInTransaction(ctx, increment, &TransactionOptions{ReadOnly:true})
+	if err != ErrReadOnlyTransaction {
+		t.Errorf("RunInTransaction, expected ErrReadOnlyTransaction, got %v", err)
+	}
+
+	// Nil keys are caught by Put, not by the commit
+	var nilKey *datastore.Key
+	err = p.RunInTransaction(ctx, func(tx Transaction) error {
+		if err := tx.Put(nilKey, &Foo{}); err != ErrInvalidKey {
+			t.Errorf("transaction Put, expected ErrInvalidKey, got %v", err)
+		}
+		return tx.PutMulti([]Keyer{k, nil}, []Foo{{}, {}})
+	}, nil)
+	if err != ErrInvalidKey {
+		t.Errorf("transaction PutMulti, expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestMemoryCursors(t *testing.T) {
+	p,_ := newTestProvider(t)
+
+	q := NewQuery("Foo").Order("-I").Limit(2)
+	it := p.Run(ctx, q)
+	foo := Foo{}
+	if _,err := it.Next(&foo); err != nil || foo.I != 4 {
+		t.Fatalf("Run, first result, err: %v, foo: %+v", err, foo)
+	}
+	it.Next(&foo)
+	if _,err := it.Next(&foo); err != ErrDone {
+		t.Errorf("Run, expected ErrDone after limit, got: %v", err)
+	}
+	c,err := it.Cursor()
+	if err != nil {
+		t.Fatalf("Cursor, err: %v", err)
+	}
+
+	// Writes behind the cursor shouldn't affect the resumed query
+	p.Put(ctx, p.NewNameKey(ctx, "Foo", "new", nil), &Foo{I:10})
+
+	foos := []Foo{}
+	if _,err := p.GetAll(ctx, NewQuery("Foo").Order("-I").Start(c), &foos); err != nil {
+		t.Errorf("GetAll from cursor, err: %v", err)
+	} else if len(foos) != 3 || foos[0].I != 2 {
+		t.Errorf("GetAll from cursor, bad results: %+v", foos)
+	}
+
+	foos = []Foo{}
+	if _,err := p.GetAll(ctx, NewQuery("Foo").Order("-I").End(c).Offset(1), &foos); err != nil {
+		t.Errorf("GetAll with end cursor & offset, err: %v", err)
+	} else if len(foos) != 2 || foos[0].I != 4 || foos[1].I != 3 {
+		t.Errorf("GetAll with end cursor & offset, bad results: %+v", foos)
+	}
+
+	// Cursors hold their own position, so another provider with the same data can use them
+	p2,_ := newTestProvider(t)
+	foos = []Foo{}
+	if _,err := p2.GetAll(ctx, NewQuery("Foo").Order("-I").Start(c), &foos); err != nil {
+		t.Errorf("GetAll from cursor on another provider, err: %v", err)
+	} else if len(foos) != 3 || foos[0].I != 2 {
+		t.Errorf("GetAll from cursor on another provider, bad results: %+v", foos)
+	}
+	if _,err := p.GetAll(ctx, NewQuery("Foo").Start("garbage!"), nil); err == nil {
+		t.Errorf("GetAll with bad cursor, expected an error")
+	}
+
+	// Cursors on a time ordering have to carry a time.Time around
+	it = p2.Run(ctx, NewQuery("Foo").Order("T").Limit(2))
+	for {
+		if _,err := it.Next(&foo); err == ErrDone {
+			break
+		} else if err != nil {
+			t.Fatalf("Run ordered by time, err: %v", err)
+		}
+	}
+	if c,err = it.Cursor(); err != nil {
+		t.Fatalf("Cursor on time order, err: %v", err)
+	}
+	foos = []Foo{}
+	if _,err := p2.GetAll(ctx, NewQuery("Foo").Order("T").Start(c), &foos); err != nil {
+		t.Errorf("GetAll from time cursor, err: %v", err)
+	} else if len(foos) != 3 || !foos[0].T.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("GetAll from time cursor, bad results: %+v", foos)
+	}
+}
+
+func TestMemoryInvalidKeys(t *testing.T) {
+	p,_ := newTestProvider(t)
+	incomplete := p.NewIncompleteKey(ctx, "Foo", nil)
+
+	for _,k := range []Keyer{nil, incomplete} {
+		if err := p.Get(ctx, k, &Foo{}); err != ErrInvalidKey {
+			t.Errorf("Get(%v), expected ErrInvalidKey, got %v", k, err)
+		}
+		if err := p.Delete(ctx, k); err != ErrInvalidKey {
+			t.Errorf("Delete(%v), expected ErrInvalidKey, got %v", k, err)
+		}
+	}
+	err := p.GetMulti(ctx, []Keyer{incomplete, nil}, make([]Foo, 2))
+	if me,ok := err.(MultiError); !ok || me[0] != ErrInvalidKey || me[1] != ErrInvalidKey {
+		t.Errorf("GetMulti, expected ErrInvalidKey for each key, got %v", err)
+	}
+	err = p.RunInTransaction(ctx, func(tx Transaction) error { return tx.Get(incomplete, &Foo{}) }, nil)
+	if err != ErrInvalidKey {
+		t.Errorf("transaction Get, expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestMemoryStreamingIterator(t *testing.T) {
+	p := NewMemoryProvider()
+	for i:=0; i<25; i++ {
+		p.Put(ctx, p.NewIDKey(ctx, "Foo", int64(i+1), nil), &Foo{I:i})
+	}
+
+	// Process the first 12, checkpoint, then resume with a fresh iterator.
+	q := NewQuery("Foo").Order("I")
+	it := NewStreamingIterator(ctx, p, q, Foo{})
+	seen := []int{}
+	for it.Iterate(ctx) {
+		foo := Foo{}
+		it.Val(&foo)
+		seen = append(seen, foo.I)
+		if len(seen) == 12 { break }
+	}
+	c,err := it.Cursor()
+	if err != nil {
+		t.Fatalf("Cursor, err: %v", err)
+	}
+
+	it = NewStreamingIterator(ctx, p, q.Start(c), &Foo{})
+	it.PageSize = 4
+	for it.Iterate(ctx) {
+		foo := &Foo{}
+		it.Val(&foo)
+		seen = append(seen, foo.I)
+	}
+	if it.Err() != nil {
+		t.Errorf("iterator err: %v", it.Err())
+	}
+	for i := range seen {
+		if seen[i] != i {
+			t.Fatalf("streaming iterator, bad results: %v", seen)
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("streaming iterator, expected 25 results, got %v", seen)
+	}
+
+	n := 0
+	for it = NewStreamingIterator(ctx, p, NewQuery("Foo").Limit(7), Foo{}); it.Iterate(ctx); n++ {}
+	if n != 7 {
+		t.Errorf("streaming iterator with limit, expected 7 results, got %d", n)
+	}
+}
+
+func TestMemoryPrefetchingIterator(t *testing.T) {
+	p := NewMemoryProvider()
+	for i:=0; i<53; i++ {
+		p.Put(ctx, p.NewIDKey(ctx, "Foo", int64(i+1), nil), &Foo{I:i})
+	}
+	p.Delete(ctx, p.NewIDKey(ctx, "Foo", 21, nil))
+
+	for _,streaming := range []bool{false, true} {
+		var it *Iterator
+		if streaming {
+			it = NewStreamingIterator(ctx, p, NewQuery("Foo").Order("I"), Foo{})
+		} else {
+			it = NewIterator(ctx, p, NewQuery("Foo").Order("I"), Foo{})
+			p.Delete(ctx, p.NewIDKey(ctx, "Foo", 31, nil)) // Should get skipped
+		}
+		it.PageSize = 4
+		it.Prefetch = 3
+
+		seen := []int{}
+		for it.Iterate(ctx) {
+			foo := Foo{}
+			it.Val(&foo)
+			seen = append(seen, foo.I)
+		}
+		it.Close()
+		if it.Err() != nil {
+			t.Errorf("prefetch(streaming=%v) err: %v", streaming, it.Err())
+		} else if len(seen) != 51 || seen[0] != 0 || seen[50] != 52 {
+			t.Errorf("prefetch(streaming=%v), bad results: %v", streaming, seen)
+		}
+		for i:=1; i<len(seen); i++ {
+			if seen[i] <= seen[i-1] {
+				t.Fatalf("prefetch(streaming=%v), out of order: %v", streaming, seen)
+			}
+		}
+	}
+
+	// Bail out early; Close should stop the prefetchers, and the iterator.
+	it := NewIterator(ctx, p, NewQuery("Foo"), Foo{})
+	it.PageSize = 2
+	it.Prefetch = 2
+	if !it.Iterate(ctx) {
+		t.Fatalf("prefetch, no first result: %v", it.Err())
+	}
+	it.Close()
+	it.Close()
+	if it.Iterate(ctx) {
+		t.Errorf("prefetch, iterator still returning results after Close")
+	}
+
+	// Abandon one without closing it; cancelling its context should stop the prefetchers.
+	before := runtime.NumGoroutine()
+	actx,abandon := context.WithCancel(ctx)
+	func() {
+		it := NewIterator(actx, p, NewQuery("Foo"), Foo{})
+		it.PageSize = 2
+		it.Prefetch = 2
+		it.Iterate(actx)
+	}()
+	abandon()
+	for i:=0; i<100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("prefetch, abandoned iterator left %d goroutines running", n-before)
+	}
+
+	// An Iterator embedded by value should work just the same.
+	wrapped := struct {
+		Name string
+		Iterator
+	}{Name:"wrapped", Iterator:*NewIterator(ctx, p, NewQuery("Foo"), Foo{})}
+	wrapped.PageSize = 2
+	wrapped.Prefetch = 2
+	n := 0
+	for wrapped.Iterate(ctx) { n++ }
+	if n != 51 || wrapped.Err() != nil {
+		t.Errorf("prefetch, embedded iterator: %d results, err %v", n, wrapped.Err())
+	}
+
+	// A cancelled context should surface as an error.
+	cctx,cancel := context.WithCancel(ctx)
+	it = NewIterator(cctx, p, NewQuery("Foo"), Foo{})
+	it.PageSize = 2
+	it.Prefetch = 1
+	defer it.Close()
+	it.Iterate(cctx)
+	cancel()
+	for it.Iterate(cctx) {}
+	if it.Err() == nil {
+		t.Errorf("prefetch, expected error from cancelled context")
+	}
+}
+
+func TestMemoryNamespaces(t *testing.T) {
+	p := NewMemoryProvider()
+	p.Namespace = "prod"
+	nsCtx := SetProviderInNamespace(ctx, p, "staging")
+
+	root := p.NewNameKey(nsCtx, "Root", "root", nil)
+	keys := []Keyer{
+		p.NewNameKey(ctx, "Foo", "foo", nil),                     // prod
+		p.NewNameKey(nsCtx, "Foo", "foo", nil),                   // staging
+		p.NewNameKey(ctx, "Foo", "foo2", root),                   // staging, via the parent
+		InNamespace(p.NewNameKey(ctx, "Foo", "foo", nil), ""),    // default
+	}
+	for i,k := range keys {
+		if _,err := p.Put(ctx, k, &Foo{I:i}); err != nil {
+			t.Fatalf("Put(%v): %v", k, err)
+		}
+	}
+	if ns,_ := GetNamespace(nsCtx); ns != "staging" || GetProviderOrPanic(nsCtx) != p {
+		t.Errorf("context plumbing, got ns=%q", ns)
+	}
+
+	tests := []struct {
+		ctx  context.Context
+		q   *Query
+		exp  string
+	}{
+		{ctx,   NewQuery("Foo"),                  "[0]"},
+		{nsCtx, NewQuery("Foo"),                  "[1 2]"},
+		{ctx,   NewQuery("Foo").Ancestor(root),   "[2]"},
+		{nsCtx, NewQuery("Foo").Namespace(""),    "[3]"},
+		{ctx,   NewQuery("Foo").Namespace("nope"), "[]"},
+	}
+	for i,test := range tests {
+		foos := []Foo{}
+		if _,err := p.GetAll(test.ctx, test.q.Order("I"), &foos); err != nil {
+			t.Errorf("[%d] GetAll: %v", i, err)
+			continue
+		}
+		got := []int{}
+		for _,foo := range foos { got = append(got, foo.I) }
+		if fmt.Sprintf("%v", got) != test.exp {
+			t.Errorf("[%d] %s: expected %s, got %v", i, test.q, test.exp, got)
+		}
+	}
+
+	foo := Foo{}
+	if err := p.Get(ctx, InNamespace(keys[0], "staging"), &foo); err != nil || foo.I != 1 {
+		t.Errorf("Get via InNamespace, got %v, %+v", err, foo)
+	}
+}
+
+func TestMemoryAllocateIDs(t *testing.T) {
+	p := NewMemoryProvider()
+
+	if err := p.ReserveIDs(ctx, []Keyer{p.NewIDKey(ctx, "Flight", 1000, nil)}); err != nil {
+		t.Fatalf("ReserveIDs: %v", err)
+	} else if err := p.ReserveIDs(ctx, []Keyer{p.NewNameKey(ctx, "Flight", "f", nil)}); err == nil {
+		t.Errorf("ReserveIDs on a name key should have failed")
+	}
+
+	keyers,err := p.AllocateIDs(ctx, []Keyer{p.NewIncompleteKey(ctx, "Flight", nil)})
+	if err != nil {
+		t.Fatalf("AllocateIDs: %v", err)
+	}
+	flight := keyers[0]
+	if p.KeyID(flight) <= 1000 {
+		t.Errorf("AllocateIDs handed out a reserved ID: %v", flight)
+	}
+
+	// Build the child keys before anything is written
+	frags,err := p.AllocateIDs(ctx, []Keyer{
+		p.NewIncompleteKey(ctx, "Frag", flight),
+		p.NewIncompleteKey(ctx, "Frag", flight),
+	})
+	if err != nil {
+		t.Fatalf("AllocateIDs: %v", err)
+	} else if p.KeyEqual(frags[0], frags[1]) || !p.KeyEqual(p.KeyParent(frags[1]), flight) {
+		t.Errorf("AllocateIDs, bad child keys: %v", frags)
+	}
+	if _,err := p.PutMulti(ctx, append(frags, flight), []Bar{{"a"}, {"b"}, {"flight"}}); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if n,_ := p.Count(ctx, NewQuery("Frag").Ancestor(flight)); n != 2 {
+		t.Errorf("expected 2 frags under the flight, got %d", n)
+	}
+
+	if _,err := p.AllocateIDs(ctx, []Keyer{flight}); err == nil {
+		t.Errorf("AllocateIDs on a complete key should have failed")
+	}
+}
+
+func TestMemoryMutate(t *testing.T) {
+	p,root := newTestProvider(t)
+	foo0 := p.NewIDKey(ctx, "Foo", 100, root)
+	foo1 := p.NewIDKey(ctx, "Foo", 101, root)
+	newFoo := p.NewNameKey(ctx, "Foo", "new", nil)
+
+	keyers,err := p.Mutate(ctx,
+		NewInsert(p.NewIncompleteKey(ctx, "Bar", nil), &Bar{S:"inserted"}),
+		NewInsert(newFoo, &Foo{I:10}),
+		NewUpdate(foo0, &Foo{I:11}),
+		NewUpsert(p.NewNameKey(ctx, "Bar", "bar1", nil), &Bar{S:"upserted"}),
+		NewDelete(foo1))
+	if err != nil {
+		t.Fatalf("Mutate: %v", err)
+	} else if len(keyers) != 5 || p.KeyID(keyers[0]) == 0 || !p.KeyEqual(keyers[4], foo1) {
+		t.Errorf("Mutate, bad keys: %v", keyers)
+	}
+	if n,_ := p.Count(ctx, NewQuery("Bar")); n != 2 {
+		t.Errorf("Mutate, expected 2 Bars, got %d", n)
+	}
+	foo := Foo{}
+	if err := p.Get(ctx, foo1, &foo); err != ErrNoSuchEntity {
+		t.Errorf("Mutate, delete didn't happen: %v", err)
+	} else if p.Get(ctx, foo0, &foo); foo.I != 11 {
+		t.Errorf("Mutate, update didn't happen: %+v", foo)
+	}
+
+	// Preconditions; nothing should get written if any fail.
+	_,err = p.Mutate(ctx,
+		NewUpsert(foo0, &Foo{I:12}),
+		NewInsert(newFoo, &Foo{}),
+		NewUpdate(foo1, &Foo{}))
+	me,isMulti := err.(MultiError)
+	if !isMulti || len(me) != 3 || me[0] != nil || me[1] != ErrEntityExists || me[2] != ErrNoSuchEntity {
+		t.Fatalf("Mutate, bad preconditions err: %v", err)
+	}
+	if p.Get(ctx, foo0, &foo); foo.I != 11 {
+		t.Errorf("Mutate wasn't all-or-nothing: %+v", foo)
+	}
+	if _,err := p.Mutate(ctx, NewDelete(p.NewIncompleteKey(ctx, "Foo", nil))); err == nil {
+		t.Errorf("Mutate, delete with an incomplete key should have failed")
+	}
+	var nilKey *datastore.Key
+	_,err = p.Mutate(ctx, NewUpsert(foo0, &Foo{I:12}), NewUpsert(nilKey, &Foo{}), NewDelete(Key{}))
+	if me,isMulti := err.(MultiError); !isMulti || me[0] != nil || me[1] != ErrInvalidKey || me[2] != ErrInvalidKey {
+		t.Errorf("Mutate, expected ErrInvalidKey for the nil keys, got %v", err)
+	}
+
+	// Later mutations see the effects of earlier ones.
+	if _,err := p.Mutate(ctx, NewDelete(newFoo), NewInsert(newFoo, &Foo{I:20}), NewUpdate(newFoo, &Foo{I:21})); err != nil {
+		t.Errorf("Mutate, sequence on one key: %v", err)
+	}
+
+	// In a transaction
+	err = p.RunInTransaction(ctx, func(tx Transaction) error {
+		if err := tx.Mutate(NewInsert(foo1, &Foo{I:30}), NewUpdate(foo1, &Foo{I:31})); err != nil {
+			return err
+		}
+		return tx.Mutate(NewInsert(foo1, &Foo{})) // Sees the transaction's own insert
+	}, nil)
+	if me,isMulti := err.(MultiError); !isMulti || me[0] != ErrEntityExists {
+		t.Errorf("transaction Mutate, expected ErrEntityExists, got %v", err)
+	}
+	err = p.RunInTransaction(ctx, func(tx Transaction) error {
+		return tx.Mutate(NewInsert(foo1, &Foo{I:30}), NewUpdate(foo1, &Foo{I:31}))
+	}, nil)
+	if err != nil {
+		t.Errorf("transaction Mutate: %v", err)
+	} else if p.Get(ctx, foo1, &foo); foo.I != 31 {
+		t.Errorf("transaction Mutate, bad result: %+v", foo)
+	}
+}
+
+func TestMemoryCompositeFilters(t *testing.T) {
+	p,_ := newTestProvider(t)
+
+	tests := []struct {
+		F    EntityFilter
+		Exp  []int
+	}{
+		{Ge("I", 3), []int{3,4}},
+		{Or(Eq("I", 0), Eq("S", "bar")), []int{0,3}},
+		{Or(Lt("I", 1), And(Gt("I", 2), Eq("S", "foo"))), []int{0,4}},
+		{And(Ne("I", 0), NotIn("I", []int64{2,3})), []int{1,4}},
+		{Or(Eq("Nope", 1)), []int{}},
+		{Or(Filter{"I <", 1}, Filter{"I", 4}), []int{0,4}}, // Old style, with the op in the field
+	}
+
+	for i,test := range tests {
+		foos := []Foo{}
+		if _,err := p.GetAll(ctx, NewQuery("Foo").FilterEntity(test.F).Order("I"), &foos); err != nil {
+			t.Errorf("[%d] GetAll, err: %v", i, err)
+			continue
+		}
+		got := []int{}
+		for _,foo := range foos { got = append(got, foo.I) }
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", test.Exp) {
+			t.Errorf("[%d] %s: expected %v, got %v", i, test.F, test.Exp, got)
+		}
+	}
+
+	if _,err := p.GetAll(ctx, NewQuery("Foo").Filter("I ~", 1), nil); err == nil {
+		t.Errorf("GetAll with bad filter, expected an error")
+	}
+	if _,err := p.GetAll(ctx, NewQuery("Foo").FilterEntity(Or()), nil); err == nil {
+		t.Errorf("GetAll with empty OR, expected an error")
+	}
+}
+
+func TestMemoryAggregations(t *testing.T) {
+	p,_ := newTestProvider(t)
+
+	if n,err := p.Count(ctx, NewQuery("Foo").Filter("S =", "foo")); err != nil || n != 4 {
+		t.Errorf("Count, expected 4, got %d (err: %v)", n, err)
+	}
+	if n,err := p.Count(ctx, NewQuery("Nope")); err != nil || n != 0 {
+		t.Errorf("Count of nothing, expected 0, got %d (err: %v)", n, err)
+	}
+
+	res,err := p.Aggregate(ctx, NewQuery("Foo").Filter("I >=", 1),
+		AggregateCount("n"), AggregateSum("I", ""), AggregateAvg("I", "avg"), AggregateAvg("S", "nope"))
+	if err != nil {
+		t.Fatalf("Aggregate, err: %v", err)
+	}
+	if res.Int("n") != 4 || res["sum_I"] != int64(10) || res.Float("avg") != 2.5 || res["nope"] != nil {
+		t.Errorf("Aggregate, bad results: %v", res)
+	}
+}
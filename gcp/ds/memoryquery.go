@@ -0,0 +1,444 @@
+package ds
+
+import(
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// This file evaluates a ds.Query against the entities held in a MemoryProvider. It aims to
+// follow datastore semantics closely enough for tests: entities lacking a filtered or
+// ordered property are not returned, multi-valued properties match if any value matches,
+// and values of different types sort in datastore's type order.
+
+const keyFieldName = "__key__"
+
+// {{{ runQuery
+
+// runQuery must be called with the lock held. It only considers entities in the namespace ns.
+// As well as the results, it returns the last entity skipped over due to an offset, if any.
+func (p *MemoryProvider)runQuery(ns string, q *Query) ([]*memEntity, *memEntity, error) {
+	filters := q.allFilters()
+	for _,ef := range filters {
+		if err := validateFilter(ef); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	results := []*memEntity{}
+	for _,ent := range p.entities {
+		if ent.key.Namespace != ns {
+			continue
+		} else if q.Kind != "" && ent.key.Kind != q.Kind {
+			continue
+		} else if q.AncestorKeyer != nil && !hasAncestor(ent.key, toDatastoreKey(q.AncestorKeyer)) {
+			continue
+		}
+
+		if !ent.matchesAll(filters) {
+			continue
+		}
+
+		results = append(results, ent)
+	}
+
+	orders := q.allOrders()
+	results = sortEntities(results, orders)
+
+	// Cursors are positions in the sort order, so they still work if entities were written
+	// since they were handed out (or if they were handed out by another MemoryProvider).
+	for _,c := range []Cursor{q.StartCursor, q.EndCursor} {
+		if c == "" { continue }
+		pos,err := decodeMemCursor(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad cursor %q: %v", c, err)
+		}
+		kept := []*memEntity{}
+		for _,ent := range results {
+			cmp := compareInOrder(orders, ent, pos)
+			if (c == q.StartCursor && cmp > 0) || (c == q.EndCursor && cmp <= 0) {
+				kept = append(kept, ent)
+			}
+		}
+		results = kept
+	}
+
+	if len(q.ProjectFields) > 0 {
+		results = project(results, q.ProjectFields, q.DistinctVals)
+	}
+
+	var lastSkipped *memEntity
+	if offset := q.OffsetVal; offset > 0 {
+		if offset > len(results) {
+			offset = len(results)
+		}
+		if offset > 0 {
+			lastSkipped = results[offset-1]
+		}
+		results = results[offset:]
+	}
+
+	if q.LimitVal > 0 && len(results) > q.LimitVal {
+		results = results[:q.LimitVal]
+	}
+
+	return results, lastSkipped, nil
+}
+
+func hasAncestor(k, ancestor *datastore.Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(ancestor) { return true }
+	}
+	return false
+}
+
+// }}}
+// {{{ ent.values, ent.matchesAll, ent.matches
+
+// values returns all the values the entity has for the named property; multi-valued
+// properties are flattened. The bool is false if the entity has no such property.
+func (ent *memEntity)values(field string) ([]interface{}, bool) {
+	if field == keyFieldName {
+		return []interface{}{ent.key}, true
+	}
+	for _,prop := range ent.props {
+		if prop.Name != field { continue }
+		if multi,ok := prop.Value.([]interface{}); ok {
+			return multi, len(multi) > 0
+		}
+		return []interface{}{prop.Value}, true
+	}
+	return nil, false
+}
+
+func (ent *memEntity)matchesAll(filters []EntityFilter) bool {
+	for _,ef := range filters {
+		if !ent.matchesFilter(ef) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ent *memEntity)matchesFilter(ef EntityFilter) bool {
+	switch f := ef.(type) {
+	case Filter:
+		return ent.matchesFilter(f.Property())
+	case PropertyFilter:
+		return ent.matches(f.Field, f.Op, normalizeValue(f.Value))
+	case CompositeFilter:
+		if f.Op == CompositeAnd {
+			return ent.matchesAll(f.Filters)
+		}
+		for _,sub := range f.Filters {
+			if ent.matchesFilter(sub) { return true }
+		}
+	}
+	return false
+}
+
+func (ent *memEntity)matches(field string, op Operator, want interface{}) bool {
+	vals,exists := ent.values(field)
+	if !exists {
+		return false
+	}
+
+	switch op {
+	case OpIn, OpNotIn:
+		set := []interface{}{}
+		rv := reflect.ValueOf(want)
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			for i:=0; i<rv.Len(); i++ {
+				set = append(set, normalizeValue(rv.Index(i).Interface()))
+			}
+		}
+		for _,v := range vals {
+			for _,s := range set {
+				if compareValues(v, s) == 0 { return op == OpIn }
+			}
+		}
+		return op == OpNotIn
+	}
+
+	for _,v := range vals {
+		c := compareValues(v, want)
+		switch op {
+		case OpEqual:       if c == 0 { return true }
+		case OpNotEqual:    if c != 0 { return true }
+		case OpLessThan:    if c <  0 { return true }
+		case OpLessEq:      if c <= 0 { return true }
+		case OpGreaterThan: if c >  0 { return true }
+		case OpGreaterEq:   if c >= 0 { return true }
+		}
+	}
+	return false
+}
+
+// }}}
+// {{{ compareInOrder, sortEntities
+
+// compareInOrder returns the relative position of two entities in the ordering. Ties (and
+// unordered queries) are resolved in key order.
+func compareInOrder(orders []Order, a, b *memEntity) int {
+	for _,o := range orders {
+		if c := compareEntities(a, b, o.Field, o.Descending); c != 0 {
+			return c
+		}
+	}
+	return compareKeys(a.key, b.key)
+}
+
+// sortEntities applies the ordering, dropping entities that lack any ordered property.
+func sortEntities(ents []*memEntity, orders []Order) []*memEntity {
+	kept := ents[:0]
+	for _,ent := range ents {
+		hasAll := true
+		for _,o := range orders {
+			if _,exists := ent.values(o.Field); !exists {
+				hasAll = false
+			}
+		}
+		if hasAll {
+			kept = append(kept, ent)
+		}
+	}
+	ents = kept
+
+	sort.SliceStable(ents, func(i, j int) bool {
+		return compareInOrder(orders, ents[i], ents[j]) < 0
+	})
+	return ents
+}
+
+// compareEntities compares on a (possibly multi-valued) property; datastore sorts ascending
+// by the smallest value, and descending by the largest.
+func compareEntities(a, b *memEntity, field string, desc bool) int {
+	pick := func(ent *memEntity) interface{} {
+		vals,_ := ent.values(field)
+		best := vals[0]
+		for _,v := range vals[1:] {
+			if c := compareValues(v, best); (desc && c > 0) || (!desc && c < 0) {
+				best = v
+			}
+		}
+		return best
+	}
+	c := compareValues(pick(a), pick(b))
+	if desc { c = -c }
+	return c
+}
+
+// }}}
+// {{{ project
+
+// project returns copies of the entities holding only the projected fields. Entities that
+// lack any of the fields are dropped. With distinct, only the first entity for each
+// combination of projected values is kept.
+func project(ents []*memEntity, fields []string, distinct bool) []*memEntity {
+	out := []*memEntity{}
+	seen := map[string]bool{}
+	for _,ent := range ents {
+		projected := &memEntity{key: ent.key}
+		sig := ""
+		for _,field := range fields {
+			for _,prop := range ent.props {
+				if prop.Name == field {
+					projected.props = append(projected.props, prop)
+					sig += fmt.Sprintf("%s=%#v;", field, prop.Value)
+					break
+				}
+			}
+		}
+		if len(projected.props) != len(fields) {
+			continue
+		}
+		if distinct {
+			if seen[sig] { continue }
+			seen[sig] = true
+		}
+		out = append(out, projected)
+	}
+	return out
+}
+
+// }}}
+
+// {{{ aggregateField
+
+// aggregateField computes a sum or an average over the numeric values of a field, skipping
+// entities where the field is missing or isn't a number.
+func aggregateField(ents []*memEntity, agg Aggregation) interface{} {
+	var intSum int64
+	var floatSum float64
+	n, allInts := 0, true
+
+	for _,ent := range ents {
+		vals,_ := ent.values(agg.Field)
+		for _,v := range vals {
+			switch val := normalizeValue(v).(type) {
+			case int64:
+				intSum += val
+				floatSum += float64(val)
+				n++
+			case float64:
+				floatSum += val
+				allInts = false
+				n++
+			}
+		}
+	}
+
+	if agg.Type == AggAvg {
+		if n == 0 { return nil }
+		return floatSum / float64(n)
+	} else if allInts {
+		return intSum
+	}
+	return floatSum
+}
+
+// }}}
+// {{{ normalizeValue
+
+// normalizeValue converts the Go types that a caller might use in a filter into the types
+// the datastore library uses for property values.
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case Keyer:
+		return toDatastoreKey(val) // e.g. a ds.Key
+	case time.Time, string, bool, []byte, datastore.GeoPoint:
+		return v
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+	return v
+}
+
+// }}}
+// {{{ compareValues
+
+// typeRank follows datastore's ordering of values of different types.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:                  return 0
+	case int64, time.Time:     return 1
+	case bool:                 return 2
+	case string, []byte:       return 3
+	case float64:              return 4
+	case datastore.GeoPoint:   return 5
+	case *datastore.Key:       return 6
+	}
+	return 7
+}
+
+func compareValues(a, b interface{}) int {
+	a,b = normalizeValue(a), normalizeValue(b)
+	if ra,rb := typeRank(a), typeRank(b); ra != rb {
+		if ra < rb { return -1 }
+		return 1
+	}
+
+	cmpInt := func(x, y int64) int {
+		if x < y { return -1 } else if x > y { return 1 }
+		return 0
+	}
+	cmpFloat := func(x, y float64) int {
+		if x < y { return -1 } else if x > y { return 1 }
+		return 0
+	}
+	asMicros := func(v interface{}) int64 {
+		if t,ok := v.(time.Time); ok { return t.UnixMicro() }
+		return v.(int64)
+	}
+	asBytes := func(v interface{}) []byte {
+		if s,ok := v.(string); ok { return []byte(s) }
+		return v.([]byte)
+	}
+
+	switch av := a.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return cmpInt(asMicros(a), asMicros(b))
+	case bool:
+		bv := b.(bool)
+		if av == bv { return 0 } else if !av { return -1 }
+		return 1
+	case string, []byte:
+		return bytes.Compare(asBytes(a), asBytes(b))
+	case float64:
+		return cmpFloat(av, b.(float64))
+	case datastore.GeoPoint:
+		bv := b.(datastore.GeoPoint)
+		if c := cmpFloat(av.Lat, bv.Lat); c != 0 { return c }
+		return cmpFloat(av.Lng, bv.Lng)
+	case *datastore.Key:
+		return compareKeys(av, b.(*datastore.Key))
+	}
+
+	// Entities and other oddities; fall back to their printed forms.
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// }}}
+// {{{ compareKeys
+
+// compareKeys orders keys by their path from the root; at each element, by kind, and then
+// with IDs before names.
+func compareKeys(a, b *datastore.Key) int {
+	path := func(k *datastore.Key) []*datastore.Key {
+		out := []*datastore.Key{}
+		for ; k != nil; k = k.Parent {
+			out = append([]*datastore.Key{k}, out...)
+		}
+		return out
+	}
+	pa,pb := path(a), path(b)
+
+	for i:=0; i<len(pa) && i<len(pb); i++ {
+		x,y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind, y.Kind); c != 0 {
+			return c
+		}
+		if (x.Name == "") != (y.Name == "") {
+			if x.Name == "" { return -1 }
+			return 1
+		}
+		if x.Name != "" {
+			if c := strings.Compare(x.Name, y.Name); c != 0 { return c }
+		} else if x.ID != y.ID {
+			if x.ID < y.ID { return -1 }
+			return 1
+		}
+	}
+
+	if len(pa) < len(pb) { return -1 } else if len(pa) > len(pb) { return 1 }
+	return 0
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
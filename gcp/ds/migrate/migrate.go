@@ -0,0 +1,519 @@
+package migrate
+
+// This package rewrites every entity of a kind, when its schema changes; e.g. to fix up old
+// entities that would otherwise fail to load with ds.ErrFieldMismatch.
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/skypies/util/gcp/ds"
+	"github.com/skypies/util/singleton"
+)
+
+/*
+
+ func init() {
+   migrate.Register("flight-tags-to-list", "Flight", func(old map[string]interface{}) (map[string]interface{}, error) {
+     str,isOld := old["TagString"].(string)
+     if !isOld {
+       return nil, nil // nil means leave this entity alone
+     }
+     old["Tags"] = strings.Split(str, ",")
+     delete(old, "TagString")
+     return old, nil
+   })
+ }
+
+ r := migrate.NewRunner(p, gcpsingleton.NewProvider(p))
+ r.Budget = 5*time.Minute
+
+ // A dry run reports what would change, without writing anything
+ r.DryRun = true
+ report,err := r.Run(ctx, "flight-tags-to-list")
+ fmt.Print(report)
+
+ // The real thing. If the budget runs out, call it again to pick up where it left off.
+ r.DryRun = false
+ for report,err := r.Run(ctx, "flight-tags-to-list"); err == nil && !report.Done; {
+   report,err = r.Run(ctx, "flight-tags-to-list")
+ }
+
+ // Or, fan the work out over 8 Cloud Tasks; each requeues itself until its shard is done
+ r.Tasks = &migrate.TaskQueue{Client:client, ProjectID:"myproj", LocationID:"us-central1",
+   QueueID:"migrations", URL:"/admin/migrate/task"}
+ http.HandleFunc("/admin/migrate/task", r.TaskHandler)
+ err := r.Start(ctx, "flight-tags-to-list", 8)
+ ...
+ checkpoints,err := r.Status(ctx, "flight-tags-to-list")
+
+ */
+
+var ErrNoSuchMigration = errors.New("migrate: no such migration")
+
+// Func rewrites one entity. old holds the entity's properties, by name; multi-valued
+// properties are []interface{}. It returns the new properties, or nil to leave the entity as
+// it is. It is fine to modify old and return it.
+type Func func(old map[string]interface{}) (map[string]interface{}, error)
+
+type Migration struct {
+	Name      string
+	Kind      string
+	F         Func
+	NoIndex []string // New properties that shouldn't be indexed; existing ones keep their setting
+}
+
+// {{{ registry
+
+var(
+	registryMu sync.Mutex
+	registry = map[string]Migration{}
+)
+
+// Register adds a migration for kind; it panics if the name is already taken.
+func Register(name, kind string, f Func) {
+	RegisterMigration(Migration{Name:name, Kind:kind, F:f})
+}
+
+// RegisterMigration is like Register, but takes the full Migration.
+func RegisterMigration(m Migration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _,exists := registry[m.Name]; exists {
+		panic(fmt.Sprintf("migrate: migration %q registered twice", m.Name))
+	}
+	registry[m.Name] = m
+}
+
+func Lookup(name string) (Migration, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	m,exists := registry[name]
+	if !exists {
+		return m, fmt.Errorf("%w: %q", ErrNoSuchMigration, name)
+	}
+	return m, nil
+}
+
+// Registered lists the names of the registered migrations.
+func Registered() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := []string{}
+	for name := range registry { names = append(names, name) }
+	sort.Strings(names)
+	return names
+}
+
+// }}}
+// {{{ Checkpoint, Report
+
+// Counts tally what happened to the entities in a shard.
+type Counts struct {
+	Seen       int64
+	Changed    int64 // In a dry run, these would have changed
+	Unchanged  int64
+	Failed     int64 // The migration returned an error; the entity was left alone
+}
+
+func (c *Counts)add(o Counts) {
+	c.Seen += o.Seen
+	c.Changed += o.Changed
+	c.Unchanged += o.Unchanged
+	c.Failed += o.Failed
+}
+
+// Checkpoint is the progress through one shard of a migration. It is saved in the singleton
+// provider after every page, so a later run can resume from it.
+type Checkpoint struct {
+	Migration  string
+	Shard      int
+	DryRun     bool
+	Start      string    // Encoded key; the shard covers [Start,End). Empty means unbounded.
+	End        string
+	Cursor     ds.Cursor // Where to resume within the shard
+	Done       bool
+	Counts               // Totals, across all the runs so far
+	Updated    time.Time
+}
+
+// Change is an entity that a dry run would have rewritten.
+type Change struct {
+	Key       string
+	Old, New  map[string]interface{}
+}
+
+// Report describes a single run over a shard.
+type Report struct {
+	Checkpoint           // Where things stand, after the run
+	Run        Counts    // What this run did
+	Errors   []string    // The first few entities that the migration failed on
+	Changes  []Change    // Dry runs only: the first few changes that would have been made
+}
+
+func (r Report)String() string {
+	mode := ""
+	if r.DryRun { mode = " (dry run)" }
+	str := fmt.Sprintf("migration %s, shard %d%s: done=%v\n", r.Migration, r.Shard, mode, r.Done)
+	str += fmt.Sprintf("  this run: %+v\n  in total: %+v\n", r.Run, r.Counts)
+	for _,e := range r.Errors {
+		str += fmt.Sprintf("  error: %s\n", e)
+	}
+	for _,c := range r.Changes {
+		str += fmt.Sprintf("  change: %s\n    old: %v\n    new: %v\n", c.Key, c.Old, c.New)
+	}
+	return str
+}
+
+// }}}
+// {{{ Runner
+
+// Runner runs migrations, checkpointing as it goes. The migration's read-modify-write is not
+// transactional, so changes made by other writers while it runs can be overwritten.
+type Runner struct {
+	P           ds.DatastoreProvider
+	SP          singleton.SingletonProvider // Where the checkpoints live
+	PageSize    int                         // Entities read (and written) per batch; default 100
+	Budget      time.Duration               // How long one Run may go for; zero means no limit
+	DryRun      bool                        // Report what would change, but don't write anything
+	MaxSamples  int                         // How many errors & changes a Report keeps; default 20
+	Tasks      *TaskQueue                   // For fanning out; see tasks.go
+}
+
+func NewRunner(p ds.DatastoreProvider, sp singleton.SingletonProvider) *Runner {
+	return &Runner{P:p, SP:sp, PageSize:100, MaxSamples:20}
+}
+
+func (r *Runner)pageSize() int {
+	if r.PageSize <= 0 { return 100 }
+	return r.PageSize
+}
+
+func (r *Runner)maxSamples() int {
+	if r.MaxSamples <= 0 { return 20 }
+	return r.MaxSamples
+}
+
+// Dry runs keep their own checkpoints, so they don't interfere with the real thing.
+func (r *Runner)singletonName(name string, shard int) string {
+	s := "migrate:" + name
+	if shard >= 0 { s += fmt.Sprintf(":%d", shard) }
+	if r.DryRun { s += ":dryrun" }
+	return s
+}
+
+// }}}
+// {{{ checkpoints
+
+type plan struct {
+	Shards int
+}
+
+// loadCheckpoint returns nil if there isn't one.
+func (r *Runner)loadCheckpoint(ctx context.Context, name string, shard int) (*Checkpoint, error) {
+	cp := Checkpoint{}
+	err := r.SP.ReadSingleton(ctx, r.singletonName(name, shard), nil, &cp)
+	if err == singleton.ErrNoSuchEntity || (err == nil && cp.Migration == "") {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("migrate: loading checkpoint for %s/%d: %v", name, shard, err)
+	}
+	return &cp, nil
+}
+
+func (r *Runner)saveCheckpoint(ctx context.Context, cp Checkpoint) error {
+	cp.Updated = time.Now()
+	if err := r.SP.WriteSingleton(ctx, r.singletonName(cp.Migration, cp.Shard), nil, &cp); err != nil {
+		return fmt.Errorf("migrate: saving checkpoint for %s/%d: %v", cp.Migration, cp.Shard, err)
+	}
+	return nil
+}
+
+// Plan splits the migration into shards of roughly equal numbers of entities, and writes a
+// fresh checkpoint for each, discarding any progress. To split, it reads every key of the
+// kind (but not the entities). Plan(ctx, name, 1) just starts the migration over.
+func (r *Runner)Plan(ctx context.Context, name string, shards int) error {
+	m,err := Lookup(name)
+	if err != nil {
+		return err
+	}
+	if shards < 1 { shards = 1 }
+
+	bounds := []string{""}
+	if shards > 1 {
+		keyers,err := r.P.GetAll(ctx, ds.NewQuery(m.Kind).Order("__key__").KeysOnly(), nil)
+		if err != nil {
+			return fmt.Errorf("migrate: planning %s: %v", name, err)
+		}
+		for i:=1; i<shards; i++ {
+			if j := i*len(keyers)/shards; j > 0 && j < len(keyers) {
+				bounds = append(bounds, keyers[j].Encode())
+			}
+		}
+	}
+	bounds = append(bounds, "")
+
+	for i:=0; i<len(bounds)-1; i++ {
+		cp := Checkpoint{Migration:name, Shard:i, DryRun:r.DryRun, Start:bounds[i], End:bounds[i+1]}
+		if err := r.saveCheckpoint(ctx, cp); err != nil {
+			return err
+		}
+	}
+	pl := plan{Shards: len(bounds)-1}
+	if err := r.SP.WriteSingleton(ctx, r.singletonName(name, -1), nil, &pl); err != nil {
+		return fmt.Errorf("migrate: saving plan for %s: %v", name, err)
+	}
+	return nil
+}
+
+// Status returns the checkpoints for each shard of the migration. If it hasn't been planned
+// or run, there is a single empty checkpoint.
+func (r *Runner)Status(ctx context.Context, name string) ([]Checkpoint, error) {
+	pl := plan{}
+	if err := r.SP.ReadSingleton(ctx, r.singletonName(name, -1), nil, &pl); err != nil && err != singleton.ErrNoSuchEntity {
+		return nil, fmt.Errorf("migrate: loading plan for %s: %v", name, err)
+	}
+	if pl.Shards < 1 { pl.Shards = 1 }
+
+	out := []Checkpoint{}
+	for i:=0; i<pl.Shards; i++ {
+		cp,err := r.loadCheckpoint(ctx, name, i)
+		if err != nil {
+			return nil, err
+		} else if cp == nil {
+			cp = &Checkpoint{Migration:name, Shard:i, DryRun:r.DryRun}
+		}
+		out = append(out, *cp)
+	}
+	return out, nil
+}
+
+// }}}
+// {{{ Run, RunShard
+
+// Run runs the migration over its only shard (i.e. without Plan).
+func (r *Runner)Run(ctx context.Context, name string) (*Report, error) {
+	return r.RunShard(ctx, name, 0)
+}
+
+// RunShard picks up from the shard's checkpoint, and migrates entities a page at a time, until
+// it reaches the end of the shard, or runs out of budget (or the context is done). The
+// checkpoint is saved after each page. If there is an error, the returned report (if any) says
+// how far it got, and a later run will redo the page that failed.
+func (r *Runner)RunShard(ctx context.Context, name string, shard int) (*Report, error) {
+	m,err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	cp,err := r.loadCheckpoint(ctx, name, shard)
+	if err != nil {
+		return nil, err
+	} else if cp == nil {
+		if shard != 0 {
+			return nil, fmt.Errorf("migrate: %s has no shard %d; see Plan", name, shard)
+		}
+		cp = &Checkpoint{Migration:name, Shard:shard, DryRun:r.DryRun}
+	}
+
+	report := &Report{Checkpoint: *cp}
+	if cp.Done {
+		return report, nil
+	}
+
+	q := ds.NewQuery(m.Kind).Order("__key__").Start(cp.Cursor)
+	for _,bound := range []struct{ encoded, op string }{{cp.Start, ">="}, {cp.End, "<"}} {
+		if bound.encoded == "" { continue }
+		k,err := r.P.DecodeKey(bound.encoded)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: bad shard bound: %v", err)
+		}
+		q = q.Filter("__key__ " + bound.op, k)
+	}
+
+	var deadline time.Time
+	if r.Budget > 0 { deadline = time.Now().Add(r.Budget) }
+
+	it := ds.NewStreamingIterator(ctx, r.P, q, datastore.PropertyList{})
+	it.PageSize = r.pageSize()
+	defer it.Close()
+
+	pg := pending{}
+	for it.Iterate(ctx) {
+		props := datastore.PropertyList{}
+		keyer := it.Val(&props)
+		r.migrateEntity(m, keyer, props, report, &pg)
+
+		if it.Remaining() > 0 {
+			continue // Not the end of the page yet
+		}
+		if err := r.flush(ctx, report, &pg); err != nil {
+			return report, err
+		}
+		if report.Checkpoint.Cursor,err = it.Cursor(); err != nil {
+			return report, err
+		}
+		if err := r.saveCheckpoint(ctx, report.Checkpoint); err != nil {
+			return report, err
+		}
+		if ctx.Err() != nil || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return report, nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return report, fmt.Errorf("migrate: %s/%d: %v", name, shard, err)
+	}
+
+	report.Done = true
+	return report, r.saveCheckpoint(ctx, report.Checkpoint)
+}
+
+// pending accumulates a page's worth of rewritten entities, and their counts.
+type pending struct {
+	keyers   []ds.Keyer
+	ents     []datastore.PropertyList
+	counts     Counts
+}
+
+// flush writes the page's changes, and only then adds its counts to the report.
+func (r *Runner)flush(ctx context.Context, report *Report, pg *pending) error {
+	if len(pg.keyers) > 0 {
+		if _,err := r.P.PutMulti(ctx, pg.keyers, pg.ents); err != nil {
+			return fmt.Errorf("migrate: %s/%d: writing %d entities: %v", report.Migration, report.Shard,
+				len(pg.keyers), err)
+		}
+	}
+	report.Run.add(pg.counts)
+	report.Counts.add(pg.counts)
+	*pg = pending{}
+	return nil
+}
+
+func (r *Runner)migrateEntity(m Migration, keyer ds.Keyer, props datastore.PropertyList, report *Report, pg *pending) {
+	pg.counts.Seen++
+	old,noIndex := propsToMap(props)
+
+	in := map[string]interface{}{}
+	for name,val := range old {
+		if multi,isMulti := val.([]interface{}); isMulti {
+			val = append([]interface{}{}, multi...)
+		}
+		in[name] = val
+	}
+
+	out,err := m.F(in)
+	if err != nil {
+		pg.counts.Failed++
+		if len(report.Errors) < r.maxSamples() {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", keyer, err))
+		}
+		return
+	}
+	if out != nil {
+		out = normalizeMap(out)
+	}
+	if out == nil || reflect.DeepEqual(out, old) {
+		pg.counts.Unchanged++
+		return
+	}
+
+	pg.counts.Changed++
+	if r.DryRun {
+		if len(report.Changes) < r.maxSamples() {
+			report.Changes = append(report.Changes, Change{Key:keyer.Encode(), Old:old, New:out})
+		}
+		return
+	}
+	for _,name := range m.NoIndex {
+		if _,existed := old[name]; !existed { noIndex[name] = true }
+	}
+	pg.keyers = append(pg.keyers, keyer)
+	pg.ents = append(pg.ents, mapToProps(out, noIndex))
+}
+
+// }}}
+// {{{ property maps
+
+func propsToMap(props datastore.PropertyList) (map[string]interface{}, map[string]bool) {
+	m := map[string]interface{}{}
+	noIndex := map[string]bool{}
+	for _,p := range props {
+		m[p.Name] = p.Value
+		if p.NoIndex { noIndex[p.Name] = true }
+	}
+	return m, noIndex
+}
+
+// mapToProps sorts the properties by name, so the output is stable.
+func mapToProps(m map[string]interface{}, noIndex map[string]bool) datastore.PropertyList {
+	names := []string{}
+	for name := range m { names = append(names, name) }
+	sort.Strings(names)
+
+	props := datastore.PropertyList{}
+	for _,name := range names {
+		props = append(props, datastore.Property{Name:name, Value:m[name], NoIndex:noIndex[name]})
+	}
+	return props
+}
+
+// normalizeMap converts values into the types that datastore uses: ints become int64, floats
+// become float64, and slices (other than []byte) become []interface{}.
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for name,val := range m {
+		out[name] = normalizeValue(val)
+	}
+	return out
+}
+
+func normalizeValue(val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	switch v := val.(type) {
+	case []byte, time.Time, *datastore.Key, datastore.GeoPoint, *datastore.Entity:
+		return v
+	case ds.Keyer:
+		// E.g. a ds.Key; turn it into a *datastore.Key, via the encoding that both share
+		if k,err := datastore.DecodeKey(v.Encode()); err == nil { return k }
+		return v
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = normalizeValue(rv.Index(i).Interface())
+		}
+		return out
+	}
+	return val
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
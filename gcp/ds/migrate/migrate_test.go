@@ -0,0 +1,159 @@
+package migrate
+
+import(
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skypies/util/gcp/ds"
+	"github.com/skypies/util/singleton/memory"
+)
+
+// go test -v github.com/skypies/util/gcp/ds/migrate
+
+var ctx = context.Background()
+
+type OldFlight struct {
+	Callsign   string
+	TagString  string
+}
+
+type Flight struct {
+	Callsign   string
+	Tags     []string
+	Version    int
+}
+
+func init() {
+	Register("test-tags", "Flight", func(old map[string]interface{}) (map[string]interface{}, error) {
+		str,isOld := old["TagString"].(string)
+		if !isOld {
+			return nil, nil
+		} else if str == "bad" {
+			return nil, fmt.Errorf("can't handle this one")
+		}
+		old["Tags"] = strings.Split(str, ",")
+		old["Version"] = 2 // An int, not an int64
+		delete(old, "TagString")
+		return old, nil
+	})
+}
+
+// Writes 25 old Flights, one of which the migration will fail on.
+func newTestRunner(t *testing.T) (*Runner, []ds.Keyer) {
+	p := ds.NewMemoryProvider()
+	keyers := []ds.Keyer{}
+	flights := []OldFlight{}
+	for i:=0; i<25; i++ {
+		keyers = append(keyers, p.NewIDKey(ctx, "Flight", int64(1000+i), nil))
+		flights = append(flights, OldFlight{Callsign:fmt.Sprintf("UAL%d", i), TagString:"a,b"})
+	}
+	flights[7].TagString = "bad"
+	if _,err := p.PutMulti(ctx, keyers, flights); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	r := NewRunner(p, memory.NewProvider())
+	r.PageSize = 10
+	return r, keyers
+}
+
+func TestDryRun(t *testing.T) {
+	r,keyers := newTestRunner(t)
+	r.DryRun = true
+	r.MaxSamples = 3
+
+	report,err := r.Run(ctx, "test-tags")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	exp := Counts{Seen:25, Changed:24, Failed:1}
+	if !report.Done || report.Run != exp || report.Counts != exp {
+		t.Errorf("unexpected report: %s", report)
+	}
+	if len(report.Errors) != 1 || len(report.Changes) != 3 {
+		t.Errorf("expected 1 error & 3 changes, got: %s", report)
+	} else if c := report.Changes[0]; c.New["Version"] != int64(2) || c.Old["TagString"] != "a,b" {
+		t.Errorf("unexpected change: %+v", c)
+	}
+
+	// Nothing should have been written
+	if err := r.P.Get(ctx, keyers[0], &Flight{}); err != ds.ErrFieldMismatch {
+		t.Errorf("expected the entity to be unchanged, got %v", err)
+	}
+}
+
+func TestResumableRun(t *testing.T) {
+	r,keyers := newTestRunner(t)
+	r.Budget = time.Nanosecond // So each run does just one page
+
+	runs := 0
+	for {
+		report,err := r.Run(ctx, "test-tags")
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		runs++
+		if report.Done {
+			exp := Counts{Seen:25, Changed:24, Failed:1}
+			if report.Counts != exp {
+				t.Errorf("unexpected totals: %s", report)
+			}
+			break
+		} else if runs > 5 {
+			t.Fatalf("too many runs: %s", report)
+		}
+	}
+	if runs != 4 {
+		// 10, 10 and 5 entities; then one that finds there are no more
+		t.Errorf("expected 4 runs, got %d", runs)
+	}
+
+	f := Flight{}
+	if err := r.P.Get(ctx, keyers[0], &f); err != nil || f.Version != 2 || len(f.Tags) != 2 || f.Callsign != "UAL0" {
+		t.Errorf("Get migrated entity: %v, %+v", err, f)
+	}
+
+	// Running it again does nothing; migrating it again from scratch changes nothing
+	if report,err := r.Run(ctx, "test-tags"); err != nil || !report.Done || report.Run.Seen != 0 {
+		t.Errorf("Run when done: %v, %s", err, report)
+	}
+	if err := r.Plan(ctx, "test-tags", 1); err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	r.Budget = 0
+	if report,err := r.Run(ctx, "test-tags"); err != nil || report.Run.Changed != 0 || report.Run.Unchanged != 24 {
+		t.Errorf("Run again: %v, %s", err, report)
+	}
+}
+
+func TestShards(t *testing.T) {
+	r,_ := newTestRunner(t)
+	if err := r.Plan(ctx, "test-tags", 3); err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	checkpoints,err := r.Status(ctx, "test-tags")
+	if err != nil || len(checkpoints) != 3 {
+		t.Fatalf("Status: %v, %+v", err, checkpoints)
+	}
+
+	total := Counts{}
+	for _,cp := range checkpoints {
+		report,err := r.RunShard(ctx, "test-tags", cp.Shard)
+		if err != nil || !report.Done {
+			t.Fatalf("RunShard %d: %v, %s", cp.Shard, err, report)
+		} else if report.Seen < 8 || report.Seen > 9 {
+			t.Errorf("RunShard %d: unbalanced shard: %s", cp.Shard, report)
+		}
+		total.add(report.Counts)
+	}
+	if exp := (Counts{Seen:25, Changed:24, Failed:1}); total != exp {
+		t.Errorf("expected totals %+v, got %+v", exp, total)
+	}
+
+	if _,err := r.RunShard(ctx, "no-such-migration", 0); err == nil {
+		t.Errorf("expected an error for an unregistered migration")
+	}
+}
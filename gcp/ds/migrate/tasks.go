@@ -0,0 +1,96 @@
+package migrate
+
+import(
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+
+	"github.com/skypies/util/gcp/tasks"
+)
+
+// TaskQueue is where Start sends the tasks that run each shard; URL is where the app has
+// mounted Runner.TaskHandler.
+type TaskQueue struct {
+	Client      *cloudtasks.Client // See tasks.GetClient
+	ProjectID    string
+	LocationID   string
+	QueueID      string
+	URL          string
+}
+
+// How long a task works on its shard before requeueing itself, if the Runner has no Budget.
+// App Engine gives task handlers ten minutes.
+const defaultTaskBudget = 5*time.Minute
+
+// Start plans the migration into shards (see Plan), and submits a task for each.
+func (r *Runner)Start(ctx context.Context, name string, shards int) error {
+	if r.Tasks == nil {
+		return fmt.Errorf("migrate: Start needs Runner.Tasks")
+	}
+
+	if err := r.Plan(ctx, name, shards); err != nil {
+		return err
+	}
+	checkpoints,err := r.Status(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _,cp := range checkpoints {
+		if err := r.submitTask(ctx, name, cp.Shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner)submitTask(ctx context.Context, name string, shard int) error {
+	if r.Tasks == nil {
+		return fmt.Errorf("migrate: can't requeue %s/%d without Runner.Tasks", name, shard)
+	}
+	params := url.Values{}
+	params.Set("migration", name)
+	params.Set("shard", fmt.Sprintf("%d", shard))
+	if r.DryRun { params.Set("dryrun", "1") }
+
+	t := r.Tasks
+	if _,err := tasks.SubmitAETask(ctx, t.Client, t.ProjectID, t.LocationID, t.QueueID, 0, t.URL, params); err != nil {
+		return fmt.Errorf("migrate: submitting task for %s/%d: %v", name, shard, err)
+	}
+	return nil
+}
+
+// TaskHandler runs one shard until it is done or the budget runs out, in which case it submits
+// a task to carry on. Errors return a 500, so that Cloud Tasks retries; the retry resumes from
+// the checkpoint.
+//   ?migration=name&shard=N[&dryrun=1]
+func (r *Runner)TaskHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	name := req.FormValue("migration")
+	shard,err := strconv.Atoi(req.FormValue("shard"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad shard: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	runner := *r
+	runner.DryRun = req.FormValue("dryrun") != ""
+	if runner.Budget == 0 { runner.Budget = defaultTaskBudget }
+
+	report,err := runner.RunShard(ctx, name, shard)
+	if err == nil && !report.Done {
+		err = runner.submitTask(ctx, name, shard)
+	}
+	if err != nil {
+		runner.P.Errorf(ctx, "migrate: task for %s/%d: %v", name, shard, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(report.String()))
+}
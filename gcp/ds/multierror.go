@@ -0,0 +1,100 @@
+package ds
+
+import(
+	"fmt"
+)
+
+// MultiError is returned by the batch operations (e.g. GetMulti) when some of the individual
+// items failed; there is one entry per key, in the same order, which is nil for the items
+// that succeeded. Errors from reads are translated, so missing entities show up as
+// ErrNoSuchEntity, and type problems as ErrFieldMismatch.
+type MultiError []error
+
+func (me MultiError)Error() string {
+	n, first := 0, ""
+	for i,err := range me {
+		if err == nil { continue }
+		if n == 0 { first = fmt.Sprintf("[%d]: %v", i, err) }
+		n++
+	}
+	switch n {
+	case 0: return "dsprovider: (0 errors)"
+	case 1: return "dsprovider: " + first
+	}
+	return fmt.Sprintf("dsprovider: %s (and %d other errors)", first, n-1)
+}
+
+// errOrNil returns the MultiError, or nil if every item succeeded.
+func (me MultiError)errOrNil() error {
+	for _,err := range me {
+		if err != nil {
+			return me
+		}
+	}
+	return nil
+}
+
+// AsMultiError presents the error from an n-item batch operation as a MultiError, so callers
+// can check items individually: nil becomes n nils, and an error that isn't a MultiError is
+// taken to apply to every item.
+func AsMultiError(err error, n int) MultiError {
+	if me,ok := err.(MultiError); ok {
+		return me
+	}
+	me := make(MultiError, n)
+	for i := range me {
+		me[i] = err
+	}
+	return me
+}
+
+func (me MultiError)indicesWhere(f func(error) bool) []int {
+	out := []int{}
+	for i,err := range me {
+		if f(err) { out = append(out, i) }
+	}
+	return out
+}
+
+// FoundIndices lists the items that succeeded.
+func (me MultiError)FoundIndices() []int {
+	return me.indicesWhere(func(err error) bool { return err == nil })
+}
+
+// MissingIndices lists the items that failed with ErrNoSuchEntity.
+func (me MultiError)MissingIndices() []int {
+	return me.indicesWhere(func(err error) bool { return err == ErrNoSuchEntity })
+}
+
+// MismatchIndices lists the items that were loaded, but failed with ErrFieldMismatch.
+func (me MultiError)MismatchIndices() []int {
+	return me.indicesWhere(func(err error) bool { return err == ErrFieldMismatch })
+}
+
+// OtherErrors returns the errors that were neither ErrNoSuchEntity nor ErrFieldMismatch,
+// keyed by item index.
+func (me MultiError)OtherErrors() map[int]error {
+	out := map[int]error{}
+	for i,err := range me {
+		if err != nil && err != ErrNoSuchEntity && err != ErrFieldMismatch {
+			out[i] = err
+		}
+	}
+	return out
+}
+
+// AllMissing is true if none of the items were found.
+func (me MultiError)AllMissing() bool {
+	return len(me.MissingIndices()) == len(me)
+}
+
+// OnlyMissing is true if the only failures were missing entities; i.e. the items that were
+// found can be used as-is.
+func (me MultiError)OnlyMissing() bool {
+	for _,err := range me {
+		if err != nil && err != ErrNoSuchEntity {
+			return false
+		}
+	}
+	return true
+}
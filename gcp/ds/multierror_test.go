@@ -0,0 +1,37 @@
+package ds
+
+import(
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	other := errors.New("boom")
+	me := MultiError{nil, ErrNoSuchEntity, ErrFieldMismatch, nil, other, ErrNoSuchEntity}
+
+	check := func(name string, got, exp interface{}) {
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", exp) {
+			t.Errorf("%s: expected %v, got %v", name, exp, got)
+		}
+	}
+	check("FoundIndices", me.FoundIndices(), []int{0,3})
+	check("MissingIndices", me.MissingIndices(), []int{1,5})
+	check("MismatchIndices", me.MismatchIndices(), []int{2})
+	check("OtherErrors", me.OtherErrors(), map[int]error{4:other})
+	check("AllMissing", me.AllMissing(), false)
+	check("OnlyMissing", me.OnlyMissing(), false)
+	check("Error", me.Error(), "dsprovider: [1]: "+ErrNoSuchEntity.Error()+" (and 3 other errors)")
+
+	me = MultiError{ErrNoSuchEntity, ErrNoSuchEntity}
+	check("AllMissing", me.AllMissing(), true)
+	check("OnlyMissing", MultiError{nil, ErrNoSuchEntity}.OnlyMissing(), true)
+
+	check("AsMultiError(nil)", AsMultiError(nil, 2), MultiError{nil, nil})
+	check("AsMultiError(other)", AsMultiError(other, 2), MultiError{other, other})
+	check("AsMultiError(me)", len(AsMultiError(me, 5)), 2)
+
+	if (MultiError{nil, nil}).errOrNil() != nil {
+		t.Errorf("errOrNil, expected nil for all-nil MultiError")
+	}
+}
@@ -0,0 +1,60 @@
+package ds
+
+import(
+	"fmt"
+)
+
+/*
+
+ keyers,err := p.Mutate(ctx,
+   ds.NewInsert(p.NewIncompleteKey(ctx, "Flight", nil), &flight), // Fails if it exists
+   ds.NewUpdate(airframeKey, &airframe),                          // Fails if it doesn't exist
+   ds.NewUpsert(statsKey, &stats),                                // Just a Put
+   ds.NewDelete(oldFlightKey))
+ if me,isMulti := err.(ds.MultiError); isMulti {
+   ... me[i] is the error (if any) for the i'th mutation
+ }
+
+ // Also in transactions, where they are applied along with everything else on commit
+ err := p.RunInTransaction(ctx, func(tx ds.Transaction) error {
+   return tx.Mutate(ds.NewInsert(k, &obj))
+ }, nil)
+
+ */
+
+type MutationOp string
+
+const(
+	MutationInsert MutationOp = "insert" // Fails with ErrEntityExists if the entity exists
+	MutationUpdate MutationOp = "update" // Fails with ErrNoSuchEntity if it doesn't
+	MutationUpsert MutationOp = "upsert"
+	MutationDelete MutationOp = "delete"
+)
+
+// Mutation is a single write, for Mutate. Src is as for Put, and is unused for deletes.
+type Mutation struct {
+	Op     MutationOp
+	Keyer  Keyer
+	Src    interface{}
+}
+
+func NewInsert(keyer Keyer, src interface{}) Mutation { return Mutation{MutationInsert, keyer, src} }
+func NewUpdate(keyer Keyer, src interface{}) Mutation { return Mutation{MutationUpdate, keyer, src} }
+func NewUpsert(keyer Keyer, src interface{}) Mutation { return Mutation{MutationUpsert, keyer, src} }
+func NewDelete(keyer Keyer) Mutation                  { return Mutation{MutationDelete, keyer, nil} }
+
+func (m Mutation)String() string { return fmt.Sprintf("%s(%v)", m.Op, m.Keyer) }
+
+func (m Mutation)validate() error {
+	switch m.Op {
+	case MutationInsert, MutationUpdate, MutationUpsert:
+		if m.Src == nil { return fmt.Errorf("%s: nil src", m) }
+	case MutationDelete:
+	default:
+		return fmt.Errorf("%s: unknown mutation op", m)
+	}
+	if m.Keyer == nil {
+		return fmt.Errorf("%s: nil key", m)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package ds
+
+import(
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+/*
+
+ Namespaces keep sets of entities apart within a single project (e.g. staging vs. prod, or one
+ per customer). The namespace for a new root key, or a query, is picked from (in order):
+
+ 1. an explicit namespace: ds.InNamespace(key, ns), or q.Namespace(ns)
+ 2. for child keys, and ancestor queries, the namespace of the parent/ancestor
+ 3. the context: ctx = ds.SetNamespace(ctx, ns)
+ 4. the provider's default: ds.NewCloudDSProvider(ctx, proj, ds.WithNamespace(ns)), or
+    MemoryProvider.Namespace
+
+ The empty string is the default namespace.
+
+ ctx = ds.SetProviderInNamespace(ctx, p, "customer1")
+ k := p.NewNameKey(ctx, "Foo", "foo1", nil)              // in "customer1"
+ k2 := ds.InNamespace(p.NewNameKey(ctx, "Foo", "foo1", nil), "customer2")
+ q := ds.NewQuery("Foo").Namespace("")                   // the default namespace
+
+ */
+
+// InNamespace returns a copy of the key, and all its ancestors, in the namespace ns.
+func InNamespace(keyer Keyer, ns string) Keyer {
+	if keyer == nil { return nil }
+	return Keyer(keyInNamespace(toDatastoreKey(keyer), ns))
+}
+
+func keyInNamespace(key *datastore.Key, ns string) *datastore.Key {
+	if key == nil { return nil }
+	out := *key
+	out.Namespace = ns
+	out.Parent = keyInNamespace(key.Parent, ns)
+	return &out
+}
+
+// contextNamespace is the namespace to use if nothing more specific was asked for.
+func contextNamespace(ctx context.Context, providerDefault string) string {
+	if ns,exists := GetNamespace(ctx); exists {
+		return ns
+	}
+	return providerDefault
+}
+
+// newKeyNamespace puts a freshly built key into the right namespace. The datastore.*Key()
+// funcs leave it empty, even for child keys; but children must share their parent's namespace.
+func newKeyNamespace(ctx context.Context, key *datastore.Key, providerDefault string) *datastore.Key {
+	if key.Parent != nil {
+		key.Namespace = key.Parent.Namespace
+	} else {
+		key.Namespace = contextNamespace(ctx, providerDefault)
+	}
+	return key
+}
+
+// queryNamespace is the namespace the query should run in.
+func queryNamespace(ctx context.Context, q *Query, providerDefault string) string {
+	if q.NamespaceVal != nil {
+		return *q.NamespaceVal
+	} else if q.AncestorKeyer != nil {
+		return toDatastoreKey(q.AncestorKeyer).Namespace
+	}
+	return contextNamespace(ctx, providerDefault)
+}
@@ -1,34 +1,67 @@
 package ds
 
-import "fmt"
+import(
+	"context"
+	"fmt"
+	"strings"
+)
 
 // Query is a thin skin over the datastore query API. It also provides a textual dump of the
 // query.
 type Query struct {
 	Kind            string
 	AncestorKeyer   Keyer
-	Filters       []Filter
+	Filters       []Filter       // All of these must match, as must all the EntityFilters
+	EntityFilters []EntityFilter
 	ProjectFields []string
+	Orders        []Order        // Results are sorted by each of these in turn
+	// Deprecated: use Orders. If set, it is applied before them, as if passed to Order().
 	OrderStr        string
 	LimitVal        int
+	OffsetVal       int
+	StartCursor     Cursor
+	EndCursor       Cursor
 	KeysOnlyVal     bool
 	DistinctVals    bool
+	NamespaceVal   *string        // nil means the context's, or the provider's, namespace
 }
 
-type Filter struct {
-	Field string
-	Value interface{}
+type Order struct {
+	Field      string
+	Descending bool
 }
 
+// String renders the order in the style that Query.Order takes.
+func (o Order)String() string {
+	if o.Descending { return "-" + o.Field }
+	return o.Field
+}
+
+// Cursor is an opaque, printable position in the results of a query, as returned by
+// QueryIterator.Cursor; it can be stashed away, and passed to Query.Start to resume a query
+// in a later request. The empty Cursor is the start of the results.
+type Cursor string
+
 func (q *Query)String() string {
 	str := fmt.Sprintf("NewQuery(%q)\n", q.Kind)
+	if q.NamespaceVal != nil  { str += fmt.Sprintf("  .Namespace(%q)\n", *q.NamespaceVal) }
 	if q.AncestorKeyer != nil { str += fmt.Sprintf("  .Ancestor(%v)\n", q.AncestorKeyer) }
 	for _,f := range q.Filters {
-		str += fmt.Sprintf("  .Filter(%q, %v)\n", f.Field, f.Value)
+		if pf := f.Property(); pf.Validate() == nil {
+			str += fmt.Sprintf("  .Filter(%q, %s)\n", pf.Field+" "+string(pf.Op), filterValueString(pf.Value))
+		} else {
+			str += fmt.Sprintf("  .Filter(%q, %s)\n", f.Field, filterValueString(f.Value))
+		}
+	}
+	for _,ef := range q.EntityFilters {
+		str += fmt.Sprintf("  .FilterEntity(%s)\n", ef)
 	}
 	if len(q.ProjectFields) != 0 { str += fmt.Sprintf("  .Project%q\n", q.ProjectFields) }
-	if q.OrderStr != ""          { str += fmt.Sprintf("  .Order(%q)\n", q.OrderStr) }
+	for _,o := range q.allOrders() { str += fmt.Sprintf("  .Order(%q)\n", o.String()) }
 	if q.LimitVal != 0           { str += fmt.Sprintf("  .Limit(%d)\n", q.LimitVal) }
+	if q.OffsetVal != 0          { str += fmt.Sprintf("  .Offset(%d)\n", q.OffsetVal) }
+	if q.StartCursor != ""       { str += fmt.Sprintf("  .Start(%q)\n", q.StartCursor) }
+	if q.EndCursor != ""         { str += fmt.Sprintf("  .End(%q)\n", q.EndCursor) }
 	if q.KeysOnlyVal             { str += fmt.Sprintf("  .KeysOnly()\n") }
 	if q.DistinctVals            { str += fmt.Sprintf("  .Distinct()\n") }
 	return str
@@ -36,18 +69,63 @@ func (q *Query)String() string {
 
 func NewQuery(kind string) *Query { return &Query{Kind:kind} }
 
-func (q *Query)Filter(field string, val interface{}) *Query {
-	q.Filters = append(q.Filters, Filter{field, val})
+// Filter takes the field and operator as a single string, e.g. "Time >". If that string can't
+// be parsed, the query will fail when it is run.
+func (q *Query)Filter(fieldAndOp string, val interface{}) *Query {
+	q.Filters = append(q.Filters, Filter{fieldAndOp, val})
+	return q
+}
+
+// FilterEntity adds a filter, or a tree of filters, built with e.g. ds.Gt() and ds.Or().
+func (q *Query)FilterEntity(ef EntityFilter) *Query {
+	q.EntityFilters = append(q.EntityFilters, ef)
 	return q
 }
 
+// allFilters returns the Filters and the EntityFilters, all of which must match.
+func (q *Query)allFilters() []EntityFilter {
+	all := []EntityFilter{}
+	for _,f := range q.Filters {
+		all = append(all, f)
+	}
+	return append(all, q.EntityFilters...)
+}
+
 func (q *Query)Project(fields ...string) *Query {
 	q.ProjectFields = fields
 	return q
 }
 
+// Order adds a sort order; a property name, with a leading '-' for descending. Call it more
+// than once to sort by further properties when the earlier ones are equal.
 func (q *Query)Order(o string) *Query {
-	q.OrderStr = o
+	q.Orders = append(q.Orders, parseOrder(o))
+	return q
+}
+
+func parseOrder(o string) Order {
+	o = strings.TrimSpace(o)
+	if strings.HasPrefix(o, "-") {
+		return Order{Field:strings.TrimSpace(o[1:]), Descending:true}
+	}
+	return Order{Field:o}
+}
+
+// allOrders returns the Orders, after any (deprecated) OrderStr.
+func (q *Query)allOrders() []Order {
+	if q.OrderStr == "" {
+		return q.Orders
+	}
+	return append([]Order{parseOrder(q.OrderStr)}, q.Orders...)
+}
+
+func (q *Query)OrderAsc(field string) *Query {
+	q.Orders = append(q.Orders, Order{Field:field})
+	return q
+}
+
+func (q *Query)OrderDesc(field string) *Query {
+	q.Orders = append(q.Orders, Order{Field:field, Descending:true})
 	return q
 }
 
@@ -56,11 +134,33 @@ func (q *Query)Limit(l int) *Query {
 	return q
 }
 
+func (q *Query)Offset(o int) *Query {
+	q.OffsetVal = o
+	return q
+}
+
+func (q *Query)Start(c Cursor) *Query {
+	q.StartCursor = c
+	return q
+}
+
+func (q *Query)End(c Cursor) *Query {
+	q.EndCursor = c
+	return q
+}
+
 func (q *Query)KeysOnly() *Query {
 	q.KeysOnlyVal = true
 	return q
 }
 
+// Namespace runs the query in the namespace ns, regardless of the context or the provider's
+// default; "" is the default namespace.
+func (q *Query)Namespace(ns string) *Query {
+	q.NamespaceVal = &ns
+	return q
+}
+
 func (q *Query)Distinct() *Query {
 	q.DistinctVals = true
 	return q
@@ -70,3 +170,41 @@ func (q *Query)Ancestor(keyer Keyer) *Query {
 	q.AncestorKeyer = keyer
 	return q
 }
+
+// Validate looks for things that datastore is known to reject; currently, that if there is an
+// inequality filter, the first sort order must be on the same property. The providers log
+// these as warnings, rather than refusing to run the query.
+func (q *Query)Validate() error {
+	orders := q.allOrders()
+	if len(orders) == 0 {
+		return nil
+	}
+
+	fields := []string{}
+	var collect func(EntityFilter)
+	collect = func(ef EntityFilter) {
+		switch f := ef.(type) {
+		case Filter:
+			collect(f.Property())
+		case PropertyFilter:
+			if f.Op.IsInequality() { fields = append(fields, f.Field) }
+		case CompositeFilter:
+			for _,sub := range f.Filters { collect(sub) }
+		}
+	}
+	for _,ef := range q.allFilters() { collect(ef) }
+
+	for _,field := range fields {
+		if field != orders[0].Field {
+			return fmt.Errorf("inequality filter on %q, but first sort order is on %q",
+				field, orders[0].Field)
+		}
+	}
+	return nil
+}
+
+func warnIfInvalid(ctx context.Context, p DatastoreProvider, q *Query) {
+	if err := q.Validate(); err != nil {
+		p.Warningf(ctx, "dsprovider: query may be rejected: %v\nQuery: %s", err, q)
+	}
+}
@@ -0,0 +1,112 @@
+package ds
+
+import(
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		In     string
+		Field  string
+		Op     Operator
+		Ok     bool
+	}{
+		{"Time >", "Time", OpGreaterThan, true},
+		{"Time>=", "Time", OpGreaterEq, true},
+		{"Time", "Time", OpEqual, true},
+		{" Time  != ", "Time", OpNotEqual, true},
+		{"Tags in", "Tags", OpIn, true},
+		{"Tags not-in", "Tags", OpNotIn, true},
+		{"Tin", "Tin", OpEqual, true},
+		{">", "", "", false},
+		{"Time ~", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _,test := range tests {
+		f,err := ParseFilter(test.In, 1)
+		if (err == nil) != test.Ok {
+			t.Errorf("ParseFilter(%q), expected ok=%v, got err: %v", test.In, test.Ok, err)
+		} else if test.Ok && (f.Field != test.Field || f.Op != test.Op) {
+			t.Errorf("ParseFilter(%q), expected %q/%q, got %q/%q", test.In, test.Field, test.Op,
+				f.Field, f.Op)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	q := NewQuery("Flight").
+		Filter("Altitude >", 100).
+		FilterEntity(Or(Eq("Airline", "UA"), And(Eq("Airline", "AA"), In("Origin", []string{"SFO"})))).
+		Limit(5).
+		Namespace("staging")
+
+	exp := `NewQuery("Flight")
+  .Namespace("staging")
+  .Filter("Altitude >", 100)
+  .FilterEntity(Or(Eq("Airline", "UA"), And(Eq("Airline", "AA"), In("Origin", ["SFO"]))))
+  .Limit(5)
+`
+	if q.String() != exp {
+		t.Errorf("Query.String(), expected:\n%s\ngot:\n%s", exp, q)
+	}
+}
+
+func TestQueryOrders(t *testing.T) {
+	q := NewQuery("Flight").Order("Airline").Order("-Timestamp").OrderDesc("Altitude")
+
+	exp := `NewQuery("Flight")
+  .Order("Airline")
+  .Order("-Timestamp")
+  .Order("-Altitude")
+`
+	if q.String() != exp {
+		t.Errorf("Query.String(), expected:\n%s\ngot:\n%s", exp, q)
+	}
+	if err := q.Validate(); err != nil {
+		t.Errorf("Validate, unexpected err: %v", err)
+	}
+
+	if err := q.Filter("Timestamp >", 0).Validate(); err == nil {
+		t.Errorf("Validate, expected error for inequality on second order")
+	}
+	if err := NewQuery("Flight").OrderAsc("Timestamp").Filter("Timestamp >", 0).Validate(); err != nil {
+		t.Errorf("Validate, unexpected err: %v", err)
+	}
+	if err := NewQuery("Flight").Filter("Airline", "UA").Order("Timestamp").Validate(); err != nil {
+		t.Errorf("Validate, equality filters shouldn't matter, but got err: %v", err)
+	}
+}
+
+func TestLegacyFilter(t *testing.T) {
+	// Positional literals, with the operator in the field, still mean what they always did
+	f := Filter{"Altitude >", 100}
+	if pf := f.Property(); pf.String() != `Gt("Altitude", 100)` || f.Validate() != nil {
+		t.Errorf("legacy Filter: got %s, %v", pf, f.Validate())
+	}
+	if err := (Filter{"Altitude ~", 100}).Validate(); err == nil {
+		t.Errorf("Validate, expected error for unparseable filter")
+	}
+
+	q := NewQuery("Flight")
+	q.Filters = append(q.Filters, Filter{"Altitude >", 100})
+	if err := q.OrderAsc("Timestamp").Validate(); err == nil {
+		t.Errorf("Validate, expected error for legacy inequality on another order")
+	}
+}
+
+func TestLegacyOrderStr(t *testing.T) {
+	q := NewQuery("Flight").Order("Altitude")
+	q.OrderStr = "-Timestamp"
+
+	exp := `NewQuery("Flight")
+  .Order("-Timestamp")
+  .Order("Altitude")
+`
+	if q.String() != exp {
+		t.Errorf("Query.String(), expected:\n%s\ngot:\n%s", exp, q)
+	}
+	if err := q.Filter("Altitude >", 0).Validate(); err == nil {
+		t.Errorf("Validate, expected OrderStr to be the first sort order")
+	}
+}
@@ -0,0 +1,306 @@
+package ds
+
+import(
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+
+ rp := ds.NewRetryingProvider(p, &ds.RetryOptions{MaxAttempts:5, RetryPuts:true})
+ ... use rp wherever you'd have used p ...
+ fmt.Printf("retried %d Gets\n", rp.RetryCounts()["Get"])
+
+ */
+
+// RetryOptions configures a RetryingProvider; the zero value gets the defaults.
+type RetryOptions struct {
+	MaxAttempts     int           // Per call, including the first; default 4
+	InitialBackoff  time.Duration // Default 100ms
+	MaxBackoff      time.Duration // Default 5s
+	Multiplier      float64       // How much the backoff grows per attempt; default 2
+
+	// Put and PutMulti are only retried if this is set, and all the keys are complete; retrying
+	// a put with an incomplete key could create duplicate entities.
+	RetryPuts       bool
+
+	// Which errors are worth retrying; defaults to IsTransientError.
+	IsRetryable     func(error) bool
+}
+
+func (opts RetryOptions)withDefaults() RetryOptions {
+	if opts.MaxAttempts <= 0    { opts.MaxAttempts = 4 }
+	if opts.InitialBackoff <= 0 { opts.InitialBackoff = 100*time.Millisecond }
+	if opts.MaxBackoff <= 0     { opts.MaxBackoff = 5*time.Second }
+	if opts.Multiplier < 1      { opts.Multiplier = 2 }
+	if opts.IsRetryable == nil  { opts.IsRetryable = IsTransientError }
+	return opts
+}
+
+// IsTransientError is true for the gRPC errors that are likely to go away if you try again:
+// Unavailable, DeadlineExceeded and Aborted. A MultiError is transient if any of its errors is.
+func IsTransientError(err error) bool {
+	if me,isMulti := err.(MultiError); isMulti {
+		for _,e := range me {
+			if e != nil && IsTransientError(e) { return true }
+		}
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// RetryingProvider wraps another provider, and retries the idempotent operations when they
+// fail with transient errors. Everything else is passed straight through.
+type RetryingProvider struct {
+	DatastoreProvider
+	opts     RetryOptions
+
+	mu       sync.Mutex
+	retries  map[string]int64 // op -> how many retries
+}
+
+// NewRetryingProvider wraps p; opts may be nil.
+func NewRetryingProvider(p DatastoreProvider, opts *RetryOptions) *RetryingProvider {
+	o := RetryOptions{}
+	if opts != nil { o = *opts }
+	return &RetryingProvider{
+		DatastoreProvider: p,
+		opts: o.withDefaults(),
+		retries: map[string]int64{},
+	}
+}
+
+// RetryCounts returns how many retries there have been, for each operation.
+func (rp *RetryingProvider)RetryCounts() map[string]int64 {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	out := map[string]int64{}
+	for op,n := range rp.retries {
+		out[op] = n
+	}
+	return out
+}
+
+// {{{ retry
+
+// retry calls f until it succeeds, fails with a non-transient error, or runs out of attempts.
+// It won't start a backoff that would overrun the context's deadline; in that case (or if the
+// context is cancelled while waiting) it returns the most recent error from f.
+func (rp *RetryingProvider)retry(ctx context.Context, op string, f func() error) error {
+	backoff := rp.opts.InitialBackoff
+	for attempt:=1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= rp.opts.MaxAttempts || !rp.opts.IsRetryable(err) {
+			return err
+		}
+
+		// "Full jitter": sleep for a random fraction of the current backoff
+		sleep := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		if deadline,hasDeadline := ctx.Deadline(); hasDeadline && time.Now().Add(sleep).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+
+		backoff = time.Duration(float64(backoff) * rp.opts.Multiplier)
+		if backoff > rp.opts.MaxBackoff { backoff = rp.opts.MaxBackoff }
+
+		rp.mu.Lock()
+		rp.retries[op]++
+		rp.mu.Unlock()
+		rp.Debugf(ctx, "dsprovider: retrying %s (attempt %d) after: %v", op, attempt+1, err)
+	}
+}
+
+// retryMulti is retry for the batch operations, where a MultiError means each key succeeded or
+// failed on its own. f is called with the indices of the keys still to be done; only the keys
+// whose errors are retryable are tried again, and the results are merged back into one
+// MultiError that lines up with all n keys.
+func (rp *RetryingProvider)retryMulti(ctx context.Context, op string, n int, f func(idx []int) error) error {
+	idx := make([]int, n)
+	for i := range idx { idx[i] = i }
+	var merged MultiError
+
+	err := rp.retry(ctx, op, func() error {
+		err := f(idx)
+		me,isMulti := err.(MultiError)
+		if !isMulti || len(me) != len(idx) {
+			// The whole call succeeded or failed, so that goes for all the keys that were in it
+			if merged != nil {
+				for _,i := range idx { merged[i] = err }
+			}
+			return err
+		}
+
+		if merged == nil { merged = make(MultiError, n) }
+		pending := []int{}
+		var retryable error
+		for j,i := range idx {
+			merged[i] = me[j]
+			if me[j] != nil && rp.opts.IsRetryable(me[j]) {
+				pending = append(pending, i)
+				retryable = me[j]
+			}
+		}
+		if retryable == nil {
+			return me
+		}
+		idx = pending
+		return retryable
+	})
+
+	if merged == nil {
+		return err
+	}
+	for _,e := range merged {
+		if e != nil { return merged }
+	}
+	return nil
+}
+
+// subKeyers picks out the keyers at the indices idx.
+func subKeyers(keyers []Keyer, idx []int) []Keyer {
+	out := make([]Keyer, len(idx))
+	for j,i := range idx {
+		out[j] = keyers[i]
+	}
+	return out
+}
+
+func allComplete(keyers []Keyer) bool {
+	for _,k := range keyers {
+		if dsKey := toDatastoreKey(k); dsKey == nil || dsKey.Incomplete() { return false }
+	}
+	return true
+}
+
+// }}}
+
+// {{{ Reads
+
+func (rp *RetryingProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	return rp.retry(ctx, "Get", func() error {
+		return rp.DatastoreProvider.Get(ctx, keyer, dst)
+	})
+}
+
+func (rp *RetryingProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	return rp.retryMulti(ctx, "GetMulti", len(keyers), func(idx []int) error {
+		if len(idx) == len(keyers) {
+			return rp.DatastoreProvider.GetMulti(ctx, keyers, dst)
+		}
+
+		// Load the retried keys into a fresh slice, and copy them back over dst
+		v := reflect.ValueOf(dst)
+		sub := reflect.MakeSlice(v.Type(), len(idx), len(idx))
+		for j,i := range idx {
+			sub.Index(j).Set(v.Index(i))
+		}
+		err := rp.DatastoreProvider.GetMulti(ctx, subKeyers(keyers, idx), sub.Interface())
+		for j,i := range idx {
+			v.Index(i).Set(sub.Index(j))
+		}
+		return err
+	})
+}
+
+func (rp *RetryingProvider)GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error) {
+	// A failed attempt may have appended some results to dst; each retry starts from scratch.
+	var dstSlice, orig reflect.Value
+	if v := reflect.ValueOf(dst); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Slice {
+		dstSlice,orig = v.Elem(), reflect.ValueOf(v.Elem().Interface())
+	}
+
+	var keyers []Keyer
+	err := rp.retry(ctx, "GetAll", func() error {
+		if dstSlice.IsValid() { dstSlice.Set(orig) }
+		var err error
+		keyers,err = rp.DatastoreProvider.GetAll(ctx, q, dst)
+		return err
+	})
+	return keyers, err
+}
+
+func (rp *RetryingProvider)Count(ctx context.Context, q *Query) (int, error) {
+	n := 0
+	err := rp.retry(ctx, "Count", func() error {
+		var err error
+		n,err = rp.DatastoreProvider.Count(ctx, q)
+		return err
+	})
+	return n, err
+}
+
+func (rp *RetryingProvider)Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	var res AggregationResult
+	err := rp.retry(ctx, "Aggregate", func() error {
+		var err error
+		res,err = rp.DatastoreProvider.Aggregate(ctx, q, aggs...)
+		return err
+	})
+	return res, err
+}
+
+// }}}
+// {{{ Writes
+
+func (rp *RetryingProvider)Delete(ctx context.Context, keyer Keyer) error {
+	return rp.retry(ctx, "Delete", func() error {
+		return rp.DatastoreProvider.Delete(ctx, keyer)
+	})
+}
+
+func (rp *RetryingProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
+	return rp.retryMulti(ctx, "DeleteMulti", len(keyers), func(idx []int) error {
+		return rp.DatastoreProvider.DeleteMulti(ctx, subKeyers(keyers, idx))
+	})
+}
+
+func (rp *RetryingProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
+	if !rp.opts.RetryPuts || !allComplete([]Keyer{keyer}) {
+		return rp.DatastoreProvider.Put(ctx, keyer, src)
+	}
+	var out Keyer
+	err := rp.retry(ctx, "Put", func() error {
+		var err error
+		out,err = rp.DatastoreProvider.Put(ctx, keyer, src)
+		return err
+	})
+	return out, err
+}
+
+func (rp *RetryingProvider)PutMulti(ctx context.Context, keyers []Keyer, src interface{}) ([]Keyer, error) {
+	if !rp.opts.RetryPuts || !allComplete(keyers) {
+		return rp.DatastoreProvider.PutMulti(ctx, keyers, src)
+	}
+	var out []Keyer
+	err := rp.retry(ctx, "PutMulti", func() error {
+		var err error
+		out,err = rp.DatastoreProvider.PutMulti(ctx, keyers, src)
+		return err
+	})
+	return out, err
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
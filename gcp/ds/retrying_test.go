@@ -0,0 +1,192 @@
+package ds
+
+import(
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyProvider fails the first n calls to Get, Put and GetAll with err. If partial is set, the
+// failing GetAlls load their results into dst first, like a query that dies halfway through.
+type flakyProvider struct {
+	DatastoreProvider
+	n       int
+	err     error
+	partial bool
+	calls   int
+}
+
+func (fp *flakyProvider)fail() error {
+	fp.calls++
+	if fp.calls <= fp.n { return fp.err }
+	return nil
+}
+func (fp *flakyProvider)Get(ctx context.Context, keyer Keyer, dst interface{}) error {
+	if err := fp.fail(); err != nil { return err }
+	return fp.DatastoreProvider.Get(ctx, keyer, dst)
+}
+func (fp *flakyProvider)Put(ctx context.Context, keyer Keyer, src interface{}) (Keyer, error) {
+	if err := fp.fail(); err != nil { return nil, err }
+	return fp.DatastoreProvider.Put(ctx, keyer, src)
+}
+func (fp *flakyProvider)GetAll(ctx context.Context, q *Query, dst interface{}) ([]Keyer, error) {
+	if err := fp.fail(); err != nil {
+		if fp.partial { fp.DatastoreProvider.GetAll(ctx, q, dst) }
+		return nil, fmt.Errorf("GetAll: %w", err)
+	}
+	return fp.DatastoreProvider.GetAll(ctx, q, dst)
+}
+
+// keyFlakyProvider fails GetMulti and DeleteMulti for the keys in bad, the first time it sees
+// each of them, with a MultiError; it records the keys in each call.
+type keyFlakyProvider struct {
+	DatastoreProvider
+	bad    map[string]error
+	calls  [][]Keyer
+}
+
+func (kp *keyFlakyProvider)fail(keyers []Keyer) error {
+	kp.calls = append(kp.calls, keyers)
+	me := make(MultiError, len(keyers))
+	failed := false
+	for i,k := range keyers {
+		if err,exists := kp.bad[k.Encode()]; exists {
+			me[i] = err
+			delete(kp.bad, k.Encode())
+			failed = true
+		}
+	}
+	if failed { return me }
+	return nil
+}
+func (kp *keyFlakyProvider)GetMulti(ctx context.Context, keyers []Keyer, dst interface{}) error {
+	failErr := kp.fail(keyers)
+	if err := kp.DatastoreProvider.GetMulti(ctx, keyers, dst); err != nil {
+		return err
+	}
+	return failErr
+}
+func (kp *keyFlakyProvider)DeleteMulti(ctx context.Context, keyers []Keyer) error {
+	me,_ := kp.fail(keyers).(MultiError)
+	for i,k := range keyers {
+		if me != nil && me[i] != nil { continue }
+		if err := kp.DatastoreProvider.Delete(ctx, k); err != nil { return err }
+	}
+	if me != nil { return me }
+	return nil
+}
+
+func TestRetryingProvider(t *testing.T) {
+	p,root := newTestProvider(t)
+	unavailable := status.Error(codes.Unavailable, "try again")
+	opts := &RetryOptions{MaxAttempts:3, InitialBackoff:time.Millisecond}
+	k := p.NewIDKey(ctx, "Foo", 100, root)
+
+	fp := &flakyProvider{DatastoreProvider:p, n:2, err:unavailable}
+	rp := NewRetryingProvider(fp, opts)
+	foo := Foo{}
+	if err := rp.Get(ctx, k, &foo); err != nil {
+		t.Errorf("Get, expected to succeed on the third attempt: %v", err)
+	} else if n := rp.RetryCounts()["Get"]; n != 2 {
+		t.Errorf("Get, expected 2 retries, got %d", n)
+	}
+
+	// Wrapped errors are still transient
+	fp.calls = 0
+	foos := []Foo{}
+	if _,err := rp.GetAll(ctx, NewQuery("Foo"), &foos); err != nil || len(foos) != 5 {
+		t.Errorf("GetAll: %v, %d results", err, len(foos))
+	}
+
+	// Results from failed attempts don't pile up in dst
+	fp = &flakyProvider{DatastoreProvider:p, n:2, err:unavailable, partial:true}
+	rp = NewRetryingProvider(fp, opts)
+	foos = []Foo{{S:"already here"}}
+	if _,err := rp.GetAll(ctx, NewQuery("Foo"), &foos); err != nil || len(foos) != 6 {
+		t.Errorf("GetAll with partial failures: %v, %d results (expected 1+5)", err, len(foos))
+	} else if foos[0].S != "already here" {
+		t.Errorf("GetAll with partial failures: clobbered dst[0]: %+v", foos[0])
+	}
+
+	// Out of attempts
+	fp = &flakyProvider{DatastoreProvider:p, n:5, err:unavailable}
+	rp = NewRetryingProvider(fp, opts)
+	if err := rp.Get(ctx, k, &foo); status.Code(err) != codes.Unavailable || fp.calls != 3 {
+		t.Errorf("Get, expected to give up after 3 attempts; got %v after %d", err, fp.calls)
+	}
+
+	// Non-transient errors aren't retried
+	fp = &flakyProvider{DatastoreProvider:p, n:1, err:status.Error(codes.InvalidArgument, "nope")}
+	rp = NewRetryingProvider(fp, opts)
+	if err := rp.Get(ctx, k, &foo); err == nil || fp.calls != 1 {
+		t.Errorf("Get, shouldn't have retried: %v after %d", err, fp.calls)
+	}
+
+	// Puts are only retried if asked for, and the key is complete
+	fp = &flakyProvider{DatastoreProvider:p, n:1, err:unavailable}
+	rp = NewRetryingProvider(fp, opts)
+	if _,err := rp.Put(ctx, k, &foo); err == nil {
+		t.Errorf("Put, shouldn't have retried by default")
+	}
+	fp.calls = 0
+	rp = NewRetryingProvider(fp, &RetryOptions{InitialBackoff:time.Millisecond, RetryPuts:true})
+	if _,err := rp.Put(ctx, p.NewIncompleteKey(ctx, "Foo", nil), &foo); err == nil {
+		t.Errorf("Put, shouldn't have retried with an incomplete key")
+	}
+	fp.calls = 0
+	if _,err := rp.Put(ctx, k, &foo); err != nil || rp.RetryCounts()["Put"] != 1 {
+		t.Errorf("Put, expected one retry: %v, %v", err, rp.RetryCounts())
+	}
+
+	// Backoffs that would overrun the deadline aren't attempted
+	fp = &flakyProvider{DatastoreProvider:p, n:5, err:unavailable}
+	rp = NewRetryingProvider(fp, &RetryOptions{MaxAttempts:10, InitialBackoff:time.Hour})
+	dctx,cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := rp.Get(dctx, k, &foo); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Get, expected a quick failure; got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestRetryingProviderPerKey(t *testing.T) {
+	p,root := newTestProvider(t)
+	opts := &RetryOptions{MaxAttempts:3, InitialBackoff:time.Millisecond}
+	keyers := []Keyer{}
+	for i:=0; i<5; i++ {
+		keyers = append(keyers, p.NewIDKey(ctx, "Foo", int64(100+i), root))
+	}
+	unavailable := status.Error(codes.Unavailable, "try again")
+	invalid := status.Error(codes.InvalidArgument, "nope")
+
+	// Only the key with the transient error is fetched again
+	kp := &keyFlakyProvider{DatastoreProvider:p, bad:map[string]error{keyers[3].Encode():unavailable}}
+	rp := NewRetryingProvider(kp, opts)
+	foos := make([]Foo, len(keyers))
+	if err := rp.GetMulti(ctx, keyers, foos); err != nil {
+		t.Errorf("GetMulti: %v", err)
+	} else if len(kp.calls) != 2 || len(kp.calls[1]) != 1 || kp.calls[1][0].Encode() != keyers[3].Encode() {
+		t.Errorf("GetMulti, expected a retry of just keyers[3], got calls %v", kp.calls)
+	} else if foos[3].I != 3 || foos[3].S != "bar" || foos[4].I != 4 {
+		t.Errorf("GetMulti, results not loaded into the right slots: %+v", foos)
+	}
+
+	// A permanent error in one slot is kept, alongside the retried slot succeeding
+	kp = &keyFlakyProvider{DatastoreProvider:p, bad:map[string]error{
+		keyers[1].Encode():invalid, keyers[2].Encode():unavailable,
+	}}
+	rp = NewRetryingProvider(kp, opts)
+	err := rp.DeleteMulti(ctx, keyers)
+	if me,isMulti := err.(MultiError); !isMulti || len(me) != 5 || me[1] != invalid || me[2] != nil {
+		t.Errorf("DeleteMulti, expected only keyers[1] to fail, got %v", err)
+	} else if len(kp.calls) != 2 || len(kp.calls[1]) != 1 || kp.calls[1][0].Encode() != keyers[2].Encode() {
+		t.Errorf("DeleteMulti, expected a retry of just keyers[2], got calls %v", kp.calls)
+	}
+	if n,_ := p.Count(ctx, NewQuery("Foo")); n != 1 {
+		t.Errorf("DeleteMulti, expected just keyers[1] to remain, but %d Foos do", n)
+	}
+}
@@ -0,0 +1,240 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+
+ // Append some CSV rows to today's log, creating it if need be
+ w := c.NewAppender(ctx, "mybucket", "logs/2020-01-01.csv", gcs.WithContentType("text/csv"))
+ fmt.Fprintf(w, "%s,%d\n", callsign, alt)
+ if err := w.Close(); err != nil { ... }  // The data is only appended if this is nil
+
+ // Or, in one go
+ err := c.Append(ctx, "mybucket", "logs/2020-01-01.csv", []byte("UAL123,4500\n"))
+
+ // Rewrite a (smallish) object, without losing anyone else's concurrent changes
+ err := c.ReadModifyWrite(ctx, "mybucket", "state.json", func(old []byte) ([]byte, error) {
+   ... old is nil if the object doesn't exist yet ...
+   return new, nil
+ })
+
+ */
+
+// GCS won't compose an object out of more than 1024 components, and each append adds one; so
+// an object can only be appended to about a thousand times. Roll over to new objects (e.g.
+// one per day) well before then.
+const maxComponents = 1024
+
+var ErrTooManyAppends = errors.New("gcs: object has too many components to append to")
+
+// How many times to try a conditional write, if other writers keep getting there first.
+const preconditionAttempts = 10
+
+// Appender appends to an object, which it creates if need be. Writes go to a temporary
+// object; Close then composes the temporary object onto the end of the real one, with a
+// generation precondition, so that concurrent appends don't clobber each other (it retries if
+// the object changed under it). The content options only apply if Close creates the object.
+// WithGenerationMatch makes the append conditional on the object's generation (zero meaning it
+// must not exist yet); if that doesn't hold, Close fails without retrying.
+type Appender struct {
+	c                *Client
+	ctx               context.Context
+	bucket, object    string
+	temp              string
+	cfg               objectConfig
+	w                *storage.Writer
+}
+
+func (c *Client)NewAppender(ctx context.Context, bucket, object string, opts ...ObjectOption) *Appender {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	a := Appender{
+		c: c,
+		ctx: ctx,
+		bucket: bucket,
+		object: object,
+		temp: fmt.Sprintf("%s.append-%s", object, hex.EncodeToString(suffix)),
+		cfg: newObjectConfig(opts...),
+	}
+	// Any precondition is for the real object; the temporary object just needs to be written.
+	a.w = c.NewWriter(ctx, bucket, a.temp, append(opts, withoutGenerationMatch())...)
+	return &a
+}
+
+func withoutGenerationMatch() ObjectOption {
+	return func(cfg *objectConfig) { cfg.genMatch = nil }
+}
+
+// Append appends data to the object.
+func (c *Client)Append(ctx context.Context, bucket, object string, data []byte, opts ...ObjectOption) error {
+	ctx,cancel := context.WithCancel(ctx) // Cancelling abandons the temporary object
+	defer cancel()
+	a := c.NewAppender(ctx, bucket, object, opts...)
+	if _,err := a.Write(data); err != nil {
+		cancel()
+		a.w.Close()
+		return fmt.Errorf("gcs.Append: gs://%s/%s: %w", bucket, object, err)
+	}
+	return a.Close()
+}
+
+func (a *Appender)Write(p []byte) (int, error) {
+	return a.w.Write(p)
+}
+
+// Close finishes writing the temporary object, appends it, and deletes it.
+func (a *Appender)Close() error {
+	if err := a.w.Close(); err != nil {
+		return fmt.Errorf("gcs.Append: gs://%s/%s: writing: %w", a.bucket, a.temp, err)
+	}
+	defer a.c.Bucket(a.bucket).Object(a.temp).Delete(a.ctx)
+
+	if a.w.Attrs().Size == 0 {
+		return nil // Nothing to append
+	}
+
+	var err error
+	if a.cfg.genMatch != nil {
+		err = a.compose() // The caller's precondition won't be any truer next time
+	} else {
+		err = retryOnPrecondition(a.ctx, a.compose)
+	}
+	if err != nil {
+		return fmt.Errorf("gcs.Append: gs://%s/%s: %w", a.bucket, a.object, err)
+	}
+	return nil
+}
+
+// compose makes one attempt to append the temporary object.
+func (a *Appender)compose() error {
+	b := a.c.Bucket(a.bucket)
+	dst := b.Object(a.object)
+	tmp := b.Object(a.temp)
+
+	attrs,err := dst.Attrs(a.ctx)
+	if err == storage.ErrObjectNotExist {
+		if a.cfg.genMatch != nil && *a.cfg.genMatch != 0 {
+			return ErrPreconditionFailed
+		}
+		// First one in; the temporary object becomes the whole thing
+		copier := dst.If(storage.Conditions{DoesNotExist:true}).CopierFrom(tmp)
+		a.cfg.apply(&copier.ObjectAttrs)
+		_,err := copier.Run(a.ctx)
+		return err
+	} else if err != nil {
+		return err
+	} else if a.cfg.genMatch != nil && *a.cfg.genMatch != attrs.Generation {
+		return ErrPreconditionFailed
+	} else if attrs.ComponentCount >= maxComponents {
+		return ErrTooManyAppends
+	}
+
+	// Pin the source to the generation we looked at, and only write if it is still current
+	composer := dst.If(storage.Conditions{GenerationMatch:attrs.Generation}).
+		ComposerFrom(dst.Generation(attrs.Generation), tmp)
+	composer.ContentType = attrs.ContentType // Otherwise compose drops these
+	composer.CacheControl = attrs.CacheControl
+	composer.Metadata = attrs.Metadata
+	_,err = composer.Run(a.ctx)
+	return err
+}
+
+// ReadModifyWrite reads the object (nil if it doesn't exist), and replaces it with whatever f
+// returns. The write has a generation precondition; if the object changed since it was read,
+// it goes round again, so f may be called more than once.
+func (c *Client)ReadModifyWrite(ctx context.Context, bucket, object string, f func(old []byte) ([]byte, error), opts ...ObjectOption) error {
+	err := retryOnPrecondition(ctx, func() error {
+		return c.readModifyWrite(ctx, bucket, object, f, opts...)
+	})
+	if err != nil {
+		return fmt.Errorf("gcs.ReadModifyWrite: gs://%s/%s: %w", bucket, object, err)
+	}
+	return nil
+}
+
+func (c *Client)readModifyWrite(ctx context.Context, bucket, object string, f func(old []byte) ([]byte, error), opts ...ObjectOption) error {
+	obj := c.Bucket(bucket).Object(object)
+	var old []byte
+	cond := storage.Conditions{DoesNotExist:true}
+
+	r,err := obj.NewReader(ctx)
+	if err == nil {
+		old,err = io.ReadAll(r)
+		r.Close()
+		cond = storage.Conditions{GenerationMatch:r.Attrs.Generation}
+	}
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+
+	data,err := f(old)
+	if err != nil {
+		return err
+	}
+
+	wctx,cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := obj.If(cond).NewWriter(wctx)
+	newObjectConfig(opts...).apply(&w.ObjectAttrs)
+	if _,err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// retryOnPrecondition calls f until it doesn't fail on a precondition, backing off a little
+// (with jitter) each time; it gives up early if ctx is done.
+func retryOnPrecondition(ctx context.Context, f func() error) error {
+	var err error
+	for i:=0; i<preconditionAttempts; i++ {
+		if err = f(); !IsPreconditionFailed(err) {
+			return err
+		}
+		jitter,_ := rand.Int(rand.Reader, big.NewInt(int64(50*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(i+1)*10*time.Millisecond + time.Duration(jitter.Int64())):
+		}
+	}
+	return err
+}
+
+// IsPreconditionFailed is true if a conditional write failed because the object had changed;
+// either from GCS itself, or an ErrPreconditionFailed from an ObjectStore.
+func IsPreconditionFailed(err error) bool {
+	if errors.Is(err, ErrPreconditionFailed) {
+		return true
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusPreconditionFailed
+	}
+	return status.Code(err) == codes.FailedPrecondition
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,185 @@
+package gcs
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryOnPrecondition(t *testing.T) {
+	calls := 0
+	conflict := func() error { calls++; return ErrPreconditionFailed }
+
+	if err := retryOnPrecondition(context.Background(), conflict); !IsPreconditionFailed(err) {
+		t.Errorf("expected a precondition failure, got %v", err)
+	} else if calls != preconditionAttempts {
+		t.Errorf("expected %d attempts, got %d", preconditionAttempts, calls)
+	}
+
+	// A cancelled context stops the retries
+	calls = 0
+	ctx,cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := retryOnPrecondition(ctx, conflict); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if calls != 1 || time.Since(start) > time.Second {
+		t.Errorf("kept retrying after cancellation: %d calls, %s", calls, time.Since(start))
+	}
+}
+
+// tempObjects lists any temporary objects that appends have left lying around.
+func (f *fakeGCS)tempObjects() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []string{}
+	for name := range f.objects {
+		if strings.Contains(name, ".append-") { out = append(out, name) }
+	}
+	return out
+}
+
+func TestAppend(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+
+	// The first append creates the object, with the options
+	if err := c.Append(ctx, "mybucket", "log.csv", []byte("a\n"), WithContentType("text/csv")); err != nil {
+		t.Fatalf("first Append: %v", err)
+	}
+	obj := f.get("mybucket", "log.csv")
+	if obj == nil || string(obj.data) != "a\n" || obj.ContentType != "text/csv" {
+		t.Errorf("first Append: got %+v", obj)
+	}
+
+	// Later ones compose onto the end, keeping the attributes
+	w := c.NewAppender(ctx, "mybucket", "log.csv")
+	fmt.Fprintf(w, "b\n")
+	fmt.Fprintf(w, "c\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Append: %v", err)
+	}
+	obj = f.get("mybucket", "log.csv")
+	if string(obj.data) != "a\nb\nc\n" || obj.ContentType != "text/csv" || obj.ComponentCount != 2 {
+		t.Errorf("second Append: got %+v, %q", obj, obj.data)
+	}
+	if temps := f.tempObjects(); len(temps) != 0 {
+		t.Errorf("temporary objects left behind: %v", temps)
+	}
+
+	// Empty appends don't touch the object
+	gen := obj.Generation
+	if err := c.NewAppender(ctx, "mybucket", "log.csv").Close(); err != nil {
+		t.Errorf("empty Append: %v", err)
+	} else if f.get("mybucket", "log.csv").Generation != gen {
+		t.Errorf("empty Append changed the object")
+	}
+
+	// Too many components
+	f.put("mybucket", "full.csv", "x\n").ComponentCount = maxComponents
+	if err := c.Append(ctx, "mybucket", "full.csv", []byte("y\n")); !errors.Is(err, ErrTooManyAppends) {
+		t.Errorf("Append to a full object: expected ErrTooManyAppends, got %v", err)
+	}
+}
+
+func TestAppendConflicts(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+
+	// Someone else creates the object just before we do; the create (which must only happen if
+	// the object doesn't exist) fails, and the retry appends to theirs.
+	sneak := func(op, object, contents string) {
+		done := false
+		f.beforeWrite = func(gotOp, name string) {
+			if !done && gotOp == op && name == object {
+				done = true
+				f.put("mybucket", object, contents)
+			}
+		}
+	}
+	sneak("rewrite", "log.csv", "theirs\n")
+	if err := c.Append(ctx, "mybucket", "log.csv", []byte("ours\n")); err != nil {
+		t.Fatalf("Append racing a create: %v", err)
+	} else if obj := f.get("mybucket", "log.csv"); string(obj.data) != "theirs\nours\n" {
+		t.Errorf("Append racing a create: got %q", obj.data)
+	} else if f.count("POST rewrite") != 1 || f.count("POST compose") != 1 {
+		t.Errorf("Append racing a create: expected a failed create, then a compose; got %v", f.requests)
+	}
+
+	// The object changes between looking at its generation and composing; the compose fails,
+	// rather than dropping their data, and the retry composes onto the new generation.
+	sneak("compose", "log.csv", "replaced\n")
+	if err := c.Append(ctx, "mybucket", "log.csv", []byte("again\n")); err != nil {
+		t.Fatalf("Append racing a write: %v", err)
+	} else if obj := f.get("mybucket", "log.csv"); string(obj.data) != "replaced\nagain\n" {
+		t.Errorf("Append racing a write: got %q", obj.data)
+	} else if f.count("POST compose") != 3 {
+		t.Errorf("Append racing a write: expected a retried compose; got %v", f.requests)
+	}
+	f.beforeWrite = nil
+
+	// The caller's own precondition applies to the real object, and isn't retried
+	gen := f.get("mybucket", "log.csv").Generation
+	if err := c.Append(ctx, "mybucket", "log.csv", []byte("pinned\n"), WithGenerationMatch(gen)); err != nil {
+		t.Errorf("Append with the current generation: %v", err)
+	}
+	composes := f.count("POST compose")
+	if err := c.Append(ctx, "mybucket", "log.csv", []byte("stale\n"), WithGenerationMatch(gen)); !IsPreconditionFailed(err) {
+		t.Errorf("Append with a stale generation: expected a precondition failure, got %v", err)
+	} else if f.count("POST compose") != composes {
+		t.Errorf("Append with a stale generation: shouldn't have tried to compose")
+	}
+	if err := c.Append(ctx, "mybucket", "new.csv", []byte("new\n"), WithGenerationMatch(0)); err != nil {
+		t.Errorf("Append creating with WithGenerationMatch(0): %v", err)
+	}
+	if temps := f.tempObjects(); len(temps) != 0 {
+		t.Errorf("temporary objects left behind: %v", temps)
+	}
+}
+
+func TestReadModifyWrite(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+
+	calls := 0
+	increment := func(old []byte) ([]byte, error) {
+		calls++
+		n := 0
+		if old != nil { fmt.Sscanf(string(old), "%d", &n) }
+		return []byte(fmt.Sprintf("%d", n+1)), nil
+	}
+
+	// Creating it, from nothing
+	if err := c.ReadModifyWrite(ctx, "mybucket", "n", increment, WithContentType("text/plain")); err != nil {
+		t.Fatalf("ReadModifyWrite create: %v", err)
+	} else if obj := f.get("mybucket", "n"); string(obj.data) != "1" || obj.ContentType != "text/plain" {
+		t.Errorf("ReadModifyWrite create: got %+v", obj)
+	}
+
+	// Someone else writes in between our read and write; we go round again, and build on theirs
+	calls = 0
+	done := false
+	f.beforeWrite = func(op, name string) {
+		if !done && op == "upload" {
+			done = true
+			f.put("mybucket", "n", "10")
+		}
+	}
+	if err := c.ReadModifyWrite(ctx, "mybucket", "n", increment); err != nil {
+		t.Fatalf("ReadModifyWrite with a conflict: %v", err)
+	} else if obj := f.get("mybucket", "n"); string(obj.data) != "11" || calls != 2 {
+		t.Errorf("ReadModifyWrite with a conflict: got %q after %d calls", obj.data, calls)
+	}
+
+	// Errors from f abort it
+	f.beforeWrite = nil
+	nope := errors.New("nope")
+	err := c.ReadModifyWrite(ctx, "mybucket", "n", func([]byte) ([]byte, error) { return nil, nope })
+	if !errors.Is(err, nope) {
+		t.Errorf("ReadModifyWrite, expected f's error, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+/*
+
+ c,err := gcs.NewClient(ctx)  // Once, at startup; it is safe for concurrent use
+ defer c.Close()
+
+ w := c.NewWriter(ctx, "mybucket", "reports/today.csv",
+   gcs.WithContentType("text/csv"),
+   gcs.WithCacheControl("no-cache"),
+   gcs.WithMetadata(map[string]string{"source":"fr24"}))
+ fmt.Fprintf(w, "...")
+ if err := w.Close(); err != nil { ... }  // IMPORTANT - the object only exists if this is nil
+
+ r,err := c.NewReader(ctx, "mybucket", "reports/today.csv")
+ defer r.Close()
+
+ attrs,err := c.Stat(ctx, "mybucket", "reports/today.csv") // err is gcs.ErrNotExist if it isn't there
+ _,err := c.Copy(ctx, "mybucket", "reports/today.csv", "archive", "reports/2020-01-01.csv")
+ _,err := c.Compose(ctx, "mybucket", "all.csv", []string{"part1.csv", "part2.csv"}, gcs.WithContentType("text/csv"))
+
+ */
+
+// ErrNotExist is returned when an object isn't there.
+var ErrNotExist = storage.ErrObjectNotExist
+
+// Client wraps a storage client, which should be built once and shared; unlike the functions
+// in gcs.go, which build a new one on every call.
+type Client struct {
+	*storage.Client
+}
+
+func NewClient(ctx context.Context, opts ...option.ClientOption) (*Client, error) {
+	c,err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.NewClient: %v", err)
+	}
+	return &Client{c}, nil
+}
+
+// {{{ ObjectOption
+
+// ObjectOption sets attributes on the objects that NewWriter, Copy and Compose create.
+type ObjectOption func(*objectConfig)
+
+type objectConfig struct {
+	contentType   string
+	cacheControl  string
+	metadata      map[string]string
+	chunkSize    *int
+	genMatch     *int64
+}
+
+func newObjectConfig(opts ...ObjectOption) objectConfig {
+	cfg := objectConfig{}
+	for _,opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+func WithContentType(ct string) ObjectOption {
+	return func(cfg *objectConfig) { cfg.contentType = ct }
+}
+
+func WithCacheControl(cc string) ObjectOption {
+	return func(cfg *objectConfig) { cfg.cacheControl = cc }
+}
+
+// WithMetadata adds custom metadata (the x-goog-meta-* headers); it can be given more than once.
+func WithMetadata(md map[string]string) ObjectOption {
+	return func(cfg *objectConfig) {
+		if cfg.metadata == nil { cfg.metadata = map[string]string{} }
+		for k,v := range md { cfg.metadata[k] = v }
+	}
+}
+
+// WithChunkSize sets how much NewWriter buffers before sending each chunk of a resumable
+// upload; zero turns resumable uploads off, and sends the object in a single request. Copy and
+// Compose ignore it.
+func WithChunkSize(n int) ObjectOption {
+	return func(cfg *objectConfig) { cfg.chunkSize = &n }
+}
+
+// WithGenerationMatch makes the write conditional: unless the object's current generation is
+// gen, it fails with an error that IsPreconditionFailed recognizes. A gen of zero means the
+// object must not exist yet.
+func WithGenerationMatch(gen int64) ObjectOption {
+	return func(cfg *objectConfig) { cfg.genMatch = &gen }
+}
+
+// conditional adds any precondition to the handle of the object being written.
+func (cfg objectConfig)conditional(obj *storage.ObjectHandle) *storage.ObjectHandle {
+	if cfg.genMatch == nil {
+		return obj
+	} else if *cfg.genMatch == 0 {
+		return obj.If(storage.Conditions{DoesNotExist:true})
+	}
+	return obj.If(storage.Conditions{GenerationMatch:*cfg.genMatch})
+}
+
+func (cfg objectConfig)apply(attrs *storage.ObjectAttrs) {
+	if cfg.contentType != ""  { attrs.ContentType = cfg.contentType }
+	if cfg.cacheControl != "" { attrs.CacheControl = cfg.cacheControl }
+	if cfg.metadata != nil    { attrs.Metadata = cfg.metadata }
+}
+
+// }}}
+
+// {{{ NewReader, NewWriter
+
+// NewReader reads the whole object; the caller must Close it.
+func (c *Client)NewReader(ctx context.Context, bucket, object string) (*storage.Reader, error) {
+	r,err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.NewReader: gs://%s/%s: %w", bucket, object, err)
+	}
+	return r, nil
+}
+
+// NewWriter creates (or replaces) the object. It only appears once Close returns nil; to
+// abandon the write, cancel ctx before calling Close.
+func (c *Client)NewWriter(ctx context.Context, bucket, object string, opts ...ObjectOption) *storage.Writer {
+	cfg := newObjectConfig(opts...)
+	w := cfg.conditional(c.Bucket(bucket).Object(object)).NewWriter(ctx)
+	cfg.apply(&w.ObjectAttrs)
+	if cfg.chunkSize != nil { w.ChunkSize = *cfg.chunkSize }
+	return w
+}
+
+// }}}
+// {{{ Stat, Exists, Delete
+
+// Stat returns the object's attributes; the error is ErrNotExist (wrapped) if it isn't there.
+func (c *Client)Stat(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	attrs,err := c.Bucket(bucket).Object(object).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.Stat: gs://%s/%s: %w", bucket, object, err)
+	}
+	return attrs, nil
+}
+
+func (c *Client)Exists(ctx context.Context, bucket, object string) (bool, error) {
+	_,err := c.Bucket(bucket).Object(object).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("gcs.Exists: gs://%s/%s: %w", bucket, object, err)
+	}
+	return true, nil
+}
+
+func (c *Client)Delete(ctx context.Context, bucket, object string) error {
+	if err := c.Bucket(bucket).Object(object).Delete(ctx); err != nil {
+		return fmt.Errorf("gcs.Delete: gs://%s/%s: %w", bucket, object, err)
+	}
+	return nil
+}
+
+// }}}
+// {{{ Copy, Compose
+
+// Copy copies an object, possibly between buckets, without downloading it. Options override
+// the attributes that would otherwise be copied from the source.
+func (c *Client)Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, opts ...ObjectOption) (*storage.ObjectAttrs, error) {
+	cfg := newObjectConfig(opts...)
+	src := c.Bucket(srcBucket).Object(srcObject)
+	copier := cfg.conditional(c.Bucket(dstBucket).Object(dstObject)).CopierFrom(src)
+	cfg.apply(&copier.ObjectAttrs)
+	attrs,err := copier.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.Copy: gs://%s/%s -> gs://%s/%s: %w", srcBucket, srcObject,
+			dstBucket, dstObject, err)
+	}
+	return attrs, nil
+}
+
+// Compose concatenates up to 32 objects from the bucket into dstObject, which may be one of
+// them.
+func (c *Client)Compose(ctx context.Context, bucket, dstObject string, srcObjects []string, opts ...ObjectOption) (*storage.ObjectAttrs, error) {
+	b := c.Bucket(bucket)
+	srcs := []*storage.ObjectHandle{}
+	for _,name := range srcObjects {
+		srcs = append(srcs, b.Object(name))
+	}
+	cfg := newObjectConfig(opts...)
+	composer := cfg.conditional(b.Object(dstObject)).ComposerFrom(srcs...)
+	cfg.apply(&composer.ObjectAttrs)
+	attrs,err := composer.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.Compose: gs://%s/%s: %w", bucket, dstObject, err)
+	}
+	return attrs, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,430 @@
+package gcs
+
+import(
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// go test -v github.com/skypies/util/gcp/gcs
+
+// {{{ fakeGCS
+
+// fakeGCS serves just enough of the JSON API (uploads, attrs, delete, rewrite and compose,
+// all with generation preconditions) and the XML API (downloads) for the Client tests. Object
+// names mustn't contain slashes.
+type fakeGCS struct {
+	mu          sync.Mutex
+	objects     map[string]*fakeObject // "bucket/object"
+	lastGen     int64
+	requests    []string               // "METHOD op", e.g. "POST compose"
+
+	// If set, called (without the lock) just before each write is checked & applied; tests use
+	// it to sneak in a conflicting write.
+	beforeWrite func(op, name string)
+}
+
+type fakeObject struct {
+	Name           string            `json:"name"`
+	Bucket         string            `json:"bucket"`
+	Size           int64             `json:"size,string"`
+	Generation     int64             `json:"generation,string"`
+	ContentType    string            `json:"contentType,omitempty"`
+	CacheControl   string            `json:"cacheControl,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	ComponentCount int64             `json:"componentCount,omitempty"`
+	data           []byte
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *Client) {
+	f := &fakeGCS{objects:map[string]*fakeObject{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	c,err := NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return f, c
+}
+
+// put writes an object directly, as if someone else had.
+func (f *fakeGCS)put(bucket, name, data string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastGen++
+	obj := &fakeObject{Name:name, Bucket:bucket, Size:int64(len(data)), Generation:f.lastGen,
+		ComponentCount:1, data:[]byte(data)}
+	f.objects[bucket+"/"+name] = obj
+	return obj
+}
+
+func (f *fakeGCS)get(bucket, name string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+name]
+}
+
+func (f *fakeGCS)count(req string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _,r := range f.requests {
+		if r == req { n++ }
+	}
+	return n
+}
+
+func fakeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, msg)
+}
+
+// ServeHTTP routes on the shape of the path; see the storage/v1 API docs.
+func (f *fakeGCS)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o")
+		f.upload(w, r, bucket)
+
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/storage/v1/b/"), "/")
+		switch {
+		case len(parts) == 3 && r.Method == "GET":
+			f.attrs(w, parts[0], parts[2])
+		case len(parts) == 3 && r.Method == "DELETE":
+			f.delete(w, parts[0], parts[2])
+		case len(parts) == 8 && parts[3] == "rewriteTo":
+			f.rewrite(w, r, parts[0], parts[2], parts[5], parts[7])
+		case len(parts) == 4 && parts[3] == "compose":
+			f.compose(w, r, parts[0], parts[2])
+		default:
+			fakeError(w, http.StatusNotFound, "unexpected path "+path)
+		}
+
+	default: // An XML API download, /bucket/object
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		if len(parts) != 2 {
+			fakeError(w, http.StatusNotFound, "unexpected path "+path)
+			return
+		}
+		f.download(w, parts[0], parts[1])
+	}
+}
+
+// checkWrite runs the beforeWrite hook, then takes the lock (which the caller must release),
+// and checks any ifGenerationMatch precondition against the current object.
+func (f *fakeGCS)checkWrite(w http.ResponseWriter, r *http.Request, op, bucket, name string) bool {
+	if f.beforeWrite != nil {
+		f.beforeWrite(op, name)
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+op)
+
+	genMatch := r.URL.Query().Get("ifGenerationMatch")
+	if genMatch == "" {
+		return true
+	}
+	want,_ := strconv.ParseInt(genMatch, 10, 64)
+	current := int64(0)
+	if obj,exists := f.objects[bucket+"/"+name]; exists {
+		current = obj.Generation
+	}
+	if current != want {
+		fakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return false
+	}
+	return true
+}
+
+// store must be called with the lock held.
+func (f *fakeGCS)store(w http.ResponseWriter, obj *fakeObject) {
+	f.lastGen++
+	obj.Generation = f.lastGen
+	obj.Size = int64(len(obj.data))
+	f.objects[obj.Bucket+"/"+obj.Name] = obj
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeGCS)upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		fakeError(w, http.StatusBadRequest, "only multipart uploads are faked")
+		return
+	}
+	_,params,err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	obj := &fakeObject{Bucket:bucket, ComponentCount:1}
+	if part,err := mr.NextPart(); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err := json.NewDecoder(part).Decode(obj); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if part,err := mr.NextPart(); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if obj.data,err = io.ReadAll(part); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !f.checkWrite(w, r, "upload", bucket, obj.Name) {
+		f.mu.Unlock()
+		return
+	}
+	defer f.mu.Unlock()
+	f.store(w, obj)
+}
+
+func (f *fakeGCS)attrs(w http.ResponseWriter, bucket, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj,exists := f.objects[bucket+"/"+name]
+	if !exists {
+		fakeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeGCS)delete(w http.ResponseWriter, bucket, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _,exists := f.objects[bucket+"/"+name]; !exists {
+		fakeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	delete(f.objects, bucket+"/"+name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGCS)download(w http.ResponseWriter, bucket, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj,exists := f.objects[bucket+"/"+name]
+	if !exists {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Write(obj.data)
+}
+
+func (f *fakeGCS)rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, bucket, name string) {
+	override := fakeObject{}
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil && err != io.EOF {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !f.checkWrite(w, r, "rewrite", bucket, name) {
+		f.mu.Unlock()
+		return
+	}
+	defer f.mu.Unlock()
+
+	src,exists := f.objects[srcBucket+"/"+srcName]
+	if !exists {
+		fakeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	obj := *src
+	obj.Bucket, obj.Name = bucket, name
+	if override.ContentType != ""  { obj.ContentType = override.ContentType }
+	if override.CacheControl != "" { obj.CacheControl = override.CacheControl }
+	if override.Metadata != nil     { obj.Metadata = override.Metadata }
+
+	rec := httptest.NewRecorder()
+	f.store(rec, &obj)
+	fmt.Fprintf(w, `{"done":true,"totalBytesRewritten":"%d","objectSize":"%d","resource":%s}`,
+		obj.Size, obj.Size, rec.Body.String())
+}
+
+func (f *fakeGCS)compose(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	req := struct {
+		Destination   fakeObject
+		SourceObjects []struct {
+			Name       string
+			Generation int64 `json:",string"`
+		}
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !f.checkWrite(w, r, "compose", bucket, name) {
+		f.mu.Unlock()
+		return
+	}
+	defer f.mu.Unlock()
+
+	obj := req.Destination
+	obj.Bucket, obj.Name = bucket, name
+	for _,s := range req.SourceObjects {
+		src,exists := f.objects[bucket+"/"+s.Name]
+		if !exists || (s.Generation != 0 && s.Generation != src.Generation) {
+			fakeError(w, http.StatusNotFound, "no such source object "+s.Name)
+			return
+		}
+		obj.data = append(obj.data, src.data...)
+		obj.ComponentCount += src.ComponentCount
+	}
+	f.store(w, &obj)
+}
+
+// }}}
+
+func TestClientWriterOptions(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+
+	w := c.NewWriter(ctx, "mybucket", "today.csv", WithContentType("text/csv"),
+		WithCacheControl("no-cache"), WithMetadata(map[string]string{"a":"1"}),
+		WithMetadata(map[string]string{"b":"2"}), WithChunkSize(0))
+	if w.ChunkSize != 0 {
+		t.Errorf("NewWriter: WithChunkSize(0) not applied, got %d", w.ChunkSize)
+	}
+	fmt.Fprintf(w, "a,b\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("NewWriter, Close: %v", err)
+	}
+
+	obj := f.get("mybucket", "today.csv")
+	if obj == nil || string(obj.data) != "a,b\n" || obj.ContentType != "text/csv" ||
+		obj.CacheControl != "no-cache" || obj.Metadata["a"] != "1" || obj.Metadata["b"] != "2" {
+		t.Errorf("NewWriter: options not applied, got %+v", obj)
+	}
+
+	r,err := c.NewReader(ctx, "mybucket", "today.csv")
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	b,_ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "a,b\n" || r.Attrs.Generation != obj.Generation {
+		t.Errorf("NewReader: got %q, gen %d", b, r.Attrs.Generation)
+	}
+}
+
+func TestClientConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+
+	write := func(contents string, opts ...ObjectOption) error {
+		w := c.NewWriter(ctx, "mybucket", "state.json", opts...)
+		io.WriteString(w, contents)
+		return w.Close()
+	}
+
+	if err := write("1", WithGenerationMatch(0)); err != nil {
+		t.Fatalf("create with WithGenerationMatch(0): %v", err)
+	}
+	if err := write("2", WithGenerationMatch(0)); !IsPreconditionFailed(err) {
+		t.Errorf("second create: expected a precondition failure, got %v", err)
+	}
+	gen := f.get("mybucket", "state.json").Generation
+	if err := write("3", WithGenerationMatch(gen+1)); !IsPreconditionFailed(err) {
+		t.Errorf("write with stale generation: expected a precondition failure, got %v", err)
+	}
+	if err := write("4", WithGenerationMatch(gen)); err != nil {
+		t.Errorf("write with current generation: %v", err)
+	} else if obj := f.get("mybucket", "state.json"); string(obj.data) != "4" {
+		t.Errorf("write with current generation: got %q", obj.data)
+	}
+}
+
+func TestClientStat(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+	f.put("mybucket", "there", "abc")
+
+	if attrs,err := c.Stat(ctx, "mybucket", "there"); err != nil || attrs.Size != 3 {
+		t.Errorf("Stat: %v, %+v", err, attrs)
+	}
+	if _,err := c.Stat(ctx, "mybucket", "nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat of missing object: expected ErrNotExist, got %v", err)
+	} else if !strings.Contains(err.Error(), "gs://mybucket/nope") {
+		t.Errorf("Stat of missing object: error should name the object, got %v", err)
+	}
+	if _,err := c.NewReader(ctx, "mybucket", "nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("NewReader of missing object: expected ErrNotExist, got %v", err)
+	}
+
+	if exists,err := c.Exists(ctx, "mybucket", "there"); !exists || err != nil {
+		t.Errorf("Exists: %v, %v", exists, err)
+	}
+	if exists,err := c.Exists(ctx, "mybucket", "nope"); exists || err != nil {
+		t.Errorf("Exists of missing object: %v, %v", exists, err)
+	}
+
+	if err := c.Delete(ctx, "mybucket", "there"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := c.Delete(ctx, "mybucket", "there"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("second Delete: expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestClientCopyCompose(t *testing.T) {
+	ctx := context.Background()
+	f,c := newFakeGCS(t)
+	part1 := f.put("mybucket", "part1", "abc")
+	part1.ContentType = "text/plain"
+	f.put("mybucket", "part2", "def")
+
+	attrs,err := c.Copy(ctx, "mybucket", "part1", "archive", "copy", WithCacheControl("no-cache"))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	obj := f.get("archive", "copy")
+	if obj == nil || string(obj.data) != "abc" || obj.ContentType != "text/plain" ||
+		obj.CacheControl != "no-cache" || attrs.Generation != obj.Generation {
+		t.Errorf("Copy: got %+v, attrs %+v", obj, attrs)
+	}
+	if _,err := c.Copy(ctx, "mybucket", "part1", "archive", "copy", WithGenerationMatch(0)); !IsPreconditionFailed(err) {
+		t.Errorf("conditional Copy: expected a precondition failure, got %v", err)
+	}
+
+	attrs,err = c.Compose(ctx, "mybucket", "all", []string{"part1", "part2"}, WithContentType("text/csv"))
+	if err != nil {
+		t.Fatalf("Compose: %v", err)
+	}
+	obj = f.get("mybucket", "all")
+	if obj == nil || string(obj.data) != "abcdef" || obj.ContentType != "text/csv" ||
+		attrs.ComponentCount != 2 {
+		t.Errorf("Compose: got %+v, attrs %+v", obj, attrs)
+	}
+	if _,err := c.Compose(ctx, "mybucket", "all", []string{"nope"}); err == nil ||
+		!strings.Contains(err.Error(), "gcs.Compose: gs://mybucket/all") {
+		t.Errorf("Compose of missing object: got %v", err)
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -42,6 +42,7 @@ func (h *RWHandle)IOWriter() io.Writer {
 	return io.Writer(h.Writer)
 }
 
+// Deprecated: builds a new storage client every time; use Client.Exists.
 func Exists(ctx context.Context, bucketname string, filename string) (bool,error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -64,6 +65,8 @@ func Exists(ctx context.Context, bucketname string, filename string) (bool,error
 }
 
 // OpenBucket returns a handle that can read a bucket, but the bucket must already exist.
+//
+// Deprecated: builds a new storage client every time; use a Client.
 func ListBucket(ctx context.Context, bucketname string) ([]string, error) {
 	contents := []string{}
 
@@ -88,7 +91,10 @@ func ListBucket(ctx context.Context, bucketname string) ([]string, error) {
 	return contents, nil
 }
 
-// This appears to truncate contents :/
+// The writer replaces the object, so anything in the reader is lost unless written back out
+// again. To add to the end of an object, use Client.NewAppender (or Client.ReadModifyWrite).
+//
+// Deprecated: use Client.NewReader and Client.NewAppender.
 func OpenRW(ctx context.Context, bucketname string, filename string, contentType string) (*RWHandle, error) {
 	handle := RWHandle{}
 	if c, err := storage.NewClient(ctx); err != nil {
@@ -118,6 +124,31 @@ func OpenRW(ctx context.Context, bucketname string, filename string, contentType
 }
 
 
+// OpenW returns a handle for writing a new object (or replacing an existing one); the object
+// only appears when Close returns nil. Cancel ctx before calling Close to abandon the write.
+//
+// Deprecated: use Client.NewWriter.
+func OpenW(ctx context.Context, bucketname string, filename string, contentType string) (*RWHandle, error) {
+	handle := RWHandle{}
+	if c, err := storage.NewClient(ctx); err != nil {
+		return nil, err
+	} else {
+		handle.Client = c
+	}
+
+	bucket := handle.Client.Bucket(bucketname)
+	if bucket == nil {
+		return nil, fmt.Errorf("GCS client.Bucket() was nil")
+	}
+
+	handle.Writer = bucket.Object(filename).NewWriter(ctx)
+	handle.Writer.ContentType = contentType
+
+	return &handle, nil
+}
+
+
+// Deprecated: use Client.NewReader.
 func OpenR(ctx context.Context, bucketname string, filename string) (*RWHandle, error) {
 	handle := RWHandle{}
 	if c, err := storage.NewClient(ctx); err != nil {
@@ -0,0 +1,108 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+/*
+
+ // A page at a time; pass the token back in to get the next page (e.g. in a later request)
+ opts := &gcs.ListOptions{Prefix:"logs/2020-", Delimiter:"/", PageSize:100}
+ for {
+   page,err := c.List(ctx, "mybucket", opts)
+   ...
+   for _,attrs := range page.Objects { fmt.Printf("%s: %d bytes\n", attrs.Name, attrs.Size) }
+   for _,dir := range page.Prefixes { fmt.Printf("%s (dir)\n", dir) }
+   if page.NextPageToken == "" { break }
+   opts.PageToken = page.NextPageToken
+ }
+
+ // Or stream the whole lot, without holding it all in memory
+ for attrs,err := range c.Objects(ctx, "mybucket", &gcs.ListOptions{Prefix:"logs/"}) {
+   if err != nil { ... }
+   ...
+ }
+
+ */
+
+// ListOptions controls List and Objects; nil lists everything in the bucket.
+type ListOptions struct {
+	Prefix      string // Only objects whose names start with this
+	Delimiter   string // E.g. "/"; objects with it in their name after the prefix are rolled up into pseudo-directories
+	PageSize    int    // For List; defaults to 1000, which is also the most GCS will return
+	PageToken   string // From an earlier ListPage, to carry on from there
+}
+
+func (opts *ListOptions)query() *storage.Query {
+	if opts == nil { return &storage.Query{} }
+	return &storage.Query{Prefix:opts.Prefix, Delimiter:opts.Delimiter}
+}
+
+// ListPage is one page of listing results.
+type ListPage struct {
+	Objects       []*storage.ObjectAttrs // Size, Updated, Generation, MD5, Metadata, etc.
+	Prefixes      []string               // Pseudo-directories, if there was a delimiter
+	NextPageToken   string               // Empty if this is the last page
+}
+
+// List returns one page of the objects (and pseudo-directories) in the bucket.
+func (c *Client)List(ctx context.Context, bucket string, opts *ListOptions) (*ListPage, error) {
+	pageSize, token := 1000, ""
+	if opts != nil {
+		if opts.PageSize > 0 { pageSize = opts.PageSize }
+		token = opts.PageToken
+	}
+
+	it := c.Bucket(bucket).Objects(ctx, opts.query())
+	results := []*storage.ObjectAttrs{}
+	next,err := iterator.NewPager(it, pageSize, token).NextPage(&results)
+	if err != nil {
+		return nil, fmt.Errorf("gcs.List: gs://%s: %w", bucket, err)
+	}
+
+	page := ListPage{Objects:[]*storage.ObjectAttrs{}, Prefixes:[]string{}, NextPageToken:next}
+	for _,attrs := range results {
+		if attrs.Prefix != "" {
+			page.Prefixes = append(page.Prefixes, attrs.Prefix)
+		} else {
+			page.Objects = append(page.Objects, attrs)
+		}
+	}
+	return &page, nil
+}
+
+// Objects streams everything List would return, across all the pages. Pseudo-directories
+// turn up as attrs with only Prefix set. It stops after the first error.
+func (c *Client)Objects(ctx context.Context, bucket string, opts *ListOptions) iter.Seq2[*storage.ObjectAttrs, error] {
+	return func(yield func(*storage.ObjectAttrs, error) bool) {
+		it := c.Bucket(bucket).Objects(ctx, opts.query())
+		if opts != nil {
+			it.PageInfo().Token = opts.PageToken
+		}
+		for {
+			attrs,err := it.Next()
+			if err == iterator.Done {
+				return
+			} else if err != nil {
+				yield(nil, fmt.Errorf("gcs.Objects: gs://%s: %w", bucket, err))
+				return
+			}
+			if !yield(attrs, nil) {
+				return
+			}
+		}
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,114 @@
+package gcs
+
+import(
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// go test -v github.com/skypies/util/gcp/gcs
+
+// fakeListServer serves the JSON API's object listing, for the names given.
+func fakeListServer(t *testing.T, names []string) *Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/b/mybucket/o") {
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		prefix, delim := q.Get("prefix"), q.Get("delimiter")
+		start,_ := strconv.Atoi(q.Get("pageToken"))
+		max,_ := strconv.Atoi(q.Get("maxResults"))
+		if max == 0 { max = 1000 }
+
+		// Gather the objects & prefixes, in order, then page through them
+		entries := []map[string]interface{}{}
+		seen := map[string]bool{}
+		for _,name := range names {
+			if !strings.HasPrefix(name, prefix) { continue }
+			rest := name[len(prefix):]
+			if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+				dir := prefix + rest[:i+len(delim)]
+				if !seen[dir] { entries = append(entries, map[string]interface{}{"prefix":dir}) }
+				seen[dir] = true
+				continue
+			}
+			entries = append(entries, map[string]interface{}{"name":name, "size":"3", "generation":"7"})
+		}
+		resp := map[string]interface{}{}
+		items, prefixes := []interface{}{}, []string{}
+		for i:=start; i<len(entries) && i<start+max; i++ {
+			if dir,isDir := entries[i]["prefix"].(string); isDir {
+				prefixes = append(prefixes, dir)
+			} else {
+				items = append(items, entries[i])
+			}
+		}
+		resp["items"], resp["prefixes"] = items, prefixes
+		if start+max < len(entries) { resp["nextPageToken"] = strconv.Itoa(start+max) }
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	c,err := NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	c := fakeListServer(t, []string{"a.txt", "logs/1.csv", "logs/2.csv", "logs/old/1.csv", "z.txt"})
+
+	page,err := c.List(ctx, "mybucket", &ListOptions{Delimiter:"/"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(page.Objects) != 2 || page.Objects[0].Name != "a.txt" || page.Objects[0].Size != 3 ||
+		page.Objects[0].Generation != 7 {
+		t.Errorf("List: unexpected objects %v", page.Objects)
+	}
+	if len(page.Prefixes) != 1 || page.Prefixes[0] != "logs/" || page.NextPageToken != "" {
+		t.Errorf("List: unexpected prefixes %v, token %q", page.Prefixes, page.NextPageToken)
+	}
+
+	// Page through a prefix, two at a time
+	opts := &ListOptions{Prefix:"logs/", PageSize:2}
+	names := []string{}
+	for pages:=1; ; pages++ {
+		page,err := c.List(ctx, "mybucket", opts)
+		if err != nil {
+			t.Fatalf("List page %d: %v", pages, err)
+		}
+		for _,attrs := range page.Objects { names = append(names, attrs.Name) }
+		if page.NextPageToken == "" {
+			if pages != 2 { t.Errorf("expected 2 pages, got %d", pages) }
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	if strings.Join(names, ",") != "logs/1.csv,logs/2.csv,logs/old/1.csv" {
+		t.Errorf("paged List: got %v", names)
+	}
+
+	// The iterator, stopping early
+	names = []string{}
+	for attrs,err := range c.Objects(ctx, "mybucket", nil) {
+		if err != nil {
+			t.Fatalf("Objects: %v", err)
+		}
+		names = append(names, attrs.Name)
+		if len(names) == 4 { break }
+	}
+	if strings.Join(names, ",") != "a.txt,logs/1.csv,logs/2.csv,logs/old/1.csv" {
+		t.Errorf("Objects: got %v", names)
+	}
+}
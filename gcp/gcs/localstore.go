@@ -0,0 +1,307 @@
+package gcs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// LocalStore is an ObjectStore that keeps objects as files under a directory, for dev servers;
+// gs://bucket/a/b.txt lives at <dir>/bucket/a/b.txt. The attributes (generation, content type,
+// etc) live alongside, under <dir>/.gcsmeta/. Files put there by other means show up too, with
+// their modification time as their generation.
+//
+// Preconditions are only enforced between writers in the same process. As on a filesystem, an
+// object can't have the same name as a "directory" of other objects (e.g. "a" and "a/b").
+type LocalStore struct {
+	dir       string
+	mu        sync.Mutex
+	lastGen   int64
+}
+
+const(
+	localMetaDir = ".gcsmeta"
+	localTempPrefix = ".gcswrite-"
+)
+
+// localMeta is what we keep in the .gcsmeta files.
+type localMeta struct {
+	Generation    int64             `json:"generation"`
+	ContentType   string            `json:"contentType,omitempty"`
+	CacheControl  string            `json:"cacheControl,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	MD5         []byte              `json:"md5,omitempty"`
+	CRC32C        uint32            `json:"crc32c"`
+	Created       time.Time         `json:"created"`
+}
+
+// NewLocalStore uses dir, which is created if need be.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("gcs.NewLocalStore: %v", err)
+	}
+	return &LocalStore{dir:dir}, nil
+}
+
+// {{{ paths, attrs
+
+// paths returns where the object's file and metadata live, refusing names that would escape
+// the directory.
+func (s *LocalStore)paths(bucket, object string) (string, string, error) {
+	if bucket == "" || bucket == localMetaDir || strings.ContainsAny(bucket, `/\`) ||
+		bucket == "." || bucket == ".." {
+		return "", "", fmt.Errorf("gcs.LocalStore: bad bucket name %q", bucket)
+	}
+	for _,elem := range strings.Split(object, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.HasPrefix(elem, localTempPrefix) {
+			return "", "", fmt.Errorf("gcs.LocalStore: bad object name %q", object)
+		}
+	}
+	rel := filepath.Join(bucket, filepath.FromSlash(object))
+	return filepath.Join(s.dir, rel), filepath.Join(s.dir, localMetaDir, rel + ".json"), nil
+}
+
+// attrs must be called with the lock held; the error wraps ErrNotExist if there's no object.
+func (s *LocalStore)attrs(op, bucket, object string) (*storage.ObjectAttrs, error) {
+	path,metaPath,err := s.paths(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	fi,err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, notExist(op, bucket, object)
+	} else if err != nil {
+		return nil, err
+	}
+
+	attrs := storage.ObjectAttrs{
+		Bucket: bucket,
+		Name: object,
+		Size: fi.Size(),
+		Generation: fi.ModTime().UnixMicro(),
+		Metageneration: 1,
+		Created: fi.ModTime(),
+		Updated: fi.ModTime(),
+	}
+	if b,err := os.ReadFile(metaPath); err == nil {
+		meta := localMeta{}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, fmt.Errorf("gcs.LocalStore: %s: %v", metaPath, err)
+		}
+		attrs.Generation = meta.Generation
+		attrs.ContentType = meta.ContentType
+		attrs.CacheControl = meta.CacheControl
+		attrs.Metadata = meta.Metadata
+		attrs.MD5 = meta.MD5
+		attrs.CRC32C = meta.CRC32C
+		attrs.Created = meta.Created
+	}
+	return &attrs, nil
+}
+
+// }}}
+
+func (s *LocalStore)NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs,err := s.attrs("NewReader", bucket, object)
+	if err != nil {
+		return nil, nil, err
+	}
+	path,_,_ := s.paths(bucket, object)
+	f,err := os.Open(path) // Writes rename over the file, so this stays at this generation
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, attrs, nil
+}
+
+func (s *LocalStore)Stat(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attrs("Stat", bucket, object)
+}
+
+func (s *LocalStore)Delete(ctx context.Context, bucket, object string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _,err := s.attrs("Delete", bucket, object); err != nil {
+		return err
+	}
+	path,metaPath,_ := s.paths(bucket, object)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore)List(ctx context.Context, bucket string, opts *ListOptions) (*ListPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root := filepath.Join(s.dir, bucket)
+	objs := []*storage.ObjectAttrs{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == root {
+			return fs.SkipAll // No bucket, so no objects
+		} else if err != nil {
+			return err
+		} else if d.IsDir() || strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+		rel,err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		attrs,err := s.attrs("List", bucket, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		objs = append(objs, attrs)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gcs.List: gs://%s: %v", bucket, err)
+	}
+
+	sortByName(objs)
+	return listObjects(objs, opts)
+}
+
+// {{{ localWriter
+
+func (s *LocalStore)NewWriter(ctx context.Context, bucket, object string, opts ...ObjectOption) io.WriteCloser {
+	w := localWriter{s:s, ctx:ctx, bucket:bucket, object:object, cfg:newObjectConfig(opts...)}
+	path,_,err := s.paths(bucket, object)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		w.f,err = os.CreateTemp(filepath.Dir(path), localTempPrefix + "*")
+	}
+	w.err = err
+	return &w
+}
+
+// localWriter writes to a temporary file, which Close renames into place.
+type localWriter struct {
+	s              *LocalStore
+	ctx             context.Context
+	bucket, object  string
+	cfg             objectConfig
+	f              *os.File
+	err             error // Sticky; reported by Write & Close
+	closed          bool
+}
+
+func (w *localWriter)Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n,err := w.f.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *localWriter)Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.f == nil {
+		return w.err
+	}
+	defer os.Remove(w.f.Name()) // Fails harmlessly if it was renamed into place
+
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err == nil {
+		w.err = w.ctx.Err() // Abandoned ?
+	}
+	if w.err == nil {
+		w.err = w.commit()
+	}
+	return w.err
+}
+
+func (w *localWriter)commit() error {
+	data,err := os.ReadFile(w.f.Name())
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := int64(0)
+	if attrs,err := s.attrs("NewWriter", w.bucket, w.object); err == nil {
+		current = attrs.Generation
+	} else if !errors.Is(err, ErrNotExist) {
+		return err
+	}
+	if err := checkGeneration(w.cfg, w.bucket, w.object, current); err != nil {
+		return err
+	}
+
+	// Generations look like timestamps, but always go up
+	gen := time.Now().UnixMicro()
+	if gen <= s.lastGen { gen = s.lastGen + 1 }
+	if gen <= current { gen = current + 1 }
+	s.lastGen = gen
+
+	attrs := storage.ObjectAttrs{}
+	w.cfg.apply(&attrs)
+	meta := localMeta{
+		Generation: gen,
+		ContentType: attrs.ContentType,
+		CacheControl: attrs.CacheControl,
+		Metadata: attrs.Metadata,
+		MD5: sum[:],
+		CRC32C: crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+		Created: time.Now(),
+	}
+	b,err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	path,metaPath,_ := s.paths(w.bucket, w.object)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(w.f.Name(), path); err != nil {
+		return fmt.Errorf("gcs.LocalStore: gs://%s/%s: %v", w.bucket, w.object, err)
+	}
+	return os.WriteFile(metaPath, b, 0644)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
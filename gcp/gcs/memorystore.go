@@ -0,0 +1,173 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// MemoryStore is an ObjectStore that keeps everything in memory, for tests. Buckets spring
+// into existence when first written to. Each write gets a new, higher, generation, as in GCS.
+type MemoryStore struct {
+	mu        sync.Mutex
+	objects   map[string]map[string]*memObject // bucket -> name -> object
+	lastGen   int64
+}
+
+type memObject struct {
+	data   []byte
+	attrs *storage.ObjectAttrs
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects:map[string]map[string]*memObject{}}
+}
+
+// nextGeneration must be called with the lock held. Like GCS, generations look like
+// timestamps; but they always go up.
+func (s *MemoryStore)nextGeneration() int64 {
+	gen := time.Now().UnixMicro()
+	if gen <= s.lastGen { gen = s.lastGen + 1 }
+	s.lastGen = gen
+	return gen
+}
+
+func (s *MemoryStore)get(bucket, object string) *memObject {
+	if b,exists := s.objects[bucket]; exists {
+		return b[object]
+	}
+	return nil
+}
+
+func (s *MemoryStore)NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.get(bucket, object)
+	if obj == nil {
+		return nil, nil, notExist("NewReader", bucket, object)
+	}
+	// Writes replace obj.data, rather than changing it, so this is safe to hand out
+	return io.NopCloser(bytes.NewReader(obj.data)), copyAttrs(obj.attrs), nil
+}
+
+func (s *MemoryStore)Stat(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.get(bucket, object)
+	if obj == nil {
+		return nil, notExist("Stat", bucket, object)
+	}
+	return copyAttrs(obj.attrs), nil
+}
+
+func (s *MemoryStore)Delete(ctx context.Context, bucket, object string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(bucket, object) == nil {
+		return notExist("Delete", bucket, object)
+	}
+	delete(s.objects[bucket], object)
+	return nil
+}
+
+func (s *MemoryStore)List(ctx context.Context, bucket string, opts *ListOptions) (*ListPage, error) {
+	s.mu.Lock()
+	objs := []*storage.ObjectAttrs{}
+	for _,obj := range s.objects[bucket] {
+		objs = append(objs, copyAttrs(obj.attrs))
+	}
+	s.mu.Unlock()
+
+	sortByName(objs)
+	return listObjects(objs, opts)
+}
+
+// {{{ memWriter
+
+func (s *MemoryStore)NewWriter(ctx context.Context, bucket, object string, opts ...ObjectOption) io.WriteCloser {
+	return &memWriter{s:s, ctx:ctx, bucket:bucket, object:object, cfg:newObjectConfig(opts...)}
+}
+
+type memWriter struct {
+	s              *MemoryStore
+	ctx             context.Context
+	bucket, object  string
+	cfg             objectConfig
+	buf             bytes.Buffer
+	err             error // Sticky; reported by Write & Close
+	closed          bool
+}
+
+func (w *memWriter)Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter)Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err == nil {
+		w.err = w.ctx.Err() // Abandoned ?
+	}
+	if w.err == nil {
+		w.err = w.commit()
+	}
+	return w.err
+}
+
+func (w *memWriter)commit() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	current := int64(0)
+	if obj := w.s.get(w.bucket, w.object); obj != nil {
+		current = obj.attrs.Generation
+	}
+	if err := checkGeneration(w.cfg, w.bucket, w.object, current); err != nil {
+		return err
+	}
+
+	data := w.buf.Bytes()
+	sum := md5.Sum(data)
+	now := time.Now()
+	attrs := storage.ObjectAttrs{
+		Bucket: w.bucket,
+		Name: w.object,
+		Size: int64(len(data)),
+		MD5: sum[:],
+		CRC32C: crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+		Generation: w.s.nextGeneration(),
+		Metageneration: 1,
+		Created: now,
+		Updated: now,
+	}
+	w.cfg.apply(&attrs)
+
+	if w.s.objects[w.bucket] == nil {
+		w.s.objects[w.bucket] = map[string]*memObject{}
+	}
+	w.s.objects[w.bucket][w.object] = &memObject{data:data, attrs:copyAttrs(&attrs)}
+	return nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,216 @@
+package gcs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+/*
+
+ // Code that takes an ObjectStore can run against GCS ...
+ var store gcs.ObjectStore = gcs.NewGCSStore(c)
+ // ... or a directory, on a dev server ...
+ store,err := gcs.NewLocalStore("/tmp/gcs")
+ // ... or memory, in tests
+ store := gcs.NewMemoryStore()
+
+ w := store.NewWriter(ctx, "mybucket", "state.json", gcs.WithContentType("application/json"))
+ ...
+ r,attrs,err := store.NewReader(ctx, "mybucket", "state.json")
+
+ // Conditional writes behave the same in all of them
+ w := store.NewWriter(ctx, "mybucket", "state.json", gcs.WithGenerationMatch(attrs.Generation))
+ ...
+ if err := w.Close(); gcs.IsPreconditionFailed(err) {
+   ... someone else wrote it since we read it ...
+ }
+
+ for attrs,err := range gcs.AllObjects(ctx, store, "mybucket", &gcs.ListOptions{Prefix:"logs/"}) { ... }
+
+ */
+
+var ErrPreconditionFailed = errors.New("gcs: precondition failed")
+
+// ObjectStore is the part of GCS that most code needs, so that it can be swapped out; see
+// NewGCSStore, NewLocalStore and NewMemoryStore. Missing objects give errors that wrap
+// ErrNotExist, and failed conditional writes give errors that wrap ErrPreconditionFailed.
+//
+// Writers only create (or replace) the object when Close returns nil; to abandon a write,
+// cancel its context before calling Close. Of the ObjectOptions, only WithChunkSize is specific
+// to GCS; the others (including WithGenerationMatch) work everywhere.
+type ObjectStore interface {
+	// NewReader also returns the object's attributes as of the read, including the generation
+	// for use with WithGenerationMatch.
+	NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, *storage.ObjectAttrs, error)
+	NewWriter(ctx context.Context, bucket, object string, opts ...ObjectOption) io.WriteCloser
+	Stat(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error)
+	Delete(ctx context.Context, bucket, object string) error
+	List(ctx context.Context, bucket string, opts *ListOptions) (*ListPage, error)
+}
+
+// AllObjects is Client.Objects, for any ObjectStore; it pages through List.
+func AllObjects(ctx context.Context, store ObjectStore, bucket string, opts *ListOptions) iter.Seq2[*storage.ObjectAttrs, error] {
+	return func(yield func(*storage.ObjectAttrs, error) bool) {
+		pageOpts := ListOptions{}
+		if opts != nil { pageOpts = *opts }
+		for {
+			page,err := store.List(ctx, bucket, &pageOpts)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _,attrs := range page.Objects {
+				if !yield(attrs, nil) { return }
+			}
+			for _,prefix := range page.Prefixes {
+				if !yield(&storage.ObjectAttrs{Prefix:prefix}, nil) { return }
+			}
+			if page.NextPageToken == "" {
+				return
+			}
+			pageOpts.PageToken = page.NextPageToken
+		}
+	}
+}
+
+// {{{ GCSStore
+
+// GCSStore is the ObjectStore for the real thing.
+type GCSStore struct {
+	*Client
+}
+
+func NewGCSStore(c *Client) GCSStore {
+	return GCSStore{c}
+}
+
+// translateErr makes GCS's precondition failures wrap ErrPreconditionFailed.
+func translateErr(err error) error {
+	if err != nil && !errors.Is(err, ErrPreconditionFailed) && IsPreconditionFailed(err) {
+		return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+	}
+	return err
+}
+
+// NewReader gets the attributes first, and then reads that generation of the object; so they
+// match, and are as complete as the other stores'.
+func (s GCSStore)NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	obj := s.Bucket(bucket).Object(object)
+	attrs,err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gcs.NewReader: gs://%s/%s: %w", bucket, object, err)
+	}
+	r,err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gcs.NewReader: gs://%s/%s: %w", bucket, object, err)
+	}
+	return r, attrs, nil
+}
+
+type gcsStoreWriter struct {
+	*storage.Writer
+}
+
+func (w gcsStoreWriter)Close() error {
+	return translateErr(w.Writer.Close())
+}
+
+func (s GCSStore)NewWriter(ctx context.Context, bucket, object string, opts ...ObjectOption) io.WriteCloser {
+	return gcsStoreWriter{s.Client.NewWriter(ctx, bucket, object, opts...)}
+}
+
+// }}}
+// {{{ listObjects
+
+// listObjects does the work of List for the emulated stores; objs must be sorted by name. The
+// page tokens are the (encoded) last name, or prefix, on the previous page.
+func listObjects(objs []*storage.ObjectAttrs, opts *ListOptions) (*ListPage, error) {
+	o := ListOptions{}
+	if opts != nil { o = *opts }
+	if o.PageSize <= 0 { o.PageSize = 1000 }
+
+	after := ""
+	if o.PageToken != "" {
+		b,err := base64.RawURLEncoding.DecodeString(o.PageToken)
+		if err != nil {
+			return nil, fmt.Errorf("bad page token %q", o.PageToken)
+		}
+		after = string(b)
+	}
+
+	page := ListPage{Objects:[]*storage.ObjectAttrs{}, Prefixes:[]string{}}
+	last := ""
+	for _,attrs := range objs {
+		if !strings.HasPrefix(attrs.Name, o.Prefix) {
+			continue
+		}
+		// Objects below a delimiter are rolled up into a single pseudo-directory
+		entry, isPrefix := attrs.Name, false
+		if rest := attrs.Name[len(o.Prefix):]; o.Delimiter != "" {
+			if i := strings.Index(rest, o.Delimiter); i >= 0 {
+				entry, isPrefix = o.Prefix + rest[:i+len(o.Delimiter)], true
+			}
+		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if len(page.Objects) + len(page.Prefixes) >= o.PageSize {
+			page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = entry
+		if isPrefix {
+			page.Prefixes = append(page.Prefixes, entry)
+		} else {
+			page.Objects = append(page.Objects, attrs)
+		}
+	}
+	return &page, nil
+}
+
+func sortByName(objs []*storage.ObjectAttrs) {
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+}
+
+// copyAttrs returns a copy that the caller can't use to change ours.
+func copyAttrs(in *storage.ObjectAttrs) *storage.ObjectAttrs {
+	out := *in
+	if in.Metadata != nil {
+		out.Metadata = map[string]string{}
+		for k,v := range in.Metadata { out.Metadata[k] = v }
+	}
+	out.MD5 = append([]byte{}, in.MD5...)
+	return &out
+}
+
+// checkGeneration applies any WithGenerationMatch precondition; current is zero if the object
+// doesn't exist.
+func checkGeneration(cfg objectConfig, bucket, object string, current int64) error {
+	if cfg.genMatch != nil && *cfg.genMatch != current {
+		return fmt.Errorf("%w: gs://%s/%s is at generation %d, not %d", ErrPreconditionFailed,
+			bucket, object, current, *cfg.genMatch)
+	}
+	return nil
+}
+
+func notExist(op, bucket, object string) error {
+	return fmt.Errorf("gcs.%s: gs://%s/%s: %w", op, bucket, object, ErrNotExist)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
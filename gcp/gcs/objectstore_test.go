@@ -0,0 +1,192 @@
+package gcs
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// go test -v github.com/skypies/util/gcp/gcs
+
+var _ ObjectStore = GCSStore{}
+
+func TestMemoryStore(t *testing.T) {
+	testObjectStore(t, NewMemoryStore())
+}
+
+func TestLocalStore(t *testing.T) {
+	store,err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	testObjectStore(t, store)
+
+	// Bucket names can't reach outside the store's directory
+	for _,bucket := range []string{"", ".", "..", "a/b"} {
+		if err := storeBucketWrite(store, bucket); err == nil {
+			t.Errorf("write to bucket %q: expected an error", bucket)
+		}
+	}
+}
+
+func storeBucketWrite(store ObjectStore, bucket string) error {
+	w := store.NewWriter(context.Background(), bucket, "x")
+	io.WriteString(w, "x")
+	return w.Close()
+}
+
+func storeWrite(ctx context.Context, store ObjectStore, object, contents string, opts ...ObjectOption) error {
+	w := store.NewWriter(ctx, "mybucket", object, opts...)
+	if _,err := io.WriteString(w, contents); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func storeRead(t *testing.T, store ObjectStore, object string) (string, int64) {
+	t.Helper()
+	r,attrs,err := store.NewReader(context.Background(), "mybucket", object)
+	if err != nil {
+		t.Fatalf("NewReader(%s): %v", object, err)
+	}
+	defer r.Close()
+	b,err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", object, err)
+	}
+	return string(b), attrs.Generation
+}
+
+// testObjectStore is run against each of the emulated stores, which should behave the same.
+func testObjectStore(t *testing.T, store ObjectStore) {
+	ctx := context.Background()
+
+	// Missing objects
+	if _,_,err := store.NewReader(ctx, "mybucket", "nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("NewReader of missing object: got %v", err)
+	}
+	if _,err := store.Stat(ctx, "mybucket", "nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat of missing object: got %v", err)
+	}
+	if err := store.Delete(ctx, "mybucket", "nope"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Delete of missing object: got %v", err)
+	}
+
+	// Write, read, stat
+	err := storeWrite(ctx, store, "state.json", `{"n":1}`, WithGenerationMatch(0),
+		WithContentType("application/json"), WithMetadata(map[string]string{"k":"v"}))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	data,gen1 := storeRead(t, store, "state.json")
+	if data != `{"n":1}` || gen1 == 0 {
+		t.Errorf("read: got %q, gen %d", data, gen1)
+	}
+	attrs,err := store.Stat(ctx, "mybucket", "state.json")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if attrs.Generation != gen1 || attrs.Size != 7 || attrs.ContentType != "application/json" ||
+		attrs.Metadata["k"] != "v" {
+		t.Errorf("Stat: unexpected attrs %+v", attrs)
+	}
+
+	// Preconditions
+	if err := storeWrite(ctx, store, "state.json", "x", WithGenerationMatch(0)); !IsPreconditionFailed(err) {
+		t.Errorf("create of existing object: got %v", err)
+	}
+	if err := storeWrite(ctx, store, "state.json", `{"n":2}`, WithGenerationMatch(gen1)); err != nil {
+		t.Fatalf("conditional write: %v", err)
+	}
+	data,gen2 := storeRead(t, store, "state.json")
+	if data != `{"n":2}` || gen2 <= gen1 {
+		t.Errorf("after conditional write: got %q, gen %d (was %d)", data, gen2, gen1)
+	}
+	if err := storeWrite(ctx, store, "state.json", "stale", WithGenerationMatch(gen1)); !IsPreconditionFailed(err) {
+		t.Errorf("write at stale generation: got %v", err)
+	}
+	if data,_ := storeRead(t, store, "state.json"); data != `{"n":2}` {
+		t.Errorf("failed write changed the object: got %q", data)
+	}
+
+	// An abandoned write leaves the object alone
+	cctx,cancel := context.WithCancel(ctx)
+	w := store.NewWriter(cctx, "mybucket", "state.json")
+	io.WriteString(w, "abandoned")
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Errorf("abandoned write: expected an error")
+	} else if err2 := w.Close(); err2 != err {
+		t.Errorf("abandoned write: second Close should return the same error, got %v", err2)
+	}
+	w = store.NewWriter(ctx, "mybucket", "state.json", WithGenerationMatch(0))
+	io.WriteString(w, "conflict")
+	if err := w.Close(); !IsPreconditionFailed(err) {
+		t.Errorf("conflicting write: got %v", err)
+	} else if err2 := w.Close(); err2 != err {
+		t.Errorf("conflicting write: second Close should return the same error, got %v", err2)
+	}
+	if data,gen := storeRead(t, store, "state.json"); data != `{"n":2}` || gen != gen2 {
+		t.Errorf("abandoned write changed the object: got %q, gen %d", data, gen)
+	}
+
+	// List
+	for i,name := range []string{"logs/1.csv", "logs/2.csv", "logs/old/1.csv", "z.txt"} {
+		if err := storeWrite(ctx, store, name, fmt.Sprintf("%d", i)); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	page,err := store.List(ctx, "mybucket", &ListOptions{Delimiter:"/"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	names := []string{}
+	for _,attrs := range page.Objects { names = append(names, attrs.Name) }
+	if strings.Join(names, ",") != "state.json,z.txt" || strings.Join(page.Prefixes, ",") != "logs/" {
+		t.Errorf("List: got %v, prefixes %v", names, page.Prefixes)
+	}
+
+	opts := &ListOptions{Prefix:"logs/", PageSize:2}
+	names = []string{}
+	for pages:=1; ; pages++ {
+		page,err := store.List(ctx, "mybucket", opts)
+		if err != nil {
+			t.Fatalf("List page %d: %v", pages, err)
+		}
+		for _,attrs := range page.Objects { names = append(names, attrs.Name) }
+		if page.NextPageToken == "" {
+			if pages != 2 { t.Errorf("expected 2 pages, got %d", pages) }
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	if strings.Join(names, ",") != "logs/1.csv,logs/2.csv,logs/old/1.csv" {
+		t.Errorf("paged List: got %v", names)
+	}
+
+	names = []string{}
+	for attrs,err := range AllObjects(ctx, store, "mybucket", &ListOptions{PageSize:1}) {
+		if err != nil {
+			t.Fatalf("AllObjects: %v", err)
+		}
+		names = append(names, attrs.Name)
+	}
+	if strings.Join(names, ",") != "logs/1.csv,logs/2.csv,logs/old/1.csv,state.json,z.txt" {
+		t.Errorf("AllObjects: got %v", names)
+	}
+
+	// Delete
+	if err := store.Delete(ctx, "mybucket", "z.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _,err := store.Stat(ctx, "mybucket", "z.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat after Delete: got %v", err)
+	}
+	if page,err := store.List(ctx, "otherbucket", nil); err != nil || len(page.Objects) != 0 {
+		t.Errorf("List of empty bucket: got %v, %v", page, err)
+	}
+}